@@ -0,0 +1,253 @@
+// Package alert evaluates rules on the records read by the pipeline and sends the alerts to webhooks,
+// as a backup to the alarms of Nightscout itself.
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ns-exporter/model"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RuleLow       = "low"
+	RuleHigh      = "high"
+	RuleFall      = "fall"
+	RuleNoLoop    = "no-loop"
+	RuleReservoir = "reservoir"
+	RuleBattery   = "battery"
+	RuleSensorAge = "sensor-age"
+
+	// DefaultCooldown is the time an alert of a rule is not repeated for
+	DefaultCooldown = 30 * time.Minute
+	// stale readings are not used by the glucose rules, a sensor may be disconnected for a while
+	stale = 15 * time.Minute
+	// readings closer than this are the same reading, e.g. an entry and the BG of a devicestatus
+	sameReading = time.Minute
+	// the fall rate is computed from readings at least this far apart, so it is not skewed by jitter
+	fallSpan = 4 * time.Minute
+)
+
+// Rules are the thresholds of the alerts, zero values disable a rule. Glucose is in mg/dL.
+type Rules struct {
+	Low     float64
+	LowFor  time.Duration
+	High    float64
+	HighFor time.Duration
+	// Fall is the drop in mg/dL per 5 minutes
+	Fall float64
+	// NoLoop is the time without devicestatus of the loop
+	NoLoop time.Duration
+	// Reservoir is in units and Battery in percent of the pump
+	Reservoir float64
+	Battery   float64
+	// SensorAge is the time since the last 'Sensor Change' or 'Sensor Start' treatment
+	SensorAge time.Duration
+	// Cooldown is the time an alert of a user and rule is not repeated for, DefaultCooldown when zero
+	Cooldown time.Duration
+}
+
+// Alert is a rule which fired for a user
+type Alert struct {
+	User    string    `json:"user"`
+	Rule    string    `json:"rule"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Value   float64   `json:"value"`
+}
+
+type reading struct {
+	time  time.Time
+	value float64
+}
+
+// state is what is known of a user, the latest values whatever the order the records are read in
+type state struct {
+	readings     []reading
+	status       time.Time
+	reservoir    float64
+	battery      float64
+	sensorChange time.Time
+}
+
+// Monitor keeps the latest values of every user from the records it is shown and fires the alerts of the rules
+// when evaluated, a pipeline.Observer. It is safe for concurrent use.
+type Monitor struct {
+	rules    Rules
+	webhooks []Webhook
+	now      func() time.Time
+
+	mutex sync.Mutex
+	users map[string]*state
+	fired map[string]time.Time
+}
+
+func NewMonitor(rules Rules, webhooks ...Webhook) *Monitor {
+	if rules.Cooldown <= 0 {
+		rules.Cooldown = DefaultCooldown
+	}
+	return &Monitor{rules: rules, webhooks: webhooks, now: time.Now, users: map[string]*state{}, fired: map[string]time.Time{}}
+}
+
+func (m *Monitor) DeviceStatus(entry model.NsEntry) {
+	if !entry.Valid() || entry.Time.IsZero() {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var user = m.user(entry.User)
+	if bg := entry.OpenAps.Suggested.Bg.Float(); bg > 0 {
+		user.add(reading{entry.Time, bg})
+	}
+	if entry.Time.After(user.status) {
+		user.status = entry.Time
+		user.reservoir = entry.Pump.Reservoir.Float()
+		user.battery = entry.Pump.Battery.Percent.Float()
+	}
+}
+
+func (m *Monitor) Treatment(treatment model.NsTreatment) {
+	if !treatment.Valid() || (treatment.EventType != "Sensor Change" && treatment.EventType != "Sensor Start") {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var user = m.user(treatment.User)
+	if treatment.CreatedAt.After(user.sensorChange) {
+		user.sensorChange = treatment.CreatedAt
+	}
+}
+
+func (m *Monitor) Sgv(sgv model.NsSgv) {
+	if !sgv.Valid() || sgv.Type != "sgv" || sgv.Sgv <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.user(sgv.User).add(reading{sgv.Time, sgv.Sgv.Float()})
+}
+
+func (m *Monitor) user(name string) *state {
+	if m.users[name] == nil {
+		m.users[name] = &state{}
+	}
+	return m.users[name]
+}
+
+// add keeps the readings ordered by time, readings of more than a day before the latest one are dropped
+func (s *state) add(value reading) {
+	for _, existing := range s.readings {
+		if existing.time.Sub(value.time) < sameReading && value.time.Sub(existing.time) < sameReading {
+			return
+		}
+	}
+	s.readings = append(s.readings, value)
+	sort.Slice(s.readings, func(i, j int) bool { return s.readings[i].time.Before(s.readings[j].time) })
+	var latest = s.readings[len(s.readings)-1].time
+	for len(s.readings) > 0 && latest.Sub(s.readings[0].time) > 24*time.Hour {
+		s.readings = s.readings[1:]
+	}
+}
+
+// Evaluate sends the alerts of the rules which fire now and did not fire within the cooldown
+func (m *Monitor) Evaluate(ctx context.Context) error {
+	m.mutex.Lock()
+	var now = m.now()
+	var alerts []Alert
+	for name, user := range m.users {
+		for _, alert := range m.rules.evaluate(name, user, now) {
+			if last, ok := m.fired[alert.User+"\x00"+alert.Rule]; ok && now.Sub(last) < m.rules.Cooldown {
+				continue
+			}
+			alerts = append(alerts, alert)
+		}
+	}
+	m.mutex.Unlock()
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].User < alerts[j].User || (alerts[i].User == alerts[j].User && alerts[i].Rule < alerts[j].Rule)
+	})
+
+	var errs []string
+	for _, alert := range alerts {
+		fmt.Println("alert: ", alert.Message)
+		var failed = false
+		for _, webhook := range m.webhooks {
+			if err := webhook.Send(ctx, alert); err != nil {
+				errs = append(errs, err.Error())
+				failed = true
+			}
+		}
+		// alerts which could not be sent are tried again in the next run
+		if !failed {
+			m.mutex.Lock()
+			m.fired[alert.User+"\x00"+alert.Rule] = now
+			m.mutex.Unlock()
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// evaluate returns the alerts of the rules firing for the user
+func (r Rules) evaluate(name string, user *state, now time.Time) []Alert {
+	var alerts []Alert
+	var fire = func(rule string, value float64, format string, args ...interface{}) {
+		alerts = append(alerts, Alert{User: name, Rule: rule, Time: now, Value: value, Message: name + ": " + fmt.Sprintf(format, args...)})
+	}
+
+	if len(user.readings) > 0 && now.Sub(user.readings[len(user.readings)-1].time) <= stale {
+		var latest = user.readings[len(user.readings)-1]
+		if since, ok := user.since(func(value float64) bool { return value < r.Low }); r.Low > 0 && ok && latest.time.Sub(since) >= r.LowFor {
+			fire(RuleLow, latest.value, "BG %g mg/dL below %g since %s", latest.value, r.Low, since.UTC().Format(time.RFC3339))
+		}
+		if since, ok := user.since(func(value float64) bool { return value > r.High }); r.High > 0 && ok && latest.time.Sub(since) >= r.HighFor {
+			fire(RuleHigh, latest.value, "BG %g mg/dL above %g since %s", latest.value, r.High, since.UTC().Format(time.RFC3339))
+		}
+		if rate, ok := user.fallRate(); r.Fall > 0 && ok && rate >= r.Fall {
+			fire(RuleFall, rate, "BG %g mg/dL falling by %.0f mg/dL per 5 minutes", latest.value, rate)
+		}
+	}
+	if r.NoLoop > 0 && !user.status.IsZero() && now.Sub(user.status) >= r.NoLoop {
+		fire(RuleNoLoop, now.Sub(user.status).Minutes(), "no loop activity for %s", now.Sub(user.status).Round(time.Minute))
+	}
+	if r.Reservoir > 0 && user.reservoir > 0 && user.reservoir < r.Reservoir {
+		fire(RuleReservoir, user.reservoir, "pump reservoir %g U below %g U", user.reservoir, r.Reservoir)
+	}
+	if r.Battery > 0 && user.battery > 0 && user.battery < r.Battery {
+		fire(RuleBattery, user.battery, "pump battery %g%% below %g%%", user.battery, r.Battery)
+	}
+	if r.SensorAge > 0 && !user.sensorChange.IsZero() && now.Sub(user.sensorChange) >= r.SensorAge {
+		fire(RuleSensorAge, now.Sub(user.sensorChange).Hours(), "sensor inserted %s ago", now.Sub(user.sensorChange).Round(time.Hour))
+	}
+	return alerts
+}
+
+// since returns the time of the first of the latest readings matching, false when the latest reading does not match
+func (s *state) since(matches func(value float64) bool) (time.Time, bool) {
+	var since time.Time
+	for i := len(s.readings) - 1; i >= 0 && matches(s.readings[i].value); i-- {
+		since = s.readings[i].time
+	}
+	return since, !since.IsZero()
+}
+
+// fallRate returns the drop per 5 minutes between the latest reading and the one before it, positive when falling
+func (s *state) fallRate() (float64, bool) {
+	var latest = s.readings[len(s.readings)-1]
+	for i := len(s.readings) - 2; i >= 0; i-- {
+		var span = latest.time.Sub(s.readings[i].time)
+		if span > stale {
+			break
+		}
+		if span >= fallSpan {
+			return (s.readings[i].value - latest.value) / span.Minutes() * 5, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,164 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/model"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver collects the alerts posted to a json webhook
+type receiver struct {
+	mutex  sync.Mutex
+	alerts []Alert
+}
+
+func newReceiver(t *testing.T) (*receiver, Webhook) {
+	var r = &receiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(req.Body).Decode(&alert); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.alerts = append(r.alerts, alert)
+	}))
+	t.Cleanup(server.Close)
+	webhook, err := ParseWebhook(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, webhook
+}
+
+func (r *receiver) rules() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var rules []string
+	for _, alert := range r.alerts {
+		rules = append(rules, alert.User+" "+alert.Rule)
+	}
+	r.alerts = nil
+	return rules
+}
+
+func sgv(user string, at time.Time, value float64) model.NsSgv {
+	return model.NsSgv{User: user, Type: "sgv", Sgv: model.Number(value), Time: at}
+}
+
+func TestMonitor(t *testing.T) {
+	var now = time.Date(2022, 6, 8, 12, 0, 0, 0, time.UTC)
+	received, webhook := newReceiver(t)
+	monitor := NewMonitor(Rules{
+		Low: 70, LowFor: 10 * time.Minute, High: 250, Fall: 10, NoLoop: 30 * time.Minute,
+		Reservoir: 20, Battery: 10, SensorAge: 10 * 24 * time.Hour,
+	}, webhook)
+	monitor.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// john is low for 10 minutes and falling fast, readings arrive newest first
+	for i, value := range []float64{50, 62, 68, 90} {
+		monitor.Sgv(sgv("john", now.Add(time.Duration(-5*i)*time.Minute), value))
+	}
+	// jane's BG of the loop is fine, but the pump runs out and the loop stopped
+	var status = model.NsEntry{User: "jane", Time: now.Add(-40 * time.Minute)}
+	status.OpenAps.Suggested.Bg = 120
+	status.Pump.Reservoir = 15
+	status.Pump.Battery.Percent = 50
+	monitor.DeviceStatus(status)
+	monitor.Treatment(model.NsTreatment{User: "jane", EventType: "Sensor Change", CreatedAt: now.Add(-11 * 24 * time.Hour)})
+	// deleted records are ignored
+	var deleted = false
+	var high = sgv("jane", now, 300)
+	high.IsValid = &deleted
+	monitor.Sgv(high)
+
+	if err := monitor.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"jane no-loop", "jane reservoir", "jane sensor-age", "john fall", "john low"}
+	if rules := received.rules(); !equal(rules, expected) {
+		t.Errorf("unexpected alerts %v, expected %v", rules, expected)
+	}
+
+	// alerts are not repeated within the cooldown
+	now = now.Add(5 * time.Minute)
+	monitor.Sgv(sgv("john", now, 60))
+	if err := monitor.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rules := received.rules(); len(rules) != 0 {
+		t.Errorf("alerts repeated within cooldown %v", rules)
+	}
+
+	now = now.Add(DefaultCooldown)
+	var recent = model.NsEntry{User: "jane", Time: now}
+	recent.Pump.Reservoir = 150
+	monitor.DeviceStatus(recent)
+	if err := monitor.Evaluate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// john's readings are stale by now, jane's loop is running with a new reservoir
+	expected = []string{"jane sensor-age"}
+	if rules := received.rules(); !equal(rules, expected) {
+		t.Errorf("unexpected alerts after cooldown %v, expected %v", rules, expected)
+	}
+}
+
+func TestMonitorDurations(t *testing.T) {
+	var now = time.Date(2022, 6, 8, 12, 0, 0, 0, time.UTC)
+	monitor := NewMonitor(Rules{Low: 70, LowFor: 20 * time.Minute, High: 180, HighFor: 5 * time.Minute})
+	monitor.now = func() time.Time { return now }
+	for i, value := range []float64{65, 66, 72, 64, 200, 190} {
+		monitor.Sgv(sgv("john", now.Add(time.Duration(-5*i)*time.Minute), value))
+		// a reading of the loop within a minute of an entry is the same reading
+		var status = model.NsEntry{User: "john", Time: now.Add(time.Duration(-5*i)*time.Minute + 30*time.Second)}
+		status.OpenAps.Suggested.Bg = 500
+		monitor.DeviceStatus(status)
+	}
+	// low for 5 minutes only, the reading before was above the threshold
+	if alerts := monitor.rules.evaluate("john", monitor.users["john"], now); len(alerts) != 0 {
+		t.Errorf("unexpected alerts %v", alerts)
+	}
+	// high for 5 minutes, at the time of the older readings
+	if alerts := monitor.rules.evaluate("john", &state{readings: monitor.users["john"].readings[:2]}, now.Add(-20*time.Minute)); len(alerts) != 1 || alerts[0].Rule != RuleHigh || alerts[0].Value != 200 {
+		t.Errorf("unexpected alerts %v", alerts)
+	}
+}
+
+func TestMonitorFailedWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	webhook, _ := ParseWebhook(server.URL)
+	monitor := NewMonitor(Rules{Reservoir: 20}, webhook)
+	var status = model.NsEntry{User: "john", Time: time.Now()}
+	status.Pump.Reservoir = 10
+	monitor.DeviceStatus(status)
+	if err := monitor.Evaluate(context.Background()); err == nil {
+		t.Fatal("failed webhook not reported")
+	}
+	// alerts which were not sent are not in cooldown
+	if len(monitor.fired) != 0 {
+		t.Errorf("unsent alert in cooldown %v", monitor.fired)
+	}
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// FormatJSON posts the alert as JSON
+	FormatJSON = "json"
+	// FormatTelegram posts to the sendMessage method of the Telegram bot API, with chat_id in the url query
+	FormatTelegram = "telegram"
+	// FormatPushover posts a Pushover message, with token and user in the url query
+	FormatPushover = "pushover"
+)
+
+// Formats are the payload formats of webhooks
+var Formats = []string{FormatJSON, FormatTelegram, FormatPushover}
+
+// Webhook receives the alerts with HTTP POST
+type Webhook struct {
+	Format string
+	URL    string
+}
+
+// ParseWebhook parses a webhook as [format:]url, the format is json when not given,
+// e.g. telegram:https://api.telegram.org/bot<token>/sendMessage?chat_id=<chat>
+func ParseWebhook(spec string) (Webhook, error) {
+	var webhook = Webhook{Format: FormatJSON, URL: spec}
+	for _, format := range Formats {
+		if strings.HasPrefix(spec, format+":") {
+			webhook.Format, webhook.URL = format, strings.TrimPrefix(spec, format+":")
+		}
+	}
+	uri, err := url.Parse(webhook.URL)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		return webhook, fmt.Errorf("invalid webhook %q, expected [format:]url with format %s", spec, strings.Join(Formats, ", "))
+	}
+	var query = uri.Query()
+	switch webhook.Format {
+	case FormatTelegram:
+		if query.Get("chat_id") == "" {
+			return webhook, fmt.Errorf("telegram webhook %s: chat_id missing in url", uri.Host)
+		}
+	case FormatPushover:
+		if query.Get("token") == "" || query.Get("user") == "" {
+			return webhook, fmt.Errorf("pushover webhook %s: token or user missing in url", uri.Host)
+		}
+	}
+	return webhook, nil
+}
+
+// Send posts the alert in the format of the webhook
+func (w Webhook) Send(ctx context.Context, alert Alert) error {
+	uri, err := url.Parse(w.URL)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	var contentType = "application/json"
+	switch w.Format {
+	case FormatTelegram:
+		// the chat is moved from the query to the body, so the message is not limited by the url length
+		var query = uri.Query()
+		body, err = json.Marshal(map[string]string{"chat_id": query.Get("chat_id"), "text": alert.Message})
+		query.Del("chat_id")
+		uri.RawQuery = query.Encode()
+	case FormatPushover:
+		// the credentials are moved from the query to the form, so they are not logged by proxies
+		var query = uri.Query()
+		var form = url.Values{
+			"token":   {query.Get("token")},
+			"user":    {query.Get("user")},
+			"title":   {"ns-exporter " + alert.Rule},
+			"message": {alert.Message},
+		}
+		body, contentType = []byte(form.Encode()), "application/x-www-form-urlencoded"
+		query.Del("token")
+		query.Del("user")
+		uri.RawQuery = query.Encode()
+	default:
+		body, err = json.Marshal(alert)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// the url may hold credentials, e.g. the bot token of Telegram
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("can't send alert to %s webhook %s: %w", w.Format, uri.Host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		response, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s webhook %s responded %s: %s", w.Format, uri.Host, resp.Status, bytes.TrimSpace(response))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookFormats(t *testing.T) {
+	type request struct {
+		path        string
+		contentType string
+		body        string
+	}
+	var requests = make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		requests <- request{req.URL.RequestURI(), req.Header.Get("Content-Type"), string(body)}
+	}))
+	defer server.Close()
+
+	var alert = Alert{User: "john", Rule: RuleLow, Message: "john: BG 62 mg/dL below 70", Time: time.Date(2022, 6, 8, 12, 0, 0, 0, time.UTC), Value: 62}
+	var tests = []struct {
+		spec        string
+		path        string
+		contentType string
+		body        string
+	}{
+		{server.URL + "/hook", "/hook", "application/json", `{"user":"john","rule":"low","message":"john: BG 62 mg/dL below 70","time":"2022-06-08T12:00:00Z","value":62}`},
+		{"telegram:" + server.URL + "/bot123/sendMessage?chat_id=42", "/bot123/sendMessage", "application/json", `{"chat_id":"42","text":"john: BG 62 mg/dL below 70"}`},
+		{"pushover:" + server.URL + "/1/messages.json?token=app&user=key", "/1/messages.json", "application/x-www-form-urlencoded",
+			url.Values{"token": {"app"}, "user": {"key"}, "title": {"ns-exporter low"}, "message": {alert.Message}}.Encode()},
+	}
+	for _, test := range tests {
+		webhook, err := ParseWebhook(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := webhook.Send(context.Background(), alert); err != nil {
+			t.Fatal(err)
+		}
+		received := <-requests
+		if received.path != test.path || received.contentType != test.contentType {
+			t.Errorf("%s: unexpected request %s %s", webhook.Format, received.path, received.contentType)
+		}
+		if webhook.Format == FormatJSON {
+			var decoded Alert
+			if err := json.Unmarshal([]byte(received.body), &decoded); err != nil || decoded != alert {
+				t.Errorf("unexpected alert %s", received.body)
+			}
+		} else if received.body != test.body {
+			t.Errorf("%s: unexpected body %s, expected %s", webhook.Format, received.body, test.body)
+		}
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	for _, spec := range []string{"", "hook", "ftp://example.com", "telegram:https://api.telegram.org/bot1/sendMessage", "pushover:https://api.pushover.net/1/messages.json?token=app", "sms:https://example.com"} {
+		if _, err := ParseWebhook(spec); err == nil {
+			t.Errorf("invalid webhook %q accepted", spec)
+		}
+	}
+	webhook, err := ParseWebhook("https://example.com/hooks/json:1")
+	if err != nil || webhook.Format != FormatJSON || webhook.URL != "https://example.com/hooks/json:1" {
+		t.Errorf("unexpected webhook %v, %v", webhook, err)
+	}
+}
+
+func TestWebhookHidesCredentials(t *testing.T) {
+	webhook, _ := ParseWebhook("telegram:http://127.0.0.1:1/botsecret/sendMessage?chat_id=42")
+	err := webhook.Send(context.Background(), Alert{Message: "test"})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
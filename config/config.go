@@ -0,0 +1,338 @@
+// Package config reads the configuration file, in JSON, YAML or TOML.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config holds every command line argument under its name, and the list of imports which can only be set in the file
+type Config struct {
+	NsUri                 string   `json:"ns-uri,omitempty" yaml:"ns-uri" toml:"ns-uri"`
+	NsToken               string   `json:"ns-token,omitempty" yaml:"ns-token" toml:"ns-token"`
+	NsTokenFile           string   `json:"ns-token-file,omitempty" yaml:"ns-token-file" toml:"ns-token-file"`
+	MongoUri              string   `json:"mongo-uri,omitempty" yaml:"mongo-uri" toml:"mongo-uri"`
+	MongoUriFile          string   `json:"mongo-uri-file,omitempty" yaml:"mongo-uri-file" toml:"mongo-uri-file"`
+	MongoDb               string   `json:"mongo-db,omitempty" yaml:"mongo-db" toml:"mongo-db"`
+	Limit                 int64    `json:"limit,omitempty" yaml:"limit" toml:"limit"`
+	Skip                  int64    `json:"skip,omitempty" yaml:"skip" toml:"skip"`
+	InfluxUri             string   `json:"influx-uri,omitempty" yaml:"influx-uri" toml:"influx-uri"`
+	InfluxToken           string   `json:"influx-token,omitempty" yaml:"influx-token" toml:"influx-token"`
+	InfluxTokenFile       string   `json:"influx-token-file,omitempty" yaml:"influx-token-file" toml:"influx-token-file"`
+	InfluxOrg             string   `json:"influx-org,omitempty" yaml:"influx-org" toml:"influx-org"`
+	InfluxBucket          string   `json:"influx-bucket,omitempty" yaml:"influx-bucket" toml:"influx-bucket"`
+	InfluxVersion         int64    `json:"influx-version,omitempty" yaml:"influx-version" toml:"influx-version"`
+	InfluxUsername        string   `json:"influx-username,omitempty" yaml:"influx-username" toml:"influx-username"`
+	InfluxPassword        string   `json:"influx-password,omitempty" yaml:"influx-password" toml:"influx-password"`
+	InfluxPasswordFile    string   `json:"influx-password-file,omitempty" yaml:"influx-password-file" toml:"influx-password-file"`
+	InfluxRetentionPolicy string   `json:"influx-retention-policy,omitempty" yaml:"influx-retention-policy" toml:"influx-retention-policy"`
+	CreateBucket          bool     `json:"influx-create-bucket,omitempty" yaml:"influx-create-bucket" toml:"influx-create-bucket"`
+	Retention             string   `json:"influx-retention,omitempty" yaml:"influx-retention" toml:"influx-retention"`
+	User                  string   `json:"user,omitempty" yaml:"user" toml:"user"`
+	TreatmentFields       []string `json:"treatment-fields,omitempty" yaml:"treatment-fields" toml:"treatment-fields"`
+	TreatmentTags         []string `json:"treatment-tags,omitempty" yaml:"treatment-tags" toml:"treatment-tags"`
+	SyncDeletes           bool     `json:"sync-deletes,omitempty" yaml:"sync-deletes" toml:"sync-deletes"`
+	IdMode                string   `json:"id-mode,omitempty" yaml:"id-mode" toml:"id-mode"`
+	SourceTags            bool     `json:"source-tags,omitempty" yaml:"source-tags" toml:"source-tags"`
+	Timezone              string   `json:"timezone,omitempty" yaml:"timezone" toml:"timezone"`
+	LocalTimeTags         bool     `json:"local-time-tags,omitempty" yaml:"local-time-tags" toml:"local-time-tags"`
+	DedupTolerance        string   `json:"dedup-tolerance,omitempty" yaml:"dedup-tolerance" toml:"dedup-tolerance"`
+	Timeout               string   `json:"timeout,omitempty" yaml:"timeout" toml:"timeout"`
+	From                  string   `json:"from,omitempty" yaml:"from" toml:"from"`
+	To                    string   `json:"to,omitempty" yaml:"to" toml:"to"`
+	Collections           []string `json:"collections,omitempty" yaml:"collections" toml:"collections"`
+	Interval              string   `json:"interval,omitempty" yaml:"interval" toml:"interval"`
+	GapThreshold          string   `json:"gap-threshold,omitempty" yaml:"gap-threshold" toml:"gap-threshold"`
+	Anonymize             bool     `json:"anonymize,omitempty" yaml:"anonymize" toml:"anonymize"`
+	AnonymizeSecret       string   `json:"anonymize-secret,omitempty" yaml:"anonymize-secret" toml:"anonymize-secret"`
+	AnonymizeSecretFile   string   `json:"anonymize-secret-file,omitempty" yaml:"anonymize-secret-file" toml:"anonymize-secret-file"`
+	AnonymizeText         string   `json:"anonymize-text,omitempty" yaml:"anonymize-text" toml:"anonymize-text"`
+	AnonymizeShiftDays    int64    `json:"anonymize-shift-days,omitempty" yaml:"anonymize-shift-days" toml:"anonymize-shift-days"`
+	DryRun                bool     `json:"dry-run,omitempty" yaml:"dry-run" toml:"dry-run"`
+	ReplicateNsUri        string   `json:"replicate-ns-uri,omitempty" yaml:"replicate-ns-uri" toml:"replicate-ns-uri"`
+	ReplicateNsToken      string   `json:"replicate-ns-token,omitempty" yaml:"replicate-ns-token" toml:"replicate-ns-token"`
+	ReplicateNsTokenFile  string   `json:"replicate-ns-token-file,omitempty" yaml:"replicate-ns-token-file" toml:"replicate-ns-token-file"`
+	ReplicateMongoUri     string   `json:"replicate-mongo-uri,omitempty" yaml:"replicate-mongo-uri" toml:"replicate-mongo-uri"`
+	ReplicateMongoUriFile string   `json:"replicate-mongo-uri-file,omitempty" yaml:"replicate-mongo-uri-file" toml:"replicate-mongo-uri-file"`
+	ReplicateMongoDb      string   `json:"replicate-mongo-db,omitempty" yaml:"replicate-mongo-db" toml:"replicate-mongo-db"`
+	ReplicateCollections  []string `json:"replicate-collections,omitempty" yaml:"replicate-collections" toml:"replicate-collections"`
+	ReplicateState        string   `json:"replicate-state,omitempty" yaml:"replicate-state" toml:"replicate-state"`
+	ReplicateResync       string   `json:"replicate-resync,omitempty" yaml:"replicate-resync" toml:"replicate-resync"`
+	PostgresUri           string   `json:"postgres-uri,omitempty" yaml:"postgres-uri" toml:"postgres-uri"`
+	PostgresUriFile       string   `json:"postgres-uri-file,omitempty" yaml:"postgres-uri-file" toml:"postgres-uri-file"`
+	PostgresTimescale     bool     `json:"postgres-timescale,omitempty" yaml:"postgres-timescale" toml:"postgres-timescale"`
+	PostgresBatch         int64    `json:"postgres-batch,omitempty" yaml:"postgres-batch" toml:"postgres-batch"`
+	SqliteFile            string   `json:"sqlite-file,omitempty" yaml:"sqlite-file" toml:"sqlite-file"`
+	FilesDir              string   `json:"files-dir,omitempty" yaml:"files-dir" toml:"files-dir"`
+	FilesFormats          []string `json:"files-formats,omitempty" yaml:"files-formats" toml:"files-formats"`
+	OtlpEndpoint          string   `json:"otlp-endpoint,omitempty" yaml:"otlp-endpoint" toml:"otlp-endpoint"`
+	OtlpProtocol          string   `json:"otlp-protocol,omitempty" yaml:"otlp-protocol" toml:"otlp-protocol"`
+	MqttUri               string   `json:"mqtt-uri,omitempty" yaml:"mqtt-uri" toml:"mqtt-uri"`
+	MqttUsername          string   `json:"mqtt-username,omitempty" yaml:"mqtt-username" toml:"mqtt-username"`
+	MqttPassword          string   `json:"mqtt-password,omitempty" yaml:"mqtt-password" toml:"mqtt-password"`
+	MqttPasswordFile      string   `json:"mqtt-password-file,omitempty" yaml:"mqtt-password-file" toml:"mqtt-password-file"`
+	MqttTopic             string   `json:"mqtt-topic,omitempty" yaml:"mqtt-topic" toml:"mqtt-topic"`
+	MqttDiscovery         bool     `json:"mqtt-discovery,omitempty" yaml:"mqtt-discovery" toml:"mqtt-discovery"`
+	MqttDiscoveryPrefix   string   `json:"mqtt-discovery-prefix,omitempty" yaml:"mqtt-discovery-prefix" toml:"mqtt-discovery-prefix"`
+	AlertLow              int64    `json:"alert-low,omitempty" yaml:"alert-low" toml:"alert-low"`
+	AlertLowFor           string   `json:"alert-low-for,omitempty" yaml:"alert-low-for" toml:"alert-low-for"`
+	AlertHigh             int64    `json:"alert-high,omitempty" yaml:"alert-high" toml:"alert-high"`
+	AlertHighFor          string   `json:"alert-high-for,omitempty" yaml:"alert-high-for" toml:"alert-high-for"`
+	AlertFall             int64    `json:"alert-fall,omitempty" yaml:"alert-fall" toml:"alert-fall"`
+	AlertNoLoop           string   `json:"alert-no-loop,omitempty" yaml:"alert-no-loop" toml:"alert-no-loop"`
+	AlertReservoir        int64    `json:"alert-reservoir,omitempty" yaml:"alert-reservoir" toml:"alert-reservoir"`
+	AlertBattery          int64    `json:"alert-battery,omitempty" yaml:"alert-battery" toml:"alert-battery"`
+	AlertSensorAge        string   `json:"alert-sensor-age,omitempty" yaml:"alert-sensor-age" toml:"alert-sensor-age"`
+	AlertCooldown         string   `json:"alert-cooldown,omitempty" yaml:"alert-cooldown" toml:"alert-cooldown"`
+	AlertWebhooks         []string `json:"alert-webhooks,omitempty" yaml:"alert-webhooks" toml:"alert-webhooks"`
+	GrafanaDir            string   `json:"grafana-dir,omitempty" yaml:"grafana-dir" toml:"grafana-dir"`
+	DescribeFormat        string   `json:"describe-format,omitempty" yaml:"describe-format" toml:"describe-format"`
+	// OtlpHeaders are written to command line as comma-separated name=value pairs
+	OtlpHeaders map[string]string `json:"otlp-headers,omitempty" yaml:"otlp-headers" toml:"otlp-headers"`
+	// Tags are written to command line as comma-separated name=value pairs
+	Tags    map[string]string `json:"tags,omitempty" yaml:"tags" toml:"tags"`
+	Imports []Import          `json:"imports,omitempty" yaml:"imports" toml:"imports" flag:"-"`
+}
+
+// Import is a Nightscout instance of a single user, its settings override the global ones
+type Import struct {
+	NsUri                 string            `json:"ns-uri,omitempty" yaml:"ns-uri" toml:"ns-uri"`
+	NsToken               string            `json:"ns-token,omitempty" yaml:"ns-token" toml:"ns-token"`
+	NsTokenFile           string            `json:"ns-token-file,omitempty" yaml:"ns-token-file" toml:"ns-token-file"`
+	MongoUri              string            `json:"mongo-uri,omitempty" yaml:"mongo-uri" toml:"mongo-uri"`
+	MongoUriFile          string            `json:"mongo-uri-file,omitempty" yaml:"mongo-uri-file" toml:"mongo-uri-file"`
+	MongoDb               string            `json:"mongo-db,omitempty" yaml:"mongo-db" toml:"mongo-db"`
+	User                  string            `json:"user" yaml:"user" toml:"user"`
+	Timezone              string            `json:"timezone,omitempty" yaml:"timezone" toml:"timezone"`
+	Limit                 int64             `json:"limit,omitempty" yaml:"limit" toml:"limit"`
+	Skip                  int64             `json:"skip,omitempty" yaml:"skip" toml:"skip"`
+	From                  string            `json:"from,omitempty" yaml:"from" toml:"from"`
+	To                    string            `json:"to,omitempty" yaml:"to" toml:"to"`
+	Collections           []string          `json:"collections,omitempty" yaml:"collections" toml:"collections"`
+	InfluxUri             string            `json:"influx-uri,omitempty" yaml:"influx-uri" toml:"influx-uri"`
+	InfluxToken           string            `json:"influx-token,omitempty" yaml:"influx-token" toml:"influx-token"`
+	InfluxTokenFile       string            `json:"influx-token-file,omitempty" yaml:"influx-token-file" toml:"influx-token-file"`
+	InfluxOrg             string            `json:"influx-org,omitempty" yaml:"influx-org" toml:"influx-org"`
+	InfluxBucket          string            `json:"influx-bucket,omitempty" yaml:"influx-bucket" toml:"influx-bucket"`
+	InfluxVersion         int64             `json:"influx-version,omitempty" yaml:"influx-version" toml:"influx-version"`
+	InfluxUsername        string            `json:"influx-username,omitempty" yaml:"influx-username" toml:"influx-username"`
+	InfluxPassword        string            `json:"influx-password,omitempty" yaml:"influx-password" toml:"influx-password"`
+	InfluxPasswordFile    string            `json:"influx-password-file,omitempty" yaml:"influx-password-file" toml:"influx-password-file"`
+	InfluxRetentionPolicy string            `json:"influx-retention-policy,omitempty" yaml:"influx-retention-policy" toml:"influx-retention-policy"`
+	CreateBucket          *bool             `json:"influx-create-bucket,omitempty" yaml:"influx-create-bucket" toml:"influx-create-bucket"`
+	Retention             string            `json:"influx-retention,omitempty" yaml:"influx-retention" toml:"influx-retention"`
+	TreatmentFields       []string          `json:"treatment-fields,omitempty" yaml:"treatment-fields" toml:"treatment-fields"`
+	TreatmentTags         []string          `json:"treatment-tags,omitempty" yaml:"treatment-tags" toml:"treatment-tags"`
+	IdMode                string            `json:"id-mode,omitempty" yaml:"id-mode" toml:"id-mode"`
+	SourceTags            *bool             `json:"source-tags,omitempty" yaml:"source-tags" toml:"source-tags"`
+	LocalTimeTags         *bool             `json:"local-time-tags,omitempty" yaml:"local-time-tags" toml:"local-time-tags"`
+	Tags                  map[string]string `json:"tags,omitempty" yaml:"tags" toml:"tags"`
+	Interval              string            `json:"interval,omitempty" yaml:"interval" toml:"interval"`
+	Anonymize             *bool             `json:"anonymize,omitempty" yaml:"anonymize" toml:"anonymize"`
+	ReplicateNsUri        string            `json:"replicate-ns-uri,omitempty" yaml:"replicate-ns-uri" toml:"replicate-ns-uri"`
+	ReplicateNsToken      string            `json:"replicate-ns-token,omitempty" yaml:"replicate-ns-token" toml:"replicate-ns-token"`
+	ReplicateNsTokenFile  string            `json:"replicate-ns-token-file,omitempty" yaml:"replicate-ns-token-file" toml:"replicate-ns-token-file"`
+	ReplicateMongoUri     string            `json:"replicate-mongo-uri,omitempty" yaml:"replicate-mongo-uri" toml:"replicate-mongo-uri"`
+	ReplicateMongoUriFile string            `json:"replicate-mongo-uri-file,omitempty" yaml:"replicate-mongo-uri-file" toml:"replicate-mongo-uri-file"`
+	ReplicateMongoDb      string            `json:"replicate-mongo-db,omitempty" yaml:"replicate-mongo-db" toml:"replicate-mongo-db"`
+}
+
+// Load reads the file in the format of its extension
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return Decode(data, Format(path))
+}
+
+// Format returns the format of the file by its extension, files without a known one are treated as JSON
+func Format(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// Decode decodes the data and interpolates environment variables into its text values, unknown keys are rejected
+func Decode(data []byte, format string) (Config, error) {
+	var config = Config{}
+	var err error
+	switch format {
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	case "yaml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&config); err == io.EOF {
+			err = nil
+		}
+	case "toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), &config)
+		if undecoded := meta.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown keys %v", undecoded)
+		}
+	default:
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return config, fmt.Errorf("can't decode config %s: %w", strings.ToUpper(format), err)
+	}
+	var missing []string
+	interpolateValues(reflect.ValueOf(&config).Elem(), &missing)
+	if len(missing) > 0 {
+		return config, errors.New("environment variables not set: " + strings.Join(missing, ", "))
+	}
+	return config, nil
+}
+
+var variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?}`)
+
+// interpolate replaces ${NAME} with the value of the environment variable and ${NAME:-default}
+// with the default when the variable is not set, a variable set to an empty string is empty. Unset variables
+// without default are missing, so a missing secret is not silently replaced with an empty string.
+func interpolate(value string, missing *[]string) string {
+	return variable.ReplaceAllStringFunc(value, func(match string) string {
+		groups := variable.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		*missing = append(*missing, groups[1])
+		return match
+	})
+}
+
+// interpolateValues interpolates the decoded strings, so values are never parsed as part of the file
+// and variables in its comments are not expanded
+func interpolateValues(value reflect.Value, missing *[]string) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(interpolate(value.String(), missing))
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			interpolateValues(value.Field(i), missing)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			interpolateValues(value.Index(i), missing)
+		}
+	case reflect.Map:
+		for _, key := range value.MapKeys() {
+			var element = reflect.New(value.Type().Elem()).Elem()
+			element.Set(value.MapIndex(key))
+			interpolateValues(element, missing)
+			value.SetMapIndex(key, element)
+		}
+	}
+}
+
+// Values returns the settings which are set, as command line argument values by argument name
+func (c Config) Values() map[string]string {
+	var values = map[string]string{}
+	value := reflect.ValueOf(c)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("flag") == "-" {
+			continue
+		}
+		name := Name(field)
+		switch v := value.Field(i).Interface().(type) {
+		case string:
+			if v != "" {
+				values[name] = v
+			}
+		case int64:
+			if v != 0 {
+				values[name] = strconv.FormatInt(v, 10)
+			}
+		case bool:
+			if v {
+				values[name] = strconv.FormatBool(v)
+			}
+		case []string:
+			if len(v) > 0 {
+				values[name] = strings.Join(v, ",")
+			}
+		case map[string]string:
+			if len(v) > 0 {
+				values[name] = JoinTags(v)
+			}
+		}
+	}
+	return values
+}
+
+// JoinTags formats tags as comma-separated name=value pairs, ordered by name
+func JoinTags(tags map[string]string) string {
+	var pairs []string
+	for name, value := range tags {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// SplitTags parses comma-separated name=value pairs
+func SplitTags(value string) (map[string]string, error) {
+	var tags = map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, tagValue, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("tag %q must be in name=value form", pair)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(tagValue)
+	}
+	return tags, nil
+}
+
+// Name returns the key of the field in the file, which is also the name of its command line argument
+func Name(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// Parser is ff.ConfigFileParser reading the file in the format of its path, which is only known once the
+// command line is parsed. The settings are passed to set as command line arguments, the whole decoded file
+// is stored into target for the imports.
+func Parser(path *string, target *Config) func(r io.Reader, set func(name, value string) error) error {
+	return func(r io.Reader, set func(name, value string) error) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		config, err := Decode(data, Format(*path))
+		if err != nil {
+			return err
+		}
+		for name, value := range config.Values() {
+			if err := set(name, value); err != nil {
+				return err
+			}
+		}
+		*target = config
+		return nil
+	}
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var expected = Config{
+	Limit:           100,
+	InfluxUri:       "http://localhost:8086",
+	InfluxToken:     "influx-secret",
+	TreatmentFields: []string{"glucose", "profile"},
+	SyncDeletes:     true,
+	Timezone:        "Europe/Moscow",
+	DedupTolerance:  "2m",
+	Timeout:         "5m",
+	Imports: []Import{
+		{User: "john", NsUri: "https://john.example", NsToken: "john-secret"},
+		{User: "jane", MongoDb: "jane", Timezone: "Europe/Berlin"},
+	},
+}
+
+func TestLoadFormats(t *testing.T) {
+	t.Setenv("INFLUX_TOKEN", "influx-secret")
+	t.Setenv("JOHN_NS_TOKEN", "john-secret")
+	for _, path := range []string{"testdata/config.json", "testdata/config.yaml", "testdata/config.toml"} {
+		t.Run(path, func(t *testing.T) {
+			config, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("decoded %+v, expected %+v", config, expected)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsUnknownKeys(t *testing.T) {
+	var cases = map[string]string{
+		"json": `{"limit": 10, "imports": [{"user": "john", "ns-url": "https://john.example"}]}`,
+		"yaml": "limit: 10\nimports:\n  - user: john\n    ns-url: https://john.example\n",
+		"toml": "limit = 10\n[[imports]]\nuser = \"john\"\nns-url = \"https://john.example\"\n",
+	}
+	for format, data := range cases {
+		if _, err := Decode([]byte(data), format); err == nil || !strings.Contains(err.Error(), "ns-url") {
+			t.Errorf("%s: expected error about unknown key, got %v", format, err)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("NS_TOKEN", `se"cret # not a comment`)
+	t.Setenv("EMPTY", "")
+
+	var cases = map[string]string{
+		"json": `{"ns-token": "${NS_TOKEN}", "influx-org": "${EMPTY:-fallback}", "influx-bucket": "${UNSET_VARIABLE:-}",
+			"mongo-db": "$NS_TOKEN", "tags": {"token": "${NS_TOKEN}"}, "imports": [{"user": "${EMPTY}", "collections": ["${NS_TOKEN}"]}]}`,
+		"yaml": `# ns-token: ${UNSET_VARIABLE}
+ns-token: "${NS_TOKEN}" # ${UNSET_VARIABLE}
+influx-org: ${EMPTY:-fallback}
+influx-bucket: ${UNSET_VARIABLE:-}
+mongo-db: $NS_TOKEN
+tags:
+  token: ${NS_TOKEN}
+imports:
+  - user: ${EMPTY}
+    collections: ["${NS_TOKEN}"]
+`,
+		"toml": `# ns-token = "${UNSET_VARIABLE}"
+ns-token = "${NS_TOKEN}" # ${UNSET_VARIABLE}
+influx-org = "${EMPTY:-fallback}"
+influx-bucket = "${UNSET_VARIABLE:-}"
+mongo-db = "$NS_TOKEN"
+tags = { token = "${NS_TOKEN}" }
+[[imports]]
+user = "${EMPTY}"
+collections = ["${NS_TOKEN}"]
+`,
+	}
+	// values are taken as they are, a set but empty variable is a value
+	var want = Config{NsToken: `se"cret # not a comment`, InfluxOrg: "", MongoDb: "$NS_TOKEN",
+		Tags: map[string]string{"token": `se"cret # not a comment`}, Imports: []Import{{Collections: []string{`se"cret # not a comment`}}}}
+	for format, data := range cases {
+		config, err := Decode([]byte(data), format)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("%s: decoded %+v, expected %+v", format, config, want)
+		}
+	}
+
+	if _, err := Decode([]byte(`{"ns-token": "${UNSET_VARIABLE}", "tags": {"group": "${OTHER_UNSET}"}}`), "json"); err == nil ||
+		!strings.Contains(err.Error(), "environment variables not set") || !strings.Contains(err.Error(), "UNSET_VARIABLE") || !strings.Contains(err.Error(), "OTHER_UNSET") {
+		t.Errorf("expected error listing missing variables, got %v", err)
+	}
+}
+
+func TestValues(t *testing.T) {
+	values := expected.Values()
+	var want = map[string]string{
+		"limit":            "100",
+		"influx-uri":       "http://localhost:8086",
+		"influx-token":     "influx-secret",
+		"treatment-fields": "glucose,profile",
+		"sync-deletes":     "true",
+		"timezone":         "Europe/Moscow",
+		"dedup-tolerance":  "2m",
+		"timeout":          "5m",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values %v, expected %v", values, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	tags, err := SplitTags(" group=study, cohort = a ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined := JoinTags(tags); joined != "cohort=a,group=study" {
+		t.Errorf("joined %q", joined)
+	}
+	if _, err := SplitTags("group"); err == nil {
+		t.Error("tag without value accepted")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"ns-exporter/schema"
+	"text/tabwriter"
+)
+
+const (
+	describeTable = "table"
+	describeJSON  = "json"
+)
+
+// describe prints the measurements, tags and fields the exporter writes, as a table or as JSON
+func describe(s *settings, out io.Writer) error {
+	switch *s.describeFormat {
+	case describeJSON:
+		data, err := json.MarshalIndent(schema.Measurements, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "%s\n", data)
+		return err
+	case describeTable:
+		return describeMeasurements(out)
+	}
+	return fmt.Errorf("unknown 'describe-format' %q, expected %s or %s", *s.describeFormat, describeTable, describeJSON)
+}
+
+// describeMeasurements prints a row per tag and field, tags are always strings. Empty cells are '-',
+// so the columns can be split at whitespace up to the description
+func describeMeasurements(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MEASUREMENT\tCOLLECTION\tKIND\tNAME\tTYPE\tUNIT\tSOURCE\tDESCRIPTION")
+	for _, measurement := range schema.Measurements {
+		var collection = orDash(measurement.Collection)
+		for _, tag := range measurement.Tags {
+			fmt.Fprintf(w, "%s\t%s\ttag\t%s\t%s\t-\t%s\t%s\n", measurement.Name, collection, tag.Name, schema.String, tag.Source, tag.Description)
+		}
+		for _, field := range measurement.Fields {
+			fmt.Fprintf(w, "%s\t%s\tfield\t%s\t%s\t%s\t%s\t%s\n",
+				measurement.Name, collection, field.Name, field.Type, orDash(field.Unit), field.Source, field.Description)
+		}
+	}
+	return w.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"ns-exporter/grafana"
+	"os"
+	"path/filepath"
+)
+
+// grafanaOptions are the global InfluxDb settings, the dashboard offers the users of all imports
+func (s *settings) grafanaOptions() grafana.Options {
+	var options = grafana.Options{
+		Version:         *s.influxVersion,
+		URL:             *s.influxUri,
+		Org:             *s.influxOrg,
+		Bucket:          *s.influxBucket,
+		RetentionPolicy: *s.influxRP,
+		Username:        *s.influxUsername,
+	}
+	for _, entry := range s.importEntries() {
+		if entry.User != "" && !contains(options.Users, entry.User) {
+			options.Users = append(options.Users, entry.User)
+		}
+	}
+	return options
+}
+
+// provisionGrafana writes the datasource and dashboard provisioning into the grafana-dir,
+// or the dashboard to out when it is not set
+func provisionGrafana(s *settings, out io.Writer) error {
+	var options = s.grafanaOptions()
+	dashboard, err := grafana.Dashboard(options)
+	if err != nil {
+		return err
+	}
+	if *s.grafanaDir == "" {
+		_, err = out.Write(dashboard)
+		return err
+	}
+	if options.URL == "" {
+		return errors.New("'influx-uri' is required for the datasource provisioning")
+	}
+	datasource, err := grafana.Datasource(options)
+	if err != nil {
+		return err
+	}
+	provider, err := grafana.Provider()
+	if err != nil {
+		return err
+	}
+
+	var files = []struct {
+		path string
+		data []byte
+	}{
+		{filepath.Join("datasources", "ns-exporter.yaml"), datasource},
+		{filepath.Join("dashboards", "ns-exporter.yaml"), provider},
+		{filepath.Join("dashboards", "ns-exporter.json"), dashboard},
+	}
+	for _, file := range files {
+		var path = filepath.Join(*s.grafanaDir, file.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, file.data, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "written %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package grafana generates a Grafana dashboard and its provisioning from the schema of the written points,
+// so the panels always match the data.
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ns-exporter/schema"
+	"strings"
+)
+
+const (
+	// DatasourceUID is the uid of the provisioned datasource the panels query
+	DatasourceUID = "ns-exporter"
+	// DashboardUID is the uid of the dashboard, so provisioning replaces it instead of adding another one
+	DashboardUID = "ns-exporter"
+	panelWidth   = 8
+	panelHeight  = 8
+	tableLimit   = 100
+)
+
+// Options select the query language and the InfluxDB the dashboard reads
+type Options struct {
+	// Version of the InfluxDB API, 1, 2 or 3, selects InfluxQL, Flux or SQL
+	Version int64
+	URL     string
+	// Org of InfluxDB 2
+	Org string
+	// Bucket is the database of InfluxDB 1 and 3, {user} is replaced with the user variable
+	Bucket          string
+	RetentionPolicy string
+	// Username of InfluxDB 1
+	Username string
+	// Users are offered by the user variable when there is a bucket per user, whose tag values can't be queried
+	Users []string
+}
+
+func (o Options) perUser() bool {
+	return strings.Contains(o.Bucket, "{user}")
+}
+
+func (o Options) check() error {
+	switch o.Version {
+	case 1, 2, 3:
+	default:
+		return fmt.Errorf("unknown InfluxDb version %d", o.Version)
+	}
+	if strings.Contains(o.Org, "{user}") {
+		return errors.New("an org per user can't be queried by one datasource")
+	}
+	if o.perUser() && o.Version == 3 {
+		return errors.New("a database per user can't be queried with SQL")
+	}
+	if o.perUser() && len(o.Users) == 0 {
+		return errors.New("a bucket per user needs the users of the imports for the user variable")
+	}
+	return nil
+}
+
+// units are the Grafana units of the schema units
+var units = map[string]string{
+	"":      "none",
+	"mg/dL": "conmgdL",
+	"g":     "massg",
+	"min":   "m",
+	"%":     "percent",
+}
+
+func unit(name string) string {
+	if grafana, ok := units[name]; ok {
+		return grafana
+	}
+	return "suffix: " + name
+}
+
+var datasource = map[string]interface{}{"type": "influxdb", "uid": DatasourceUID}
+
+// Dashboard returns the dashboard JSON: a row of every measurement with a panel of every numeric field,
+// and a table of the text fields, or of all fields of events
+func Dashboard(options Options) ([]byte, error) {
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	var panels []interface{}
+	var id, y = 0, 0
+	for _, measurement := range schema.Measurements {
+		id++
+		panels = append(panels, map[string]interface{}{
+			"id": id, "type": "row", "title": measurement.Description, "collapsed": false, "panels": []interface{}{},
+			"gridPos": gridPos(0, y, 24, 1),
+		})
+		y++
+
+		var x = 0
+		var tableFields []schema.Field
+		for _, field := range measurement.Fields {
+			if measurement.Events || !field.Type.Numeric() {
+				tableFields = append(tableFields, field)
+			}
+			if !field.Type.Numeric() {
+				continue
+			}
+			id++
+			panels = append(panels, options.timeSeries(id, measurement, field, gridPos(x, y, panelWidth, panelHeight)))
+			if x += panelWidth; x >= 24 {
+				x, y = 0, y+panelHeight
+			}
+		}
+		if x > 0 {
+			y += panelHeight
+		}
+		if len(tableFields) > 0 {
+			id++
+			panels = append(panels, options.table(id, measurement, tableFields, gridPos(0, y, 24, panelHeight)))
+			y += panelHeight
+		}
+	}
+
+	var dashboard = map[string]interface{}{
+		"uid":           DashboardUID,
+		"title":         "Nightscout",
+		"description":   fmt.Sprintf("Generated by ns-exporter grafana for InfluxDB %d, do not edit", options.Version),
+		"tags":          []string{"nightscout", "ns-exporter"},
+		"editable":      true,
+		"schemaVersion": 36,
+		"timezone":      "browser",
+		"refresh":       "5m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating":    map[string]interface{}{"list": []interface{}{options.userVariable()}},
+		"annotations":   map[string]interface{}{"list": []interface{}{}},
+		"panels":        panels,
+	}
+	data, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func gridPos(x int, y int, w int, h int) map[string]int {
+	return map[string]int{"x": x, "y": y, "w": w, "h": h}
+}
+
+func (o Options) timeSeries(id int, measurement schema.Measurement, field schema.Field, position map[string]int) map[string]interface{} {
+	var style = map[string]interface{}{"drawStyle": "line", "lineWidth": 1, "spanNulls": true}
+	if measurement.Events {
+		style = map[string]interface{}{"drawStyle": "points", "pointSize": 6}
+	}
+	return map[string]interface{}{
+		"id":          id,
+		"type":        "timeseries",
+		"title":       fmt.Sprintf("%s %s", measurement.Name, field.Name),
+		"description": field.Description,
+		"datasource":  datasource,
+		"gridPos":     position,
+		"fieldConfig": map[string]interface{}{
+			"defaults":  map[string]interface{}{"unit": unit(field.Unit), "custom": style},
+			"overrides": []interface{}{},
+		},
+		"targets": []interface{}{o.target(o.seriesQuery(measurement, field), "time_series")},
+	}
+}
+
+func (o Options) table(id int, measurement schema.Measurement, fields []schema.Field, position map[string]int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         id,
+		"type":       "table",
+		"title":      measurement.Name,
+		"datasource": datasource,
+		"gridPos":    position,
+		"targets":    []interface{}{o.target(o.tableQuery(measurement, fields), "table")},
+	}
+}
+
+// target is the query of a panel in the form of the query language
+func (o Options) target(query string, format string) map[string]interface{} {
+	switch o.Version {
+	case 1:
+		return map[string]interface{}{"refId": "A", "datasource": datasource, "rawQuery": true, "query": query, "resultFormat": format}
+	case 3:
+		return map[string]interface{}{"refId": "A", "datasource": datasource, "rawQuery": true, "editorMode": "code", "rawSql": query, "format": "table"}
+	}
+	return map[string]interface{}{"refId": "A", "datasource": datasource, "query": query}
+}
+
+// seriesQuery selects the field of the user, averaged per interval unless the measurement holds events
+func (o Options) seriesQuery(measurement schema.Measurement, field schema.Field) string {
+	switch o.Version {
+	case 1:
+		if measurement.Events {
+			return fmt.Sprintf(`SELECT %q FROM %s WHERE "user" =~ /^$user$/ AND $timeFilter`, field.Name, o.influxqlFrom(measurement))
+		}
+		return fmt.Sprintf(`SELECT mean(%q) AS %q FROM %s WHERE "user" =~ /^$user$/ AND $timeFilter GROUP BY time($__interval) fill(none)`,
+			field.Name, field.Name, o.influxqlFrom(measurement))
+	case 3:
+		if measurement.Events {
+			return fmt.Sprintf(`SELECT time, %q FROM %q WHERE "user" = '${user}' AND %q IS NOT NULL AND $__timeFilter(time) ORDER BY time`,
+				field.Name, measurement.Name, field.Name)
+		}
+		return fmt.Sprintf(`SELECT $__dateBin(time) AS time, avg(%q) AS %q FROM %q WHERE "user" = '${user}' AND $__timeFilter(time) GROUP BY 1 ORDER BY 1`,
+			field.Name, field.Name, measurement.Name)
+	}
+	var query = o.fluxFrom(measurement) + fmt.Sprintf("\n  |> filter(fn: (r) => r._field == %q)", field.Name)
+	if !measurement.Events {
+		query += "\n  |> aggregateWindow(every: v.windowPeriod, fn: mean, createEmpty: false)"
+	}
+	return query
+}
+
+// tableQuery selects the latest values of the fields of the user
+func (o Options) tableQuery(measurement schema.Measurement, fields []schema.Field) string {
+	var names []string
+	for _, field := range fields {
+		names = append(names, fmt.Sprintf("%q", field.Name))
+	}
+	switch o.Version {
+	case 1:
+		return fmt.Sprintf(`SELECT %s FROM %s WHERE "user" =~ /^$user$/ AND $timeFilter ORDER BY time DESC LIMIT %d`,
+			strings.Join(names, ", "), o.influxqlFrom(measurement), tableLimit)
+	case 3:
+		var present []string
+		for _, name := range names {
+			present = append(present, name+" IS NOT NULL")
+		}
+		return fmt.Sprintf(`SELECT time, %s FROM %q WHERE "user" = '${user}' AND (%s) AND $__timeFilter(time) ORDER BY time DESC LIMIT %d`,
+			strings.Join(names, ", "), measurement.Name, strings.Join(present, " OR "), tableLimit)
+	}
+	var filters []string
+	for _, name := range names {
+		filters = append(filters, "r._field == "+name)
+	}
+	return o.fluxFrom(measurement) + fmt.Sprintf("\n  |> filter(fn: (r) => %s)", strings.Join(filters, " or ")) +
+		"\n  |> pivot(rowKey: [\"_time\"], columnKey: [\"_field\"], valueColumn: \"_value\")" +
+		fmt.Sprintf("\n  |> group()\n  |> sort(columns: [\"_time\"], desc: true)\n  |> limit(n: %d)", tableLimit)
+}
+
+// influxqlFrom is the measurement, qualified with the database per user and the retention policy
+func (o Options) influxqlFrom(measurement schema.Measurement) string {
+	var from = fmt.Sprintf("%q", measurement.Name)
+	if o.RetentionPolicy != "" {
+		from = fmt.Sprintf("%q.%s", o.RetentionPolicy, from)
+	} else if o.perUser() {
+		// the default retention policy of the database
+		from = "." + from
+	}
+	if o.perUser() {
+		from = fmt.Sprintf("%q.", o.bucket()) + from
+	}
+	return from
+}
+
+func (o Options) fluxFrom(measurement schema.Measurement) string {
+	return fmt.Sprintf("from(bucket: %q)\n  |> range(start: v.timeRangeStart, stop: v.timeRangeStop)", o.bucket()) +
+		fmt.Sprintf("\n  |> filter(fn: (r) => r._measurement == %q and r.user == \"${user}\")", measurement.Name)
+}
+
+// bucket is the bucket with the user variable
+func (o Options) bucket() string {
+	return strings.ReplaceAll(o.Bucket, "{user}", "${user}")
+}
+
+// userVariable queries the users from the user tag, or offers the users of the imports with a bucket per user
+func (o Options) userVariable() map[string]interface{} {
+	var variable = map[string]interface{}{"name": "user", "label": "User", "hide": 0, "multi": false, "includeAll": false}
+	if o.perUser() {
+		var options []interface{}
+		for i, user := range o.Users {
+			options = append(options, map[string]interface{}{"text": user, "value": user, "selected": i == 0})
+		}
+		variable["type"] = "custom"
+		variable["query"] = strings.Join(o.Users, ",")
+		variable["options"] = options
+		variable["current"] = map[string]interface{}{"text": o.Users[0], "value": o.Users[0]}
+		return variable
+	}
+	var query string
+	switch o.Version {
+	case 1:
+		query = `SHOW TAG VALUES WITH KEY = "user"`
+	case 2:
+		query = fmt.Sprintf("import \"influxdata/influxdb/schema\"\n\nschema.tagValues(bucket: %q, tag: \"user\")", o.Bucket)
+	case 3:
+		// every user has treatments, the default collections
+		query = `SELECT DISTINCT "user" FROM "treatments" ORDER BY "user"`
+	}
+	variable["type"] = "query"
+	variable["datasource"] = datasource
+	variable["query"] = query
+	variable["refresh"] = 1
+	variable["sort"] = 1
+	variable["options"] = []interface{}{}
+	variable["current"] = map[string]interface{}{}
+	return variable
+}
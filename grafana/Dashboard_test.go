@@ -0,0 +1,142 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"ns-exporter/schema"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update grafana.json")
+
+// TestDashboardGolden keeps grafana.json of the repository generated with the default settings
+func TestDashboardGolden(t *testing.T) {
+	data, err := Dashboard(Options{Version: 2, Org: "ns", Bucket: "ns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var golden = filepath.Join("..", "grafana.json")
+	if *update {
+		if err := os.WriteFile(golden, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("grafana.json differs from the generated dashboard, run go test ./grafana -update")
+	}
+}
+
+type dashboard struct {
+	Panels []struct {
+		Type    string
+		Title   string
+		Targets []map[string]interface{}
+	}
+	Templating struct {
+		List []struct {
+			Name  string
+			Type  string
+			Query string
+		}
+	}
+}
+
+func decode(t *testing.T, options Options) dashboard {
+	t.Helper()
+	data, err := Dashboard(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result dashboard
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestDashboardVersions(t *testing.T) {
+	var cases = []struct {
+		options  Options
+		key      string
+		query    string
+		variable string
+	}{
+		{Options{Version: 1, Bucket: "ns", RetentionPolicy: "year"}, "query",
+			`SELECT mean("sgv") AS "sgv" FROM "year"."entries" WHERE "user" =~ /^$user$/ AND $timeFilter GROUP BY time($__interval) fill(none)`,
+			`SHOW TAG VALUES WITH KEY = "user"`},
+		{Options{Version: 2, Org: "ns", Bucket: "ns"}, "query",
+			"from(bucket: \"ns\")\n  |> range(start: v.timeRangeStart, stop: v.timeRangeStop)\n" +
+				"  |> filter(fn: (r) => r._measurement == \"entries\" and r.user == \"${user}\")\n" +
+				"  |> filter(fn: (r) => r._field == \"sgv\")\n  |> aggregateWindow(every: v.windowPeriod, fn: mean, createEmpty: false)",
+			"schema.tagValues(bucket: \"ns\", tag: \"user\")"},
+		{Options{Version: 3, Bucket: "ns"}, "rawSql",
+			`SELECT $__dateBin(time) AS time, avg("sgv") AS "sgv" FROM "entries" WHERE "user" = '${user}' AND $__timeFilter(time) GROUP BY 1 ORDER BY 1`,
+			`SELECT DISTINCT "user" FROM "treatments"`},
+		// with a bucket per user the users of the imports are offered
+		{Options{Version: 1, Bucket: "ns_{user}", Users: []string{"john", "jane"}}, "query",
+			`SELECT mean("sgv") AS "sgv" FROM "ns_${user}".."entries" WHERE "user" =~ /^$user$/ AND $timeFilter GROUP BY time($__interval) fill(none)`,
+			"john,jane"},
+	}
+	for _, c := range cases {
+		var result = decode(t, c.options)
+		var found = false
+		for _, panel := range result.Panels {
+			if panel.Title == "entries sgv" {
+				found = true
+				if query := panel.Targets[0][c.key]; query != c.query {
+					t.Errorf("version %d: unexpected query %q, expected %q", c.options.Version, query, c.query)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("version %d: no sgv panel", c.options.Version)
+		}
+		if len(result.Templating.List) != 1 || result.Templating.List[0].Name != "user" ||
+			!strings.Contains(result.Templating.List[0].Query, c.variable) {
+			t.Errorf("version %d: unexpected variables %+v", c.options.Version, result.Templating.List)
+		}
+	}
+}
+
+// TestDashboardFields checks every numeric field has a panel and every measurement a row
+func TestDashboardFields(t *testing.T) {
+	var titles = map[string]bool{}
+	for _, panel := range decode(t, Options{Version: 2, Org: "ns", Bucket: "ns"}).Panels {
+		titles[panel.Type+" "+panel.Title] = true
+	}
+	for _, measurement := range schema.Measurements {
+		if !titles["row "+measurement.Description] {
+			t.Errorf("no row of %s", measurement.Name)
+		}
+		for _, field := range measurement.Fields {
+			if field.Type.Numeric() && !titles["timeseries "+measurement.Name+" "+field.Name] {
+				t.Errorf("no panel of %s %s", measurement.Name, field.Name)
+			}
+		}
+	}
+	if !titles["table treatments"] || !titles["table gaps"] {
+		t.Errorf("no tables of the events in %v", titles)
+	}
+}
+
+func TestDashboardInvalid(t *testing.T) {
+	for _, options := range []Options{
+		{Version: 4, Bucket: "ns"},
+		{Version: 2, Org: "{user}", Bucket: "ns"},
+		{Version: 3, Bucket: "ns_{user}", Users: []string{"john"}},
+		{Version: 2, Org: "ns", Bucket: "ns_{user}"},
+	} {
+		if _, err := Dashboard(options); err == nil {
+			t.Errorf("no error for %+v", options)
+		}
+	}
+}
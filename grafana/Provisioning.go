@@ -0,0 +1,63 @@
+package grafana
+
+import (
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+const (
+	// DashboardsPath is where the dashboard provider reads the dashboard from in the Grafana container
+	DashboardsPath = "/etc/grafana/provisioning/dashboards"
+	// TokenVariable and PasswordVariable are expanded by Grafana, so the provisioning holds no secrets
+	TokenVariable    = "${NS_EXPORTER_INFLUX_TOKEN}"
+	PasswordVariable = "${NS_EXPORTER_INFLUX_PASSWORD}"
+)
+
+// Datasource returns the datasource provisioning YAML of the InfluxDB the dashboard queries
+func Datasource(options Options) ([]byte, error) {
+	if err := options.check(); err != nil {
+		return nil, err
+	}
+	var source = map[string]interface{}{
+		"name":      "ns-exporter",
+		"uid":       DatasourceUID,
+		"type":      "influxdb",
+		"access":    "proxy",
+		"url":       options.URL,
+		"isDefault": true,
+	}
+	switch options.Version {
+	case 1:
+		// with a database per user the queries name it, the datasource needs one nonetheless
+		var database = options.Bucket
+		if options.perUser() {
+			database = strings.ReplaceAll(database, "{user}", options.Users[0])
+		}
+		source["database"] = database
+		source["jsonData"] = map[string]interface{}{"httpMode": "POST"}
+		if options.Username != "" {
+			source["user"] = options.Username
+			source["secureJsonData"] = map[string]string{"password": PasswordVariable}
+		}
+	case 2:
+		source["jsonData"] = map[string]interface{}{"version": "Flux", "organization": options.Org, "defaultBucket": options.bucket()}
+		source["secureJsonData"] = map[string]string{"token": TokenVariable}
+	case 3:
+		source["jsonData"] = map[string]interface{}{"version": "SQL", "dbName": options.Bucket, "httpMode": "POST"}
+		source["secureJsonData"] = map[string]string{"token": TokenVariable}
+	}
+	return yaml.Marshal(map[string]interface{}{"apiVersion": 1, "datasources": []interface{}{source}})
+}
+
+// Provider returns the dashboard provider provisioning YAML, which loads the dashboard from DashboardsPath
+func Provider() ([]byte, error) {
+	return yaml.Marshal(map[string]interface{}{
+		"apiVersion": 1,
+		"providers": []interface{}{map[string]interface{}{
+			"name":    "ns-exporter",
+			"type":    "file",
+			"folder":  "",
+			"options": map[string]string{"path": DashboardsPath},
+		}},
+	})
+}
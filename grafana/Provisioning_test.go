@@ -0,0 +1,42 @@
+package grafana
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDatasource(t *testing.T) {
+	var cases = []struct {
+		options  Options
+		expected []string
+	}{
+		{Options{Version: 1, URL: "http://influx:8086", Bucket: "ns_{user}", Username: "grafana", Users: []string{"john"}},
+			[]string{"url: http://influx:8086", "database: ns_john", "user: grafana", "password: ${NS_EXPORTER_INFLUX_PASSWORD}"}},
+		{Options{Version: 2, URL: "http://influx:8086", Org: "home", Bucket: "ns"},
+			[]string{"version: Flux", "organization: home", "defaultBucket: ns", "token: ${NS_EXPORTER_INFLUX_TOKEN}"}},
+		{Options{Version: 3, URL: "http://influx:8181", Bucket: "ns"},
+			[]string{"version: SQL", "dbName: ns", "token: ${NS_EXPORTER_INFLUX_TOKEN}"}},
+	}
+	for _, c := range cases {
+		data, err := Datasource(c.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var text = string(data)
+		for _, expected := range append(c.expected, "uid: ns-exporter", "apiVersion: 1") {
+			if !strings.Contains(text, expected) {
+				t.Errorf("version %d: %q missing in\n%s", c.options.Version, expected, text)
+			}
+		}
+	}
+}
+
+func TestProvider(t *testing.T) {
+	data, err := Provider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "path: "+DashboardsPath) {
+		t.Errorf("unexpected provider\n%s", data)
+	}
+}
@@ -0,0 +1,106 @@
+// Package mqtttest provides a fake MQTT broker keeping the published messages, for tests of the MQTT sink.
+package mqtttest
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Message is a message published to the broker
+type Message struct {
+	Topic    string
+	Payload  string
+	Retained bool
+}
+
+// Broker accepts MQTT 3.1.1 connections and publishes, it does not deliver messages to subscribers
+type Broker struct {
+	// URL is the broker uri for clients, tcp://host:port
+	URL      string
+	listener net.Listener
+	username string
+	password string
+
+	mutex    sync.Mutex
+	messages []Message
+}
+
+// NewBroker listens on a local port until the test ends, connections with other credentials are refused
+func NewBroker(t testing.TB, username string, password string) *Broker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &Broker{URL: "tcp://" + listener.Addr().String(), listener: listener, username: username, password: password}
+	go broker.accept()
+	t.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+// Messages returns the published messages in the order they were received
+func (b *Broker) Messages() []Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]Message(nil), b.messages...)
+}
+
+// Retained returns the last retained payload of every topic, as a subscriber connecting now would get them
+func (b *Broker) Retained() map[string]string {
+	var retained = map[string]string{}
+	for _, message := range b.Messages() {
+		if message.Retained {
+			retained[message.Topic] = message.Payload
+		}
+	}
+	return retained
+}
+
+func (b *Broker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if p.Username != b.username || string(p.Password) != b.password {
+				connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+			}
+			if connack.Write(conn) != nil || connack.ReturnCode != packets.Accepted {
+				return
+			}
+		case *packets.PublishPacket:
+			b.mutex.Lock()
+			b.messages = append(b.messages, Message{Topic: p.TopicName, Payload: string(p.Payload), Retained: p.Retain})
+			b.mutex.Unlock()
+			if p.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				if puback.Write(conn) != nil {
+					return
+				}
+			}
+		case *packets.PingreqPacket:
+			if packets.NewControlPacket(packets.Pingresp).Write(conn) != nil {
+				return
+			}
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
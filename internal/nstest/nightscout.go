@@ -0,0 +1,309 @@
+// Package nstest provides a fake Nightscout serving recorded fixtures, for tests of sources and pipelines.
+package nstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	Token = "exporter-0123456789abcdef"
+	Jwt   = "fake.jwt.token"
+)
+
+// Fixtures are recorded uploads of AndroidAPS, oref0 rigs and Loop
+var Fixtures = []string{"aaps", "oref0", "loop"}
+
+// Server is a fake Nightscout, documents inserted through it are added to its records
+type Server struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	records map[string][]map[string]interface{}
+	// modified numbers the changes of documents, as srvModified of real servers they only grow
+	modified int64
+}
+
+// Records returns the current documents of the collection
+func (s *Server) Records(collection string) []map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var records []map[string]interface{}
+	for _, record := range s.records[collection] {
+		var copied = map[string]interface{}{}
+		for key, value := range record {
+			copied[key] = value
+		}
+		records = append(records, copied)
+	}
+	return records
+}
+
+// NewServer serves the fixture records from dir/<collection>/<fixture>.json through APIv3 the way Nightscout does:
+// search results omit soft-deleted records, which are only returned by the history endpoint
+func NewServer(t testing.TB, dir string, fixture string) *Server {
+	t.Helper()
+	now := time.Now()
+	server := &Server{records: map[string][]map[string]interface{}{}, modified: now.UnixMilli()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/authorization/request/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.TrimPrefix(r.URL.Path, "/api/v2/authorization/request/") != Token {
+			http.Error(w, `{"status":401}`, http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"token": Jwt, "iat": 1654682400, "exp": 1654711200})
+	})
+	for _, collection := range []string{"devicestatus", "treatments", "entries", "profile"} {
+		collection := collection
+		server.records[collection] = loadDocuments(t, filepath.Join(dir, collection, fixture+".json"), now)
+		mux.HandleFunc("/api/v3/"+collection, func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(w, r) {
+				return
+			}
+			if r.Method == http.MethodPost {
+				server.insert(t, collection, w, r)
+				return
+			}
+			records := server.Records(collection)
+			if r.URL.Query().Get("sort$desc") != sortField(collection) {
+				t.Errorf("unexpected sort: %s", r.URL.RawQuery)
+			}
+			var valid []map[string]interface{}
+			for _, record := range records {
+				if record["isValid"] != false && inRange(record, r) && inDateRange(record, r) {
+					valid = append(valid, record)
+				}
+			}
+			writeJSON(w, map[string]interface{}{"status": 200, "result": page(valid, r)})
+		})
+		mux.HandleFunc("/api/v3/"+collection+"/history/", func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(w, r) {
+				return
+			}
+			since, _ := strconv.ParseFloat(strings.TrimPrefix(r.URL.Path, "/api/v3/"+collection+"/history/"), 64)
+			var changed []map[string]interface{}
+			for _, record := range server.Records(collection) {
+				if record["srvModified"].(float64) > since {
+					changed = append(changed, record)
+				}
+			}
+			sort.SliceStable(changed, func(i, j int) bool {
+				return changed[i]["srvModified"].(float64) < changed[j]["srvModified"].(float64)
+			})
+			writeJSON(w, map[string]interface{}{"status": 200, "result": page(changed, r)})
+		})
+		mux.HandleFunc("/api/v3/"+collection+"/", func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(w, r) {
+				return
+			}
+			identifier := strings.TrimPrefix(r.URL.Path, "/api/v3/"+collection+"/")
+			switch r.Method {
+			case http.MethodPut:
+				server.replace(t, collection, identifier, w, r)
+				return
+			case http.MethodDelete:
+				if server.update(collection, identifier, func(record map[string]interface{}) { record["isValid"] = false }) {
+					writeJSON(w, map[string]interface{}{"status": 200})
+				} else {
+					http.Error(w, `{"status":404}`, http.StatusNotFound)
+				}
+				return
+			}
+			for _, record := range server.Records(collection) {
+				if record["identifier"] == identifier {
+					if record["isValid"] == false {
+						http.Error(w, `{"status":410}`, http.StatusGone)
+						return
+					}
+					writeJSON(w, map[string]interface{}{"status": 200, "result": record})
+					return
+				}
+			}
+			http.Error(w, `{"status":404}`, http.StatusNotFound)
+		})
+	}
+	server.Server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// insert adds the document, checking the fields APIv3 requires
+// NewEmptyServer is a fake Nightscout without any documents, e.g. to restore or replicate into
+func NewEmptyServer(t testing.TB) *Server {
+	t.Helper()
+	return NewServer(t, t.TempDir(), "empty")
+}
+
+func (s *Server) insert(t testing.TB, collection string, w http.ResponseWriter, r *http.Request) {
+	record, ok := decode(t, collection, w, r)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	s.modified++
+	record["srvModified"] = float64(s.modified)
+	s.records[collection] = append(s.records[collection], record)
+	s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": 201, "identifier": record["identifier"]})
+}
+
+// replace replaces the document with the identifier or creates it, as APIv3 PUT does
+func (s *Server) replace(t testing.TB, collection string, identifier string, w http.ResponseWriter, r *http.Request) {
+	record, ok := decode(t, collection, w, r)
+	if !ok {
+		return
+	}
+	record["identifier"] = identifier
+	if !s.update(collection, identifier, func(existing map[string]interface{}) {
+		for key := range existing {
+			delete(existing, key)
+		}
+		for key, value := range record {
+			existing[key] = value
+		}
+	}) {
+		s.mutex.Lock()
+		s.modified++
+		record["srvModified"] = float64(s.modified)
+		s.records[collection] = append(s.records[collection], record)
+		s.mutex.Unlock()
+	}
+	writeJSON(w, map[string]interface{}{"status": 200})
+}
+
+// update changes the document with the identifier and reports whether it exists
+func (s *Server) update(collection string, identifier string, change func(record map[string]interface{})) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, record := range s.records[collection] {
+		if record["identifier"] == identifier {
+			change(record)
+			s.modified++
+			record["srvModified"] = float64(s.modified)
+			return true
+		}
+	}
+	return false
+}
+
+func decode(t testing.TB, collection string, w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	var record map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil || record["date"] == nil || record["app"] == nil {
+		t.Errorf("invalid %s document: %v, %v", collection, record, err)
+		http.Error(w, `{"status":400}`, http.StatusBadRequest)
+		return nil, false
+	}
+	for _, key := range []string{"_id", "srvModified", "srvCreated"} {
+		if _, ok := record[key]; ok {
+			t.Errorf("%s document with server field %s: %v", collection, key, record)
+		}
+	}
+	return record, true
+}
+
+// loadDocuments reads the fixture as Nightscout would return it: with identifier, falling back to _id,
+// and srvModified, which follows the record time, soft-deleted records and those without time were modified just now.
+// Missing fixtures are empty collections.
+func loadDocuments(t testing.TB, path string, now time.Time) []map[string]interface{} {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	records := LoadRecords(t, path)
+	for _, record := range records {
+		if record["identifier"] == nil && record["_id"] != nil {
+			record["identifier"] = record["_id"]
+		}
+		var at model.RecordTime
+		data, _ := json.Marshal(record)
+		_ = json.Unmarshal(data, &at)
+		modified, err := at.Resolve(nil)
+		if err != nil || record["isValid"] == false {
+			modified = now
+		}
+		record["srvModified"] = float64(modified.UnixMilli())
+	}
+	return records
+}
+
+// LoadRecords reads a fixture file
+func LoadRecords(t testing.TB, path string) []map[string]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]interface{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+Jwt {
+		http.Error(w, `{"status":401}`, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// inRange applies created_at filters, comparing strings as Mongo does
+func inRange(record map[string]interface{}, r *http.Request) bool {
+	createdAt, _ := record["created_at"].(string)
+	if from := r.URL.Query().Get("created_at$gte"); from != "" && createdAt < from {
+		return false
+	}
+	if to := r.URL.Query().Get("created_at$lt"); to != "" && createdAt >= to {
+		return false
+	}
+	return true
+}
+
+// sortField is the time field APIv3 clients sort the collection by, entries have no created_at
+func sortField(collection string) string {
+	if collection == "entries" {
+		return "date"
+	}
+	return "created_at"
+}
+
+// inDateRange applies date filters of epoch milliseconds
+func inDateRange(record map[string]interface{}, r *http.Request) bool {
+	date, _ := record["date"].(float64)
+	if from, err := strconv.ParseFloat(r.URL.Query().Get("date$gte"), 64); err == nil && date < from {
+		return false
+	}
+	if to, err := strconv.ParseFloat(r.URL.Query().Get("date$lt"), 64); err == nil && date >= to {
+		return false
+	}
+	return true
+}
+
+func page(records []map[string]interface{}, r *http.Request) []map[string]interface{} {
+	skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if skip > len(records) {
+		skip = len(records)
+	}
+	records = records[skip:]
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	return records
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
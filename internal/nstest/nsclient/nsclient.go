@@ -0,0 +1,19 @@
+// Package nsclient connects the NS client to a fake Nightscout. It is apart from nstest, which the tests of the source package use.
+package nsclient
+
+import (
+	"context"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/source"
+	"testing"
+)
+
+// Connect returns a client authorized in the server
+func Connect(t testing.TB, server *nstest.Server, options source.Options) *source.NSClient {
+	t.Helper()
+	client := source.NewNSClient(server.URL, nstest.Token, options)
+	if err := client.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
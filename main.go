@@ -2,319 +2,243 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/peterbourgon/ff/v3"
-	"html"
-	"log"
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"ns-exporter/config"
+	"ns-exporter/pipeline"
+	"ns-exporter/sink"
+	"ns-exporter/transform"
 	"os"
-	"regexp"
-	"strconv"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
-var wg sync.WaitGroup
-var wgInflux sync.WaitGroup
-
 func main() {
 	fs := flag.NewFlagSet("ns-exporter", flag.ContinueOnError)
-	var (
-		mongoUri     = fs.String("mongo-uri", "", "Mongo-db uri to download from")
-		mongoDb      = fs.String("mongo-db", "", "Mongo-db database name")
-		nsUri        = fs.String("ns-uri", "", "Nightscout server url to download from")
-		nsToken      = fs.String("ns-token", "", "Nigthscout server API Authorization Token")
-		limit        = fs.Int64("limit", 0, "number of records to read from mongo-db")
-		skip         = fs.Int64("skip", 0, "number of records to skip from mongo-db")
-		influxUri    = fs.String("influx-uri", "", "InfluxDb uri to download from")
-		influxToken  = fs.String("influx-token", "", "InfluxDb access token")
-		influxOrg    = fs.String("influx-org", "ns", "InfluxDb organization to use")
-		influxBucket = fs.String("influx-bucket", "ns", "InfluxDb bucket to use")
-		configFile   = fs.String("config", "", "File to load configuration from")
-		user         = fs.String("user", "", "User name to be set on Influx record")
-	)
-	if err := ff.Parse(fs, os.Args[1:], ff.WithEnvVarPrefix("NS_EXPORTER")); err != nil {
+	var s = newSettings(fs)
+	var options = parseOptions(s)
+
+	// subcommands share the arguments, so they can be given both before and after the subcommand name
+	validateCmd := &ffcli.Command{
+		Name:       "validate",
+		ShortUsage: "ns-exporter validate [flags]",
+		ShortHelp:  "Check the configuration and connectivity of every import",
+		FlagSet:    fs,
+		Options:    options,
+		Exec: func(ctx context.Context, _ []string) error {
+			return validate(ctx, s, os.Stdout)
+		},
+	}
+	restoreCmd := &ffcli.Command{
+		Name:       "restore",
+		ShortUsage: "ns-exporter restore -user <user> [-from <time>] [-to <time>] [-dry-run] [flags]",
+		ShortHelp:  "Write the points of a user from InfluxDb back into its Nightscout",
+		FlagSet:    fs,
+		Options:    options,
+		Exec: func(ctx context.Context, _ []string) error {
+			return restoreUser(ctx, s, os.Stdout)
+		},
+	}
+	replicateCmd := &ffcli.Command{
+		Name:       "replicate",
+		ShortUsage: "ns-exporter replicate [flags]",
+		ShortHelp:  "Copy the documents of every import into its replication target",
+		FlagSet:    fs,
+		Options:    options,
+		Exec: func(ctx context.Context, _ []string) error {
+			return replicateImports(ctx, s, os.Stdout)
+		},
+	}
+	grafanaCmd := &ffcli.Command{
+		Name:       "grafana",
+		ShortUsage: "ns-exporter grafana [-grafana-dir <dir>] [flags]",
+		ShortHelp:  "Generate the Grafana dashboard and datasource provisioning for the InfluxDb written to",
+		FlagSet:    fs,
+		Options:    options,
+		Exec: func(ctx context.Context, _ []string) error {
+			return provisionGrafana(s, os.Stdout)
+		},
+	}
+	describeCmd := &ffcli.Command{
+		Name:       "describe",
+		ShortUsage: "ns-exporter describe [-describe-format table|json]",
+		ShortHelp:  "Print the measurements, tags and fields written, with their types and source fields",
+		FlagSet:    fs,
+		Options:    options,
+		Exec: func(ctx context.Context, _ []string) error {
+			return describe(s, os.Stdout)
+		},
+	}
+	root := &ffcli.Command{
+		ShortUsage:  "ns-exporter [flags] [validate|restore|replicate|grafana|describe]",
+		FlagSet:     fs,
+		Options:     options,
+		Subcommands: []*ffcli.Command{validateCmd, restoreCmd, replicateCmd, grafanaCmd, describeCmd},
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return fmt.Errorf("unknown command %q", args[0])
+			}
+			return export(ctx, s)
+		},
+	}
+
+	if err := root.ParseAndRun(context.Background(), os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
+}
 
-	ctx := context.Background()
+// parseOptions read arguments from environment variables and the config file, command line ones take precedence
+func parseOptions(s *settings) []ff.Option {
+	return []ff.Option{
+		ff.WithEnvVarPrefix("NS_EXPORTER"),
+		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(config.Parser(s.configFile, &s.file)),
+	}
+}
 
-	deviceStatuses := make(chan NsEntry)
-	treatments := make(chan NsTreatment)
-	influx := make(chan write.Point)
+func export(ctx context.Context, s *settings) error {
+	if _, err := s.transformOptions(); err != nil {
+		return err
+	}
 
-	if *mongoUri != "" && *mongoDb != "" {
-		NewExporterFromMongo(*mongoUri, *mongoDb, *user, ctx).processClient(deviceStatuses, treatments, *limit, *skip, ctx)
+	monitor, err := s.monitor()
+	if err != nil {
+		return err
 	}
-	if *nsUri != "" && *nsToken != "" {
-		NewExporterFromNS(*nsUri, *nsToken, *user).processClient(deviceStatuses, treatments, *limit, *skip, ctx)
+	shared, err := s.sharedSinks()
+	if err != nil {
+		return err
 	}
-	var config = Config{}
-	if *configFile != "" {
-		file, err := os.Open(*configFile)
+	var sinks = &influxSinks{shared: shared}
+	defer sinks.Close()
+	var imports []pipeline.Import
+	for _, entry := range s.importEntries() {
+		entry := entry
+		result, err := s.exportImport(entry, sinks)
 		if err != nil {
-			log.Fatal("can't open config file: ", err)
-		}
-		defer file.Close()
-		decoder := json.NewDecoder(file)
-		err = decoder.Decode(&config)
-		if err != nil {
-			log.Fatal("can't decode config JSON: ", err)
-		}
-		var climit = *limit
-		if climit == 0 {
-			climit = config.Limit
-		}
-		if climit == 0 {
-			fail("'limit' must be greater than 0")
+			return fmt.Errorf("import of user %q: %w", entry.User, err)
 		}
-
-		var cskip = *skip
-		if cskip == 0 {
-			cskip = config.Skip
+		// secret files are checked before every run, so rotated secrets are used without restart
+		result.Refresh = func() (pipeline.Import, error) {
+			return s.exportImport(entry, sinks)
 		}
+		imports = append(imports, result)
+	}
 
-		for _, entry := range config.Imports {
-			var fMongoUri = combine(*mongoUri, entry.MongoUri)
-			if fMongoUri != "" && entry.MongoDb != "" {
-				NewExporterFromMongo(fMongoUri, entry.MongoDb, entry.User, ctx).processClient(deviceStatuses, treatments, climit, cskip, ctx)
-			}
-			if entry.NsUri != "" && entry.NsToken != "" {
-				NewExporterFromNS(entry.NsUri, entry.NsToken, entry.User).processClient(deviceStatuses, treatments, climit, cskip, ctx)
-			}
+	var cfg = pipeline.Config{
+		Imports:        imports,
+		DedupTolerance: *s.dedupTolerance,
+		SyncDeletes:    *s.syncDeletes,
+		GapThreshold:   *s.gapThreshold,
+	}
+	// a nil monitor must not become a non-nil observer
+	if monitor != nil {
+		cfg.Observer = monitor
+	}
+	if !scheduled(imports) {
+		if *s.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *s.timeout)
+			defer cancel()
 		}
+		summary, err := pipeline.New(cfg).Run(ctx)
+		fmt.Println("total duplicates skipped: ", summary.Duplicates)
+		reportGaps(summary.Gaps)
+		return err
 	}
 
-	var wgTransform = &sync.WaitGroup{}
-	wgTransform.Add(2)
-
-	go parseDeviceStatuses(wgTransform, influx, deviceStatuses)
-	go parseTreatments(wgTransform, influx, treatments)
-
-	go func() {
-		wgInflux.Add(1)
-		defer wgInflux.Done()
-		var count = 0
-		var fInfluxUri = combineOrFail("InfluxDB uri not supplied", *influxUri, config.InfluxUri)
-		var fInfluxToken = combineOrFail("InfluxDB token not supplied", *influxToken, config.InfluxToken)
-		var fInfluxOrg = combineOrFail("InfluxDB token not supplied", *influxOrg, config.InfluxOrg)
-		var fInfluxBucket = combineOrFail("InfluxDB token not supplied", *influxBucket, config.InfluxBucket)
-		writeAPI := influxdb2.NewClient(fInfluxUri, fInfluxToken).WriteAPIBlocking(fInfluxOrg, fInfluxBucket)
-
-		for point := range influx {
-
-			if len(point.FieldList()) == 0 && len(point.TagList()) == 0 {
-
-				fmt.Println("empty point for time: ", point.Time(), " of type: ", point.Name())
-				continue
-			}
-
-			err := writeAPI.WritePoint(ctx, &point)
-			count++
-			if err != nil {
-				fmt.Println("error writing: ", point.Time(), ", name: ", point.Name())
-			}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	pipeline.Schedule(ctx, cfg, *s.timeout, func(interval time.Duration, summary pipeline.Summary, err error) {
+		fmt.Println("run every ", interval, " finished, written: ", summary.Written, ", deleted: ", summary.Deleted, ", duplicates skipped: ", summary.Duplicates)
+		reportGaps(summary.Gaps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		}
-
-		fmt.Println("total writen: ", count)
-
-	}()
-
-	wg.Wait()
-	close(deviceStatuses)
-	close(treatments)
-	wgTransform.Wait()
-	close(influx)
-	wgInflux.Wait()
+	})
+	return nil
 }
 
-func combineOrFail(message string, values ...string) string {
-	var result = combine(values...)
-	if result == "" {
-		fail(message)
+// reportGaps lists the gaps of the run, so stopped uploads are noticed in the logs
+func reportGaps(gaps []transform.Gap) {
+	if len(gaps) > 0 {
+		fmt.Println("total gaps: ", len(gaps))
+	}
+	for _, gap := range gaps {
+		fmt.Println("gap in ", gap)
 	}
-	return result
 }
 
-func combine(values ...string) string {
-	var result = ""
-	for _, value := range values {
-		if value != "" {
-			result = value
+// exportImport resolves the import with its InfluxDb sink, and the sinks shared by all imports
+func (s *settings) exportImport(entry config.Import, sinks *influxSinks) (pipeline.Import, error) {
+	result, err := s.newImport(entry)
+	if err != nil {
+		return result, err
+	}
+	var targets []sink.Sink
+	if s.influxConfigured(entry) {
+		target, err := s.influxTarget(entry)
+		if err != nil {
+			return result, err
 		}
+		targets = append(targets, sinks.get(target))
 	}
-	return result
+	targets = append(targets, sinks.shared...)
+	result.Sink = targets[0]
+	if len(targets) > 1 {
+		result.Sink = sink.NewMulti(targets...)
+	}
+	return result, nil
 }
 
-func fail(message string) {
-	fmt.Fprintf(os.Stderr, "error: %v\n", message)
-	os.Exit(1)
+// influxSinks share a client between imports with the same InfluxDb target, and hold the sinks every import writes to
+type influxSinks struct {
+	mutex  sync.Mutex
+	sinks  map[influxTarget]sink.Sink
+	shared []sink.Sink
 }
 
-func parseDeviceStatuses(group *sync.WaitGroup, influx chan write.Point, entries chan NsEntry) {
-	defer group.Done()
-
-	reg := regexp.MustCompile("Dev: (?P<dev>[-0-9.]+),.*ISF: (?:(?P<isf_nt>[-0-9.]+)/(?P<isf_bg>[-0-9.]+)+=)?(?P<isf>[-0-9.]+),.*CR: (?P<cr>[-0-9.]+)")
-
-	var count = 0
-	var lastbg = 0.0
-	var lasttick float64 = 0
-
-	for entry := range entries {
-
-		point := influxdb2.NewPointWithMeasurement("openaps").
-			AddField("iob", entry.OpenAps.IOB.IOB).
-			AddField("basal_iob", entry.OpenAps.IOB.BasalIOB).
-			AddField("activity", entry.OpenAps.IOB.Activity).
-			SetTime(entry.OpenAps.IOB.Time)
-
-		if entry.User != "" {
-			point.AddTag("user", entry.User)
-		}
-
-		if entry.OpenAps.Suggested.Bg > 0 {
-
-			var tick = entry.OpenAps.Suggested.Tick
-			if lastbg == entry.OpenAps.Suggested.Bg &&
-				lasttick == tick &&
-				tick != 0.0 {
-				// deduplication, because nightscout still allows duplicate records to be added
-				fmt.Println("skipping duplicate bg record: ", entry.OpenAps.IOB.Time, ", bg: ", entry.OpenAps.Suggested.Bg, ", tick: ", tick)
-				continue
-			}
-
-			lastbg = entry.OpenAps.Suggested.Bg
-			lasttick = tick
-			point.
-				AddField("bg", entry.OpenAps.Suggested.Bg).
-				AddField("tick", tick).
-				AddField("eventual_bg", entry.OpenAps.Suggested.EventualBG).
-				AddField("target_bg", entry.OpenAps.Suggested.TargetBG).
-				AddField("insulin_req", entry.OpenAps.Suggested.InsulinReq).
-				AddField("cob", entry.OpenAps.Suggested.COB).
-				AddField("bolus", entry.OpenAps.Suggested.Units).
-				AddField("tbs_rate", entry.OpenAps.Suggested.Rate).
-				AddField("tbs_duration", entry.OpenAps.Suggested.Duration).
-				AddField("sens", entry.OpenAps.Suggested.SensitivityRatio)
-
-			if len(entry.OpenAps.Suggested.PredBGs.COB) > 0 {
-				point.AddField("pred_cob", entry.OpenAps.Suggested.PredBGs.COB[len(entry.OpenAps.Suggested.PredBGs.COB)-1])
-			}
-			if len(entry.OpenAps.Suggested.PredBGs.IOB) > 0 {
-				point.AddField("pred_iob", entry.OpenAps.Suggested.PredBGs.IOB[len(entry.OpenAps.Suggested.PredBGs.IOB)-1])
-			}
-			if len(entry.OpenAps.Suggested.PredBGs.UAM) > 0 {
-				point.AddField("pred_uam", entry.OpenAps.Suggested.PredBGs.UAM[len(entry.OpenAps.Suggested.PredBGs.UAM)-1])
-			}
-			if len(entry.OpenAps.Suggested.PredBGs.ZT) > 0 {
-				point.AddField("pred_zt", entry.OpenAps.Suggested.PredBGs.ZT[len(entry.OpenAps.Suggested.PredBGs.ZT)-1])
-			}
-			if len(entry.OpenAps.Suggested.Reason) > 0 {
-				matches := reg.FindStringSubmatch(entry.OpenAps.Suggested.Reason)
-				names := reg.SubexpNames()
-				for i, match := range matches {
-					if i != 0 {
-						if len(match) > 0 {
-							if rvalue, err := strconv.ParseFloat(match, 32); err == nil {
-								point.AddField(names[i], rvalue)
-							}
-						}
-					}
-				}
-
-				point.AddField("reason", html.UnescapeString(entry.OpenAps.Suggested.Reason))
-			}
-		}
-
-		count++
-		influx <- *point
-
-		fmt.Println("treatment time+: ", entry.OpenAps.IOB.Time, "iob:", entry.OpenAps.IOB.IOB, ", bg: ", entry.OpenAps.Suggested.Bg)
+func (s *influxSinks) get(target influxTarget) sink.Sink {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sinks == nil {
+		s.sinks = map[influxTarget]sink.Sink{}
+	}
+	if s.sinks[target] == nil {
+		s.sinks[target] = target.newSink()
 	}
-	fmt.Println("total devicestatuses parsed: ", count)
+	return s.sinks[target]
 }
 
-func parseTreatments(group *sync.WaitGroup, influx chan write.Point, entries chan NsTreatment) {
-	defer group.Done()
-
-	var noted = map[string]bool{
-		"Site Change":         true,
-		"Insulin Change":      true,
-		"Pump Battery Change": true,
-		"Sensor Change":       true,
-		"Sensor Start":        true,
-		"Sensor Stop":         true,
-		"BG Check":            true,
-		"Exercise":            true,
-		"Announcement":        true,
-		"Question":            true,
-		//"Note": true,
-		"OpenAPS Offline": true,
-		"D.A.D. Alert":    true,
-		"Mbg":             true,
-		//"Carb Correction": true,
-		//"Bolus Wizard": true,
-		//"Correction Bolus": true,
-		//"Meal Bolus": true,
-		//"Combo Bolus": true,
-		//"Temporary Target": true,
-		//"Temporary Target Cancel": true,
-		"Profile Switch": true,
-		//"Snack Bolus": true,
-		//"Temp Basal": true,
-		//"Temp Basal Start": true,
-		//"Temp Basal End": true,
+func (s *influxSinks) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, influx := range s.sinks {
+		influx.Close()
 	}
-
-	var count = 0
-	for entry := range entries {
-
-		point := influxdb2.NewPointWithMeasurement("treatments").
-			SetTime(entry.CreatedAt)
-
-		if entry.User != "" {
-			point.AddTag("user", entry.User)
+	for _, shared := range s.shared {
+		// buffering sinks write the rest of their rows on close
+		if err := shared.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		}
+	}
+}
 
-		tagName := "type"
-		if entry.Carbs > 0 {
-			point.
-				AddField("carbs", entry.Carbs).
-				AddTag(tagName, "carbs")
+// scheduled reports whether any import repeats, which keeps the exporter running
+func scheduled(imports []pipeline.Import) bool {
+	for _, entry := range imports {
+		if entry.Interval > 0 {
+			return true
 		}
-		if entry.Insulin > 0 {
-			point.
-				AddField("bolus", entry.Insulin).
-				AddTag(tagName, "bolus").
-				AddTag("smb", strconv.FormatBool(entry.IsSMB))
-		}
-		if entry.EventType == "Temp Basal" {
-			point.
-				AddField("duration", entry.Duration).
-				AddField("percent", entry.Percent).
-				AddField("rate", entry.Rate).
-				AddTag(tagName, "tbs")
-		} else if entry.EventType == "Temporary Target" {
-			point.
-				AddField("duration", entry.Duration).
-				AddField("target_top", entry.TargetTop).
-				AddField("target_bottom", entry.TargetBottom).
-				AddField("units", entry.Units).
-				AddField("reason", entry.Reason).
-				AddTag(tagName, "tt")
-		} else if len(entry.Notes) > 0 {
-			point.AddField("notes", entry.Notes)
-		} else if noted[entry.EventType] {
-			point.AddField("notes", entry.EventType)
-		}
-
-		count++
-		influx <- *point
-		fmt.Println("time: ", point.Time(), ", type: ", entry.EventType)
 	}
-
-	fmt.Println("total treatments parsed: ", count)
+	return false
 }
@@ -0,0 +1,235 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type NsEntry struct {
+	ID         string `json:"_id,omitempty" bson:"_id,omitempty"`
+	Identifier string `json:"identifier,omitempty" bson:"identifier,omitempty"`
+	Device     string `json:"device" bson:"device"`
+	RecordTime `bson:",inline"`
+	OpenAps    struct {
+		Suggested struct {
+			Temp             string  `json:"temp" bson:"temp"`
+			Bg               Number  `json:"bg" bson:"bg"`
+			Tick             Number  `json:"tick" bson:"tick"`
+			EventualBG       Number  `json:"eventualBG" bson:"eventualBG"`
+			TargetBG         Number  `json:"targetBG" bson:"targetBG"`
+			InsulinReq       Number  `json:"insulinReq" bson:"insulinReq"`
+			DeliverAt        RawTime `json:"deliverAt" bson:"deliverAt"`
+			SensitivityRatio Number  `json:"sensitivityRatio" bson:"sensitivityRatio"`
+			PredBGs          struct {
+				IOB []Number `json:"IOB" bson:"IOB"`
+				ZT  []Number `json:"ZT" bson:"ZT"`
+				COB []Number `json:"COB" bson:"COB"`
+				UAM []Number `json:"UAM" bson:"UAM"`
+			} `json:"predBGs" bson:"predBGs"`
+			COB       Number  `json:"COB" bson:"COB"`
+			IOB       Number  `json:"IOB" bson:"IOB"`
+			Reason    string  `json:"reason" bson:"reason"`
+			Units     Number  `json:"units" bson:"units"`
+			Rate      Number  `json:"rate" bson:"rate"`
+			Duration  Number  `json:"duration" bson:"duration"`
+			Timestamp RawTime `json:"timestamp" bson:"timestamp"`
+		} `json:"suggested,omitempty" bson:"suggested,omitempty"`
+		IOB struct {
+			IOB      Number  `json:"iob" bson:"iob"`
+			BasalIOB Number  `json:"basaliob" bson:"basaliob"`
+			Activity Number  `json:"activity" bson:"activity"`
+			Time     RawTime `json:"time" bson:"time"`
+		} `json:"iob" bson:"iob"`
+	} `json:"openaps" bson:"openaps"`
+	Pump struct {
+		Clock     RawTime `json:"clock" bson:"clock"`
+		Reservoir Number  `json:"reservoir" bson:"reservoir"`
+		Status    struct {
+			Status    string `json:"status" bson:"status"`
+			Timestamp int64  `json:"-" bson:"-"`
+		} `json:"status" bson:"status"`
+		Extended struct {
+			Version               string `json:"Version" bson:"Version"`
+			ActiveProfile         string `json:"ActiveProfile" bson:"ActiveProfile"`
+			TempBasalAbsoluteRate Number `json:"TempBasalAbsoluteRate" bson:"TempBasalAbsoluteRate"`
+			TempBasalPercent      Number `json:"TempBasalPercent" bson:"TempBasalPercent"`
+			TempBasalRemaining    Number `json:"TempBasalRemaining" bson:"TempBasalRemaining"`
+		} `json:"extended" bson:"extended"`
+		Battery struct {
+			Percent Number `json:"percent" bson:"percent"`
+		} `json:"battery" bson:"battery"`
+	} `json:"pump" bson:"pump"`
+	IsValid *bool `json:"isValid,omitempty" bson:"isValid,omitempty"`
+	// Time is resolved from openaps.iob.time, created_at, date or mills in Location
+	Time     time.Time      `json:"-" bson:"-"`
+	Location *time.Location `json:"-" bson:"-"`
+	User     string         `json:"-"`
+}
+
+// ResolveTime sets Time and Location of the record, loc is used for timestamps without zone
+func (e *NsEntry) ResolveTime(loc *time.Location) (err error) {
+	e.Time, err = e.resolve(loc, e.OpenAps.IOB.Time)
+	e.Location = e.location(loc)
+	return err
+}
+
+type NsTreatment struct {
+	ID               string `json:"_id,omitempty" bson:"_id,omitempty"`
+	RecordTime       `bson:",inline"`
+	EnteredBy        string `json:"enteredBy" bson:"enteredBy"`
+	EventType        string `json:"eventType" bson:"eventType"`
+	Carbs            Number `json:"carbs,omitempty" bson:"carbs,omitempty"`
+	Duration         Number `json:"duration,omitempty" bson:"duration,omitempty"`
+	Insulin          Number `json:"insulin,omitempty" bson:"insulin,omitempty"`
+	IsSMB            bool   `json:"isSMB,omitempty" bson:"isSMB,omitempty"`
+	Notes            string `json:"notes,omitempty" bson:"notes,omitempty"`
+	Percent          Number `json:"percent,omitempty" bson:"percent,omitempty"`
+	TargetTop        Number `json:"targetTop,omitempty" bson:"targetTop,omitempty"`
+	TargetBottom     Number `json:"targetBottom,omitempty" bson:"targetBottom,omitempty"`
+	Reason           string `json:"reason,omitempty" bson:"reason,omitempty"`
+	Rate             Number `json:"rate,omitempty" bson:"rate,omitempty"`
+	Units            string `json:"units,omitempty" bson:"units,omitempty"`
+	Glucose          Number `json:"glucose,omitempty" bson:"glucose,omitempty"`
+	GlucoseType      string `json:"glucoseType,omitempty" bson:"glucoseType,omitempty"`
+	AbsorptionTime   Number `json:"absorptionTime,omitempty" bson:"absorptionTime,omitempty"`
+	Profile          string `json:"profile,omitempty" bson:"profile,omitempty"`
+	Percentage       Number `json:"percentage,omitempty" bson:"percentage,omitempty"`
+	Timeshift        Number `json:"timeshift,omitempty" bson:"timeshift,omitempty"`
+	OriginalDuration Number `json:"originalDuration,omitempty" bson:"originalDuration,omitempty"`
+	PumpId           int64  `json:"pumpId,omitempty" bson:"pumpId,omitempty"`
+	PumpType         string `json:"pumpType,omitempty" bson:"pumpType,omitempty"`
+	Type             string `json:"type,omitempty" bson:"type,omitempty"`
+	IsValid          *bool  `json:"isValid,omitempty" bson:"isValid,omitempty"`
+	Identifier       string `json:"identifier,omitempty" bson:"identifier,omitempty"`
+	// Extra holds every field of the source document not mapped above
+	Extra map[string]interface{} `json:"-" bson:",inline"`
+	// CreatedAt is resolved from created_at, date or mills in Location
+	CreatedAt time.Time      `json:"-" bson:"-"`
+	Location  *time.Location `json:"-" bson:"-"`
+	User      string         `json:"-" bson:"-"`
+}
+
+// ResolveTime sets CreatedAt and Location of the record, loc is used for timestamps without zone
+func (t *NsTreatment) ResolveTime(loc *time.Location) (err error) {
+	t.CreatedAt, err = t.resolve(loc)
+	t.Location = t.location(loc)
+	return err
+}
+
+// NsSgv is a CGM reading or meter value of the entries collection
+type NsSgv struct {
+	ID         string  `json:"_id,omitempty" bson:"_id,omitempty"`
+	Identifier string  `json:"identifier,omitempty" bson:"identifier,omitempty"`
+	Type       string  `json:"type" bson:"type"`
+	Sgv        Number  `json:"sgv,omitempty" bson:"sgv,omitempty"`
+	Mbg        Number  `json:"mbg,omitempty" bson:"mbg,omitempty"`
+	Direction  string  `json:"direction,omitempty" bson:"direction,omitempty"`
+	Noise      Number  `json:"noise,omitempty" bson:"noise,omitempty"`
+	Device     string  `json:"device,omitempty" bson:"device,omitempty"`
+	DateString RawTime `json:"dateString,omitempty" bson:"dateString,omitempty"`
+	RecordTime `bson:",inline"`
+	IsValid    *bool `json:"isValid,omitempty" bson:"isValid,omitempty"`
+	// Time is resolved from dateString, created_at, date or mills in Location
+	Time     time.Time      `json:"-" bson:"-"`
+	Location *time.Location `json:"-" bson:"-"`
+	User     string         `json:"-" bson:"-"`
+}
+
+// ResolveTime sets Time and Location of the record, loc is used for timestamps without zone
+func (s *NsSgv) ResolveTime(loc *time.Location) (err error) {
+	s.Time, err = s.resolve(loc, s.DateString)
+	s.Location = s.location(loc)
+	return err
+}
+
+// Valid reports whether the record is not soft-deleted
+func (s *NsSgv) Valid() bool {
+	return isValid(s.IsValid)
+}
+
+// Valid reports whether the record is not soft-deleted
+func (e *NsEntry) Valid() bool {
+	return isValid(e.IsValid)
+}
+
+// Valid reports whether the record is not soft-deleted
+func (t *NsTreatment) Valid() bool {
+	return isValid(t.IsValid)
+}
+
+// isValid reports whether the record is not soft-deleted, records without the flag are valid
+func isValid(flag *bool) bool {
+	return flag == nil || *flag
+}
+
+// treatmentKeys are the json names of the mapped NsTreatment fields, these are excluded from Extra
+var treatmentKeys = jsonKeys(reflect.TypeOf(NsTreatment{}))
+
+func (t *NsTreatment) UnmarshalJSON(data []byte) error {
+	type plain NsTreatment
+	if err := json.Unmarshal(data, (*plain)(t)); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, key := range treatmentKeys {
+		delete(all, key)
+	}
+	if len(all) > 0 {
+		t.Extra = all
+	}
+	return nil
+}
+
+// Lookup returns the value of the treatment field with the given json name, falling back to Extra.
+// Zero values of mapped fields are reported as missing.
+func (t *NsTreatment) Lookup(name string) (interface{}, bool) {
+	if field, ok := lookupField(reflect.ValueOf(t).Elem(), name); ok {
+		if field.IsZero() {
+			return nil, false
+		}
+		if field.Kind() == reflect.Ptr {
+			field = field.Elem()
+		}
+		return field.Interface(), true
+	}
+	value, ok := t.Extra[name]
+	return value, ok
+}
+
+func lookupField(val reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < val.NumField(); i++ {
+		if val.Type().Field(i).Anonymous {
+			if field, ok := lookupField(val.Field(i), name); ok {
+				return field, true
+			}
+		} else if jsonKey(val.Type().Field(i)) == name {
+			return val.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func jsonKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Anonymous {
+			keys = append(keys, jsonKeys(t.Field(i).Type)...)
+		} else if key := jsonKey(t.Field(i)); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func jsonKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("json"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
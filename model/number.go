@@ -0,0 +1,81 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"strconv"
+	"strings"
+)
+
+// Number is a numeric record field, which uploaders sometimes send as a string (e.g. tick "+5" or carbs "20").
+// It decodes the same way from JSON and BSON, empty and null values are zero.
+type Number float64
+
+func (n *Number) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*n = 0
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return n.parse(text)
+	}
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*n = Number(value)
+	return nil
+}
+
+func (n *Number) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.Double:
+		*n = Number(value.Double())
+	case bsontype.Int32, bsontype.Int64:
+		*n = Number(value.AsInt64())
+	case bsontype.Decimal128:
+		return n.parse(value.Decimal128().String())
+	case bsontype.String:
+		return n.parse(value.StringValue())
+	case bsontype.Null, bsontype.Undefined:
+		*n = 0
+	default:
+		return fmt.Errorf("can't decode %v into a number", t)
+	}
+	return nil
+}
+
+func (n *Number) parse(text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		*n = 0
+		return nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("can't decode %q into a number: %w", text, err)
+	}
+	*n = Number(value)
+	return nil
+}
+
+func (n Number) Float() float64 {
+	return float64(n)
+}
+
+// Int returns the value rounded to integer, for fields which are written to Influx as integers
+func (n Number) Int() int64 {
+	if n < 0 {
+		return int64(n - 0.5)
+	}
+	return int64(n + 0.5)
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zonedLayouts are tried first, zoneLessLayouts are interpreted in the record or user location
+var zonedLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+}
+
+var zoneLessLayouts = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+}
+
+// RawTime keeps a timestamp as written by the uploader, to be resolved once the location is known.
+// BSON dates and epoch milliseconds are kept in RFC3339 and decimal form.
+type RawTime string
+
+func (r *RawTime) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		*r = RawTime(v)
+	case float64:
+		*r = RawTime(fmt.Sprint(int64(v)))
+	case nil:
+		*r = ""
+	default:
+		return fmt.Errorf("can't decode %s into a timestamp", data)
+	}
+	return nil
+}
+
+func (r *RawTime) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.String:
+		*r = RawTime(value.StringValue())
+	case bsontype.DateTime:
+		*r = RawTime(value.Time().UTC().Format(time.RFC3339Nano))
+	case bsontype.Int32, bsontype.Int64:
+		*r = RawTime(fmt.Sprint(value.AsInt64()))
+	case bsontype.Double:
+		*r = RawTime(fmt.Sprint(int64(value.Double())))
+	case bsontype.Null, bsontype.Undefined:
+		*r = ""
+	default:
+		return fmt.Errorf("can't decode %v into a timestamp", t)
+	}
+	return nil
+}
+
+// RecordTime holds all the ways Nightscout records carry their time
+type RecordTime struct {
+	Created   RawTime `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	Date      Number  `json:"date,omitempty" bson:"date,omitempty"`
+	Mills     Number  `json:"mills,omitempty" bson:"mills,omitempty"`
+	UtcOffset *int    `json:"utcOffset,omitempty" bson:"utcOffset,omitempty"`
+}
+
+// resolve returns the first parsable of the given timestamps, created_at, date and mills.
+// Timestamps without zone are interpreted using utcOffset of the record, or the given location when it's missing.
+func (r RecordTime) resolve(loc *time.Location, preferred ...RawTime) (time.Time, error) {
+	if r.UtcOffset != nil {
+		loc = time.FixedZone("", *r.UtcOffset*60)
+	}
+	var failed []string
+	for _, value := range append(preferred, r.Created) {
+		if value == "" {
+			continue
+		}
+		parsed, err := parseTimestamp(string(value), loc)
+		if err == nil {
+			return parsed, nil
+		}
+		failed = append(failed, string(value))
+	}
+	for _, epoch := range []Number{r.Date, r.Mills} {
+		if epoch > 0 {
+			return time.UnixMilli(epoch.Int()).UTC(), nil
+		}
+	}
+	if len(failed) > 0 {
+		return time.Time{}, fmt.Errorf("can't parse timestamp %q", strings.Join(failed, `", "`))
+	}
+	return time.Time{}, errors.New("record has no timestamp")
+}
+
+// Resolve returns the time of the record, loc is used for timestamps without zone
+func (r RecordTime) Resolve(loc *time.Location) (time.Time, error) {
+	return r.resolve(loc)
+}
+
+// location returns the configured location, falling back to utcOffset of the record and UTC
+func (r RecordTime) location(configured *time.Location) *time.Location {
+	if configured != nil {
+		return configured
+	}
+	if r.UtcOffset != nil {
+		return time.FixedZone("", *r.UtcOffset*60)
+	}
+	return time.UTC
+}
+
+// parseTimestamp parses RFC3339 strings with or without fraction and zone, or epoch milliseconds
+func parseTimestamp(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range zonedLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range zoneLessLayouts {
+		if parsed, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return parsed, nil
+		}
+	}
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil && epoch > 0 {
+		return time.UnixMilli(epoch).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown timestamp format: %q", value)
+}
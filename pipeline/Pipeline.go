@@ -0,0 +1,424 @@
+// Package pipeline runs imports of Nightscout instances through the transforms into a sink.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/model"
+	"ns-exporter/sink"
+	"ns-exporter/source"
+	"ns-exporter/transform"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DeviceStatus = "devicestatus"
+	Treatments   = "treatments"
+	Entries      = "entries"
+)
+
+// Collections are the Nightscout collections which can be exported
+var Collections = []string{DeviceStatus, Treatments, Entries}
+
+// DefaultCollections are exported when an import does not list its collections,
+// CGM entries are many times more records so they have to be asked for
+var DefaultCollections = []string{DeviceStatus, Treatments}
+
+// Import is a single Nightscout instance read either from its Mongo database or through the NS API.
+// Its optional settings override the ones of the pipeline Config.
+type Import struct {
+	User string
+	// Location is used for timestamps without zone and local time tags, nil means UTC
+	Location *time.Location
+	MongoUri string
+	MongoDb  string
+	NsUri    string
+	NsToken  string
+	Limit    int64
+	Skip     int64
+	// From and To limit records to the time range, zero values leave it open
+	From time.Time
+	To   time.Time
+	// Collections to export, DefaultCollections when empty
+	Collections []string
+	Transform   *transform.Options
+	Sink        sink.Sink
+	// Interval of repeated runs by Schedule, zero runs the import once
+	Interval time.Duration
+	// Refresh returns the current settings of the import before every run, e.g. with reloaded secrets
+	Refresh func() (Import, error)
+}
+
+func (i Import) exports(collection string) bool {
+	var collections = i.Collections
+	if len(collections) == 0 {
+		collections = DefaultCollections
+	}
+	for _, name := range collections {
+		if name == collection {
+			return true
+		}
+	}
+	return false
+}
+
+type Config struct {
+	Imports   []Import
+	Transform transform.Options
+	// DedupTolerance is the time within which records with equal content are treated as duplicates
+	DedupTolerance time.Duration
+	// SyncDeletes deletes points of records which were soft-deleted in Nightscout
+	SyncDeletes bool
+	// GapThreshold is the time without devicestatus or CGM entries of an import reported as a gap, zero disables it
+	GapThreshold time.Duration
+	Sink         sink.Sink
+	// Observer sees the records of every import, e.g. to evaluate alert rules, nil when not needed
+	Observer Observer
+}
+
+// Observer is shown every record a run reads, soft-deleted ones included, before it is transformed.
+// Evaluate is called once all imports of the run are written, its error fails the run.
+// Imports are read concurrently, so an observer must be safe for concurrent use.
+type Observer interface {
+	DeviceStatus(entry model.NsEntry)
+	Treatment(treatment model.NsTreatment)
+	Sgv(sgv model.NsSgv)
+	Evaluate(ctx context.Context) error
+}
+
+// Summary counts the records processed by a run
+type Summary struct {
+	DeviceStatuses int
+	Treatments     int
+	Entries        int
+	Written        int
+	Deleted        int
+	Duplicates     int
+	// Failed counts points and deletions the sink rejected
+	Failed int
+	// Gaps are found when GapThreshold is set
+	Gaps []transform.Gap
+}
+
+func (s *Summary) add(other Summary) {
+	s.DeviceStatuses += other.DeviceStatuses
+	s.Treatments += other.Treatments
+	s.Entries += other.Entries
+	s.Written += other.Written
+	s.Deleted += other.Deleted
+	s.Failed += other.Failed
+	s.Gaps = append(s.Gaps, other.Gaps...)
+}
+
+type Pipeline struct {
+	config Config
+	mutex  sync.Mutex
+	errs   []error
+	// gaps of every import, kept between runs so gaps spanning runs are found
+	gaps []*transform.Gaps
+}
+
+func New(config Config) *Pipeline {
+	var p = &Pipeline{config: config}
+	if config.GapThreshold > 0 {
+		for range config.Imports {
+			p.gaps = append(p.gaps, transform.NewGaps(config.GapThreshold))
+		}
+	}
+	return p
+}
+
+// Run reads all imports and writes them to their sinks. Failing imports do not stop the others,
+// their errors are returned together with the summary of what was written.
+func (p *Pipeline) Run(ctx context.Context) (Summary, error) {
+	p.errs = nil
+
+	// records of a user may come from several imports, so duplicates are recognized across all of them
+	var dedup = transform.NewDeduplicator(p.config.DedupTolerance)
+	var summaries = make([]Summary, len(p.config.Imports))
+	var imports sync.WaitGroup
+	for i, entry := range p.config.Imports {
+		if entry.Refresh != nil {
+			refreshed, err := entry.Refresh()
+			if err != nil {
+				p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+				continue
+			}
+			entry = refreshed
+		}
+		var target = entry.Sink
+		if target == nil {
+			target = p.config.Sink
+		}
+		if target == nil {
+			p.fail(fmt.Errorf("user %q: sink not configured", entry.User))
+			continue
+		}
+		var options = p.config.Transform
+		if entry.Transform != nil {
+			options = *entry.Transform
+		}
+
+		var gaps *transform.Gaps
+		if p.gaps != nil {
+			gaps = p.gaps[i]
+		}
+
+		imports.Add(1)
+		go func(i int, entry Import) {
+			defer imports.Done()
+			// sinks may be shared by imports of several users, the guard keeps each import to its own user
+			summaries[i] = p.run(entry, options, sink.NewTenant(target, options.UserTag(entry.User)), dedup, gaps, ctx)
+		}(i, entry)
+	}
+	imports.Wait()
+	if p.config.Observer != nil {
+		if err := p.config.Observer.Evaluate(ctx); err != nil {
+			p.fail(err)
+		}
+	}
+
+	var summary = Summary{Duplicates: dedup.Duplicates()}
+	for _, result := range summaries {
+		summary.add(result)
+	}
+	return summary, p.err()
+}
+
+// run exports a single import, from all of its sources
+func (p *Pipeline) run(entry Import, options transform.Options, target sink.Sink, dedup *transform.Deduplicator, gaps *transform.Gaps, ctx context.Context) Summary {
+	var summary = Summary{}
+	var loaders, transforms, sinks sync.WaitGroup
+
+	deviceStatuses := make(chan model.NsEntry)
+	treatments := make(chan model.NsTreatment)
+	sgvs := make(chan model.NsSgv)
+	points := make(chan write.Point)
+	var deletes chan transform.Deletion
+	if p.config.SyncDeletes {
+		deletes = make(chan transform.Deletion)
+	}
+
+	var clients = p.open(entry, ctx)
+	for _, client := range clients {
+		p.load(&loaders, client, entry, deviceStatuses, treatments, sgvs, ctx)
+	}
+
+	var observedStatuses, observedTreatments, observedSgvs = (<-chan model.NsEntry)(deviceStatuses), (<-chan model.NsTreatment)(treatments), (<-chan model.NsSgv)(sgvs)
+	if observer := p.config.Observer; observer != nil {
+		observedStatuses = observe(observedStatuses, observer.DeviceStatus)
+		observedTreatments = observe(observedTreatments, observer.Treatment)
+		observedSgvs = observe(observedSgvs, observer.Sgv)
+	}
+	if gaps != nil {
+		observedStatuses = observe(observedStatuses, func(status model.NsEntry) {
+			if status.Valid() {
+				gaps.Record(DeviceStatus, status.Time, status.Location)
+			}
+		})
+		observedSgvs = observe(observedSgvs, func(sgv model.NsSgv) {
+			if sgv.Valid() && sgv.Type == "sgv" && sgv.Sgv > 0 {
+				gaps.Record(Entries, sgv.Time, sgv.Location)
+			}
+		})
+	}
+
+	transforms.Add(3)
+	go func() {
+		defer transforms.Done()
+		summary.DeviceStatuses = transform.DeviceStatuses(points, deletes, dedup, observedStatuses, options)
+	}()
+	go func() {
+		defer transforms.Done()
+		summary.Treatments = transform.Treatments(points, deletes, dedup, observedTreatments, options)
+	}()
+	go func() {
+		defer transforms.Done()
+		summary.Entries = transform.Entries(points, deletes, dedup, observedSgvs, options)
+	}()
+
+	var writeFailures, deleteFailures int
+	sinks.Add(1)
+	go func() {
+		defer sinks.Done()
+		summary.Written, writeFailures = p.writePoints(ctx, target, points)
+	}()
+	if deletes != nil {
+		sinks.Add(1)
+		go func() {
+			defer sinks.Done()
+			summary.Deleted, deleteFailures = p.deletePoints(ctx, target, deletes)
+		}()
+	}
+
+	loaders.Wait()
+	close(deviceStatuses)
+	close(treatments)
+	close(sgvs)
+	transforms.Wait()
+	// without a connected source nothing was read, which is no gap in the data
+	if gaps != nil && len(clients) > 0 {
+		summary.Gaps = p.detectGaps(entry, gaps, options, points)
+	}
+	close(points)
+	if deletes != nil {
+		close(deletes)
+	}
+	sinks.Wait()
+	if flusher, ok := target.(sink.Flusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+		}
+	}
+
+	for _, client := range clients {
+		client.Close(ctx)
+	}
+	summary.Failed = writeFailures + deleteFailures
+	return summary
+}
+
+// detectGaps writes the gaps of the import, a gap until now is ongoing unless the import ends before
+func (p *Pipeline) detectGaps(entry Import, gaps *transform.Gaps, options transform.Options, points chan<- write.Point) []transform.Gap {
+	var end = time.Now()
+	if !entry.To.IsZero() && entry.To.Before(end) {
+		end = entry.To
+	}
+	var found = gaps.Detect(entry.User, end)
+	for _, gap := range found {
+		point, err := transform.GapPoint(gap, options)
+		if err != nil {
+			fmt.Println("skipping gap: ", err)
+			continue
+		}
+		points <- *point
+	}
+	return found
+}
+
+// observe passes the records on after showing them to the observer, the returned channel is closed with records
+func observe[T any](records <-chan T, show func(T)) <-chan T {
+	var observed = make(chan T)
+	go func() {
+		defer close(observed)
+		for record := range records {
+			show(record)
+			observed <- record
+		}
+	}()
+	return observed
+}
+
+// open connects the sources of the import, an import may be read from both Mongo and NS
+func (p *Pipeline) open(entry Import, ctx context.Context) []source.IExporter {
+	var opts = source.Options{
+		User:           entry.User,
+		Location:       entry.Location,
+		IncludeInvalid: p.config.SyncDeletes,
+		From:           entry.From,
+		To:             entry.To,
+	}
+	var clients []source.IExporter
+	if entry.MongoUri != "" && entry.MongoDb != "" {
+		client, err := source.NewMongoClient(entry.MongoUri, entry.MongoDb, opts, ctx)
+		if err != nil {
+			p.fail(fmt.Errorf("can't connect to mongo-db %s of user %q: %w", entry.MongoDb, entry.User, err))
+		} else {
+			clients = append(clients, client)
+		}
+	}
+	if entry.NsUri != "" && entry.NsToken != "" {
+		client := source.NewNSClient(entry.NsUri, entry.NsToken, opts)
+		if err := client.Authorize(ctx); err != nil {
+			p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+		} else {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func (p *Pipeline) load(loaders *sync.WaitGroup, client source.IExporter, entry Import, deviceStatuses chan model.NsEntry, treatments chan model.NsTreatment, sgvs chan model.NsSgv, ctx context.Context) {
+	if entry.exports(DeviceStatus) {
+		loaders.Add(1)
+		go func() {
+			defer loaders.Done()
+			if err := client.LoadDeviceStatuses(deviceStatuses, entry.Limit, entry.Skip, ctx); err != nil {
+				p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+			}
+		}()
+	}
+	if entry.exports(Treatments) {
+		loaders.Add(1)
+		go func() {
+			defer loaders.Done()
+			if err := client.LoadTreatments(treatments, entry.Limit, entry.Skip, ctx); err != nil {
+				p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+			}
+		}()
+	}
+	if entry.exports(Entries) {
+		loaders.Add(1)
+		go func() {
+			defer loaders.Done()
+			if err := client.LoadEntries(sgvs, entry.Limit, entry.Skip, ctx); err != nil {
+				p.fail(fmt.Errorf("user %q: %w", entry.User, err))
+			}
+		}()
+	}
+}
+
+func (p *Pipeline) writePoints(ctx context.Context, target sink.Sink, points chan write.Point) (int, int) {
+	var count, failed = 0, 0
+	for point := range points {
+		point := point
+		if len(point.FieldList()) == 0 && len(point.TagList()) == 0 {
+			fmt.Println("empty point for time: ", point.Time(), " of type: ", point.Name())
+			continue
+		}
+
+		if err := target.Write(ctx, &point); err != nil {
+			fmt.Println("error writing: ", point.Time(), ", name: ", point.Name(), ", error: ", err)
+			failed++
+			continue
+		}
+		count++
+	}
+	fmt.Println("total writen: ", count)
+	return count, failed
+}
+
+func (p *Pipeline) deletePoints(ctx context.Context, target sink.Sink, deletes chan transform.Deletion) (int, int) {
+	var count, failed = 0, 0
+	for entry := range deletes {
+		if err := target.Delete(ctx, entry); err != nil {
+			fmt.Println("error deleting: ", entry.Time, ", name: ", entry.Measurement, ", error: ", err)
+			failed++
+			continue
+		}
+		count++
+	}
+	fmt.Println("total deleted: ", count)
+	return count, failed
+}
+
+func (p *Pipeline) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.errs = append(p.errs, err)
+}
+
+func (p *Pipeline) err() error {
+	if len(p.errs) == 0 {
+		return nil
+	}
+	var messages []string
+	for _, err := range p.errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,294 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/model"
+	"ns-exporter/sink"
+	"ns-exporter/transform"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testdata = "../testdata"
+
+// testOptions match the options the transform goldens were recorded with
+var testOptions = transform.Options{
+	ExtraFields:   []string{"glucose", "profile", "percentage", "absorptionTime", "bolusCalculatorResult", "pumpSerial"},
+	ExtraTags:     []string{"pumpType"},
+	IdMode:        transform.IdTag,
+	SourceTags:    true,
+	LocalTimeTags: true,
+}
+
+func nsImport(t *testing.T, fixture string) Import {
+	return Import{User: "test", NsUri: nstest.NewServer(t, testdata, fixture).URL, NsToken: nstest.Token, Limit: 100}
+}
+
+// measurement returns lines of the measurement, in order of writing
+func measurement(lines []string, name string) []string {
+	var result []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, name+",") || strings.HasPrefix(line, name+" ") {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func assertGolden(t *testing.T, name string, lines []string) {
+	t.Helper()
+	expected, err := os.ReadFile(filepath.Join(testdata, "golden", name+".lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := strings.Join(lines, "\n") + "\n"; actual != string(expected) {
+		t.Errorf("%s differs from golden:\n--- actual\n%s--- expected\n%s", name, actual, expected)
+	}
+}
+
+func TestPipelineFromNS(t *testing.T) {
+	for _, fixture := range nstest.Fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			memory := sink.NewMemory()
+			summary, err := New(Config{
+				Imports:        []Import{nsImport(t, fixture)},
+				Transform:      testOptions,
+				DedupTolerance: time.Minute,
+				Sink:           memory,
+			}).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertGolden(t, "devicestatus_"+fixture, measurement(memory.Lines(), "openaps"))
+			assertGolden(t, "treatments_"+fixture, measurement(memory.Lines(), "treatments"))
+			if summary.Written != len(memory.Lines()) || summary.Written != summary.DeviceStatuses+summary.Treatments {
+				t.Errorf("unexpected summary %+v for %d lines", summary, len(memory.Lines()))
+			}
+		})
+	}
+}
+
+func TestPipelineEntries(t *testing.T) {
+	var entry = nsImport(t, "aaps")
+	entry.Collections = []string{Entries}
+	entry.From = time.Date(2022, 6, 8, 10, 0, 0, 0, time.UTC)
+	memory := sink.NewMemory()
+	summary, err := New(Config{Imports: []Import{entry}, Transform: testOptions, Sink: memory}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reading of 09:55 is before from, entries are queried by their date
+	expected, err := os.ReadFile(filepath.Join(testdata, "golden", "entries_aaps.lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := memory.Lines(); summary.Entries != 2 || len(lines) != 2 || !strings.HasPrefix(string(expected), strings.Join(lines, "\n")+"\n") {
+		t.Errorf("unexpected entries %v, summary %+v", lines, summary)
+	}
+}
+
+func TestPipelineSyncDeletes(t *testing.T) {
+	memory := sink.NewMemory()
+	summary, err := New(Config{
+		Imports:     []Import{nsImport(t, "aaps")},
+		Transform:   transform.Options{IdMode: transform.IdTag},
+		SyncDeletes: true,
+		Sink:        memory,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deleted = map[string]string{}
+	for _, deletion := range memory.Deletions() {
+		deleted[deletion.Measurement] = deletion.Id
+	}
+	var expected = map[string]string{
+		"openaps":    "0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d",
+		"treatments": "c7d8e9f0-a1b2-4c3d-4e5f-607182930415",
+	}
+	if summary.Deleted != 2 || len(deleted) != 2 || deleted["openaps"] != expected["openaps"] || deleted["treatments"] != expected["treatments"] {
+		t.Errorf("unexpected deletions %+v, summary %+v", memory.Deletions(), summary)
+	}
+}
+
+func TestPipelineReportsFailedImports(t *testing.T) {
+	var failing = nsImport(t, "aaps")
+	failing.User = "failing"
+	failing.NsToken = "wrong"
+
+	memory := sink.NewMemory()
+	summary, err := New(Config{
+		Imports: []Import{failing, nsImport(t, "oref0")},
+		Sink:    memory,
+	}).Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), `user "failing"`) {
+		t.Errorf("expected error of the failing import, got %v", err)
+	}
+	if summary.Written == 0 {
+		t.Error("points of the working import were not written")
+	}
+}
+
+func TestPipelineImportOverrides(t *testing.T) {
+	global := sink.NewMemory()
+	study := sink.NewMemory()
+
+	var household = nsImport(t, "aaps")
+	household.User = "household"
+	household.Collections = []string{DeviceStatus}
+
+	var participant = nsImport(t, "aaps")
+	participant.User = "participant"
+	participant.From = time.Date(2022, 6, 8, 8, 0, 0, 0, time.UTC)
+	participant.Collections = []string{Treatments}
+	participant.Sink = study
+	participant.Transform = &transform.Options{IdMode: transform.IdTag, Tags: map[string]string{"study": "s1"}}
+
+	summary, err := New(Config{
+		Imports: []Import{household, participant},
+		Sink:    global,
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := global.Lines(); len(lines) != 2 || len(measurement(lines, "openaps")) != 2 {
+		t.Errorf("household wrote %v", lines)
+	}
+	lines := study.Lines()
+	if len(lines) != 5 || len(measurement(lines, "treatments")) != 5 {
+		t.Errorf("participant wrote %v", lines)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, ",study=s1,") || !strings.Contains(line, ",user=participant") {
+			t.Errorf("tags not applied: %s", line)
+		}
+	}
+	if summary.Written != 7 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	var once = nsImport(t, "loop")
+	var repeated = nsImport(t, "aaps")
+	repeated.Interval = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Millisecond)
+	defer cancel()
+
+	var runs = map[time.Duration]int{}
+	var mutex sync.Mutex
+	Schedule(ctx, Config{Imports: []Import{once, repeated}, Sink: sink.NewMemory()}, time.Second, func(interval time.Duration, summary Summary, err error) {
+		// a run still going when the schedule stops is cut off by it
+		if err != nil && ctx.Err() == nil {
+			t.Error(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		runs[interval]++
+	})
+
+	if runs[0] != 1 || runs[repeated.Interval] < 2 {
+		t.Errorf("unexpected runs %v", runs)
+	}
+}
+
+func TestPipelineRefreshesImports(t *testing.T) {
+	var stale = nsImport(t, "aaps")
+	stale.NsToken = "stale"
+	var refreshes = 0
+	stale.Refresh = func() (Import, error) {
+		refreshes++
+		var current = stale
+		current.NsToken = nstest.Token
+		return current, nil
+	}
+
+	memory := sink.NewMemory()
+	pipeline := New(Config{Imports: []Import{stale}, Sink: memory})
+	for run := 0; run < 2; run++ {
+		if _, err := pipeline.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if refreshes != 2 || len(memory.Lines()) == 0 {
+		t.Errorf("refreshed %d times, written %d points", refreshes, len(memory.Lines()))
+	}
+}
+
+// recorder is an Observer counting the records it is shown
+type recorder struct {
+	mutex                                         sync.Mutex
+	deviceStatuses, treatments, sgvs, evaluations int
+}
+
+func (r *recorder) DeviceStatus(model.NsEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deviceStatuses++
+}
+
+func (r *recorder) Treatment(model.NsTreatment) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.treatments++
+}
+
+func (r *recorder) Sgv(model.NsSgv) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sgvs++
+}
+
+func (r *recorder) Evaluate(context.Context) error {
+	r.evaluations++
+	return errors.New("webhook failed")
+}
+
+func TestPipelineObserver(t *testing.T) {
+	var entry = nsImport(t, "aaps")
+	entry.Collections = Collections
+	observer := &recorder{}
+	summary, err := New(Config{Imports: []Import{entry}, Sink: sink.NewMemory(), Observer: observer}).Run(context.Background())
+	if err == nil || err.Error() != "webhook failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if observer.deviceStatuses != summary.DeviceStatuses || observer.treatments != summary.Treatments || observer.sgvs != summary.Entries || observer.evaluations != 1 {
+		t.Errorf("unexpected observed records %+v, summary %+v", observer, summary)
+	}
+}
+
+func TestPipelineGaps(t *testing.T) {
+	var entry = nsImport(t, "aaps")
+	entry.Collections = Collections
+	memory := sink.NewMemory()
+	pipeline := New(Config{Imports: []Import{entry}, Sink: memory, GapThreshold: time.Hour})
+	summary, err := pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the uploads of the fixture stopped long ago
+	var gaps = measurement(memory.Lines(), "gaps")
+	if len(summary.Gaps) != 2 || len(gaps) != 2 || !summary.Gaps[0].Ongoing || summary.Gaps[0].Collection != DeviceStatus || summary.Gaps[1].Collection != Entries {
+		t.Fatalf("unexpected gaps %v, points %v", summary.Gaps, gaps)
+	}
+	if summary.Written != summary.DeviceStatuses+summary.Treatments+summary.Entries+2 {
+		t.Errorf("gap points not counted as written %+v", summary)
+	}
+
+	// the next run reports the same gaps, which are still ongoing
+	next, err := pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Gaps) != 2 || !next.Gaps[0].Start.Equal(summary.Gaps[0].Start) || !next.Gaps[1].End.After(summary.Gaps[1].End) {
+		t.Errorf("unexpected gaps of the next run %v", next.Gaps)
+	}
+}
@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Report receives the result of every scheduled run
+type Report func(interval time.Duration, summary Summary, err error)
+
+// Schedule runs the imports repeatedly, each at its interval, until ctx is done. Imports with equal interval
+// run together, so records they share are still deduplicated; imports without interval run once.
+// Each run is limited by timeout when it is positive.
+func Schedule(ctx context.Context, config Config, timeout time.Duration, report Report) {
+	var intervals []time.Duration
+	var groups = map[time.Duration][]Import{}
+	for _, entry := range config.Imports {
+		if _, ok := groups[entry.Interval]; !ok {
+			intervals = append(intervals, entry.Interval)
+		}
+		groups[entry.Interval] = append(groups[entry.Interval], entry)
+	}
+
+	var group sync.WaitGroup
+	for _, interval := range intervals {
+		var groupConfig = config
+		groupConfig.Imports = groups[interval]
+
+		group.Add(1)
+		go func(interval time.Duration, pipeline *Pipeline) {
+			defer group.Done()
+			runOnce(ctx, pipeline, interval, timeout, report)
+			if interval <= 0 {
+				return
+			}
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					runOnce(ctx, pipeline, interval, timeout, report)
+				}
+			}
+		}(interval, New(groupConfig))
+	}
+	group.Wait()
+}
+
+func runOnce(ctx context.Context, pipeline *Pipeline, interval time.Duration, timeout time.Duration, report Report) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	summary, err := pipeline.Run(ctx)
+	report(interval, summary, err)
+}
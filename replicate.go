@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"ns-exporter/config"
+	"ns-exporter/replicate"
+	"ns-exporter/source"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// replicaTarget is the Nightscout an import is replicated into
+type replicaTarget struct {
+	nsUri    string
+	nsToken  string
+	mongoUri string
+	mongoDb  string
+}
+
+func (s *settings) replicaTarget(entry config.Import) (replicaTarget, error) {
+	var target = replicaTarget{
+		nsUri:   combine(*s.replicateNsUri, entry.ReplicateNsUri),
+		mongoDb: combine(*s.replicateMongoDb, entry.ReplicateMongoDb),
+	}
+	var err error
+	if target.nsUri != "" {
+		if target.nsToken, err = s.secret("replicate-ns-token", *s.replicateNsToken, *s.replicateNsTokenFile, entry.ReplicateNsToken, entry.ReplicateNsTokenFile); err != nil {
+			return target, err
+		}
+	}
+	if target.mongoDb != "" {
+		if target.mongoUri, err = s.secret("replicate-mongo-uri", *s.replicateMongoUri, *s.replicateMongoUriFile, entry.ReplicateMongoUri, entry.ReplicateMongoUriFile); err != nil {
+			return target, err
+		}
+	}
+	return target, nil
+}
+
+// name identifies the target in the replication state, without credentials
+func (t replicaTarget) name() string {
+	if t.nsUri != "" && t.nsToken != "" {
+		return t.nsUri
+	}
+	var uri = t.mongoUri
+	if parsed, err := url.Parse(uri); err == nil {
+		parsed.User = nil
+		uri = parsed.String()
+	}
+	return uri + "#" + t.mongoDb
+}
+
+// configured reports whether the import is to be replicated
+func (t replicaTarget) configured() bool {
+	return (t.nsUri != "" && t.nsToken != "") || (t.mongoUri != "" && t.mongoDb != "")
+}
+
+// replicateImports copies the documents of every import with a replication target into it,
+// repeatedly every interval when it is set
+func replicateImports(ctx context.Context, s *settings, out io.Writer) error {
+	var collections = splitList(*s.replicateCollections)
+	for _, collection := range collections {
+		if !contains(replicate.Collections, collection) {
+			return fmt.Errorf("unknown collection %q, expected one of %v", collection, replicate.Collections)
+		}
+	}
+	state, err := replicate.LoadState(*s.replicateState)
+	if err != nil {
+		return fmt.Errorf("can't read replication state: %w", err)
+	}
+
+	run := func(ctx context.Context) error {
+		if *s.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *s.timeout)
+			defer cancel()
+		}
+		return s.replicateOnce(ctx, collections, state, out)
+	}
+	if *s.interval <= 0 {
+		return run(ctx)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(*s.interval)
+	defer ticker.Stop()
+	for {
+		if err := run(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *settings) replicateOnce(ctx context.Context, collections []string, state *replicate.State, out io.Writer) error {
+	var errs []string
+	var replicated = map[string]bool{}
+	for _, entry := range s.importEntries() {
+		target, err := s.replicaTarget(entry)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("user %q: %v", entry.User, err))
+			continue
+		}
+		if !target.configured() {
+			continue
+		}
+		// the global settings make an import of each source, the target is written from the first of them
+		var key = entry.User + "\n" + fmt.Sprint(target)
+		if replicated[key] {
+			continue
+		}
+		replicated[key] = true
+
+		summary, err := s.replicateImport(ctx, entry, target, collections, state)
+		fmt.Fprintf(out, "user %q: replicated %d documents, deleted %d\n", entry.User, summary.Copied, summary.Deleted)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("user %q: %v", entry.User, err))
+		}
+	}
+	if len(replicated) == 0 && len(errs) == 0 {
+		return errors.New("no import to replicate, set replicate-ns-uri with replicate-ns-token or replicate-mongo-uri with replicate-mongo-db")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *settings) replicateImport(ctx context.Context, entry config.Import, target replicaTarget, collections []string, state *replicate.State) (replicate.Summary, error) {
+	settings, err := s.newImport(entry)
+	if err != nil {
+		return replicate.Summary{}, err
+	}
+	from, kind, err := openReplica(ctx, settings.NsUri, settings.NsToken, settings.MongoUri, settings.MongoDb)
+	if err != nil {
+		return replicate.Summary{}, err
+	}
+	defer from.Close(ctx)
+	to, _, err := openReplica(ctx, target.nsUri, target.nsToken, target.mongoUri, target.mongoDb)
+	if err != nil {
+		return replicate.Summary{}, fmt.Errorf("replication target: %w", err)
+	}
+	defer to.Close(ctx)
+
+	var resync time.Duration
+	if kind == "mongo" {
+		resync = *s.replicateResync
+	}
+	return replicate.Run(ctx, replicate.Config{
+		// cursors differ between sources, so they are kept by each of them
+		Name:        entry.User + "@" + kind,
+		Source:      from,
+		Target:      to,
+		TargetName:  target.name(),
+		Collections: collections,
+		Limit:       settings.Limit,
+		State:       state,
+		Resync:      resync,
+	})
+}
+
+// openReplica connects the Nightscout API when it is set, otherwise its Mongo database
+func openReplica(ctx context.Context, nsUri string, nsToken string, mongoUri string, mongoDb string) (source.IReplica, string, error) {
+	if nsUri != "" && nsToken != "" {
+		client := source.NewNSClient(nsUri, nsToken, source.Options{})
+		return client, "ns", client.Authorize(ctx)
+	}
+	client, err := source.NewMongoClient(mongoUri, mongoDb, source.Options{}, ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't connect to mongo-db %s: %w", mongoDb, err)
+	}
+	return client, "mongo", nil
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
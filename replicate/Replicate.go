@@ -0,0 +1,100 @@
+// Package replicate copies the raw documents of one Nightscout instance into another.
+package replicate
+
+import (
+	"context"
+	"fmt"
+	"ns-exporter/source"
+	"time"
+)
+
+// Collections are the Nightscout collections which can be replicated
+var Collections = []string{"devicestatus", "treatments", "entries", "profile"}
+
+// defaultPage is the number of documents read at once when no limit is set, APIv3 allows 1000 by default
+const defaultPage = 500
+
+type Config struct {
+	// Name identifies the replication in the state, e.g. by the user
+	Name   string
+	Source source.IReplica
+	Target source.IReplica
+	// TargetName identifies the target in the state, e.g. by its url and database,
+	// so the replication into another target starts over instead of continuing where this one stopped
+	TargetName string
+	// Collections to replicate, all when empty
+	Collections []string
+	// Limit is the number of documents read at once
+	Limit int64
+	State *State
+	// Resync replicates the collections from their first document again when it has passed since the last time,
+	// for sources which don't report every change, zero never does
+	Resync time.Duration
+}
+
+// Summary counts the replicated documents
+type Summary struct {
+	Copied  int
+	Deleted int
+}
+
+// Run copies documents changed since the previous run into the target, replacing them there by identifier,
+// so documents are never duplicated. Soft-deleted documents are deleted in the target as well.
+// The cursor is only advanced past written documents, a failing run continues with the failed document.
+// A resync writes every document again, which changes nothing in the target but the ones changed since.
+func Run(ctx context.Context, config Config) (Summary, error) {
+	var summary Summary
+	var collections = config.Collections
+	if len(collections) == 0 {
+		collections = Collections
+	}
+	var limit = config.Limit
+	if limit <= 0 {
+		limit = defaultPage
+	}
+	for _, collection := range collections {
+		err := replicate(ctx, config, collection, limit, &summary)
+		if saveErr := config.State.Save(); saveErr != nil && err == nil {
+			err = fmt.Errorf("can't save replication state: %w", saveErr)
+		}
+		if err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+func replicate(ctx context.Context, config Config, collection string, limit int64, summary *Summary) error {
+	var key = config.Name + ">" + config.TargetName + "/" + collection
+	if config.State.Cursor(key) == "" || (config.Resync > 0 && time.Since(config.State.Started(key)) >= config.Resync) {
+		fmt.Println("replicating all ", collection, " of ", config.Name)
+		config.State.Restart(key, time.Now())
+	}
+	for {
+		documents, err := config.Source.LoadDocuments(collection, config.State.Cursor(key), limit, ctx)
+		if err != nil {
+			return err
+		}
+		for _, doc := range documents {
+			if doc.Deleted() {
+				if err := config.Target.Delete(collection, doc.Identifier, ctx); err != nil {
+					return err
+				}
+				summary.Deleted++
+			} else {
+				if err := config.Target.Replace(collection, doc, ctx); err != nil {
+					return err
+				}
+				summary.Copied++
+			}
+			config.State.SetCursor(key, doc.Cursor)
+		}
+		fmt.Println("replicated ", len(documents), " ", collection, " of ", config.Name)
+		if int64(len(documents)) < limit {
+			return nil
+		}
+		if err := config.State.Save(); err != nil {
+			return fmt.Errorf("can't save replication state: %w", err)
+		}
+	}
+}
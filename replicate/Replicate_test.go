@@ -0,0 +1,117 @@
+package replicate
+
+import (
+	"context"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/internal/nstest/nsclient"
+	"ns-exporter/source"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testdata = "../testdata"
+
+func identifiers(records []map[string]interface{}, valid bool) map[string]bool {
+	var result = map[string]bool{}
+	for _, record := range records {
+		if (record["isValid"] != false) == valid {
+			result[record["identifier"].(string)] = true
+		}
+	}
+	return result
+}
+
+func TestReplicate(t *testing.T) {
+	from := nstest.NewServer(t, testdata, "aaps")
+	to := nstest.NewEmptyServer(t)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Name: "john", Source: nsclient.Connect(t, from, source.Options{}), Target: nsclient.Connect(t, to, source.Options{}), Limit: 2, State: state}
+
+	summary, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied = 0
+	for _, collection := range Collections {
+		source, target := from.Records(collection), to.Records(collection)
+		copied += len(identifiers(source, true))
+		if len(source) == 0 {
+			t.Errorf("no %s fixture", collection)
+		}
+		// soft-deleted documents which were never replicated are not created in the target
+		if expected, actual := identifiers(source, true), identifiers(target, true); len(actual) != len(expected) || len(target) != len(expected) {
+			t.Errorf("%s replicated %v, expected %v", collection, actual, expected)
+		}
+		for _, record := range target {
+			if record["date"] == nil || record["app"] == nil {
+				t.Errorf("%s replicated without date or app: %v", collection, record)
+			}
+		}
+	}
+	if summary.Copied != copied || summary.Deleted != 2 {
+		t.Errorf("unexpected summary %+v, expected %d copied", summary, copied)
+	}
+
+	// the next run only sees what changed since
+	state, err = LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.State = state
+	if summary, err := Run(context.Background(), config); err != nil || summary != (Summary{}) {
+		t.Errorf("unexpected summary of unchanged source %+v, %v", summary, err)
+	}
+
+	var changed = from.Records("treatments")[0]
+	changed["notes"] = "changed"
+	if err := config.Source.Replace("treatments", source.Document{Identifier: changed["identifier"].(string), Data: changed}, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var deleted = from.Records("entries")[1]["identifier"].(string)
+	if err := config.Source.Delete("entries", deleted, context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = Run(context.Background(), config)
+	if err != nil || summary != (Summary{Copied: 1, Deleted: 1}) {
+		t.Errorf("unexpected summary of changed source %+v, %v", summary, err)
+	}
+	for _, record := range to.Records("treatments") {
+		if record["identifier"] == changed["identifier"] && record["notes"] != "changed" {
+			t.Errorf("change not replicated: %v", record)
+		}
+	}
+	if !identifiers(to.Records("entries"), false)[deleted] {
+		t.Errorf("deletion of %s not replicated", deleted)
+	}
+}
+
+func TestReplicateTargetsAndResync(t *testing.T) {
+	from := nstest.NewServer(t, testdata, "aaps")
+	state, err := LoadState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Name: "john", Source: nsclient.Connect(t, from, source.Options{}), Collections: []string{"treatments"}, Limit: 2, State: state}
+	var expected = len(identifiers(from.Records("treatments"), true))
+
+	// the state of one target doesn't skip the documents of another
+	for _, target := range []string{"first", "second"} {
+		config.Target, config.TargetName = nsclient.Connect(t, nstest.NewEmptyServer(t), source.Options{}), target
+		if summary, err := Run(context.Background(), config); err != nil || summary.Copied != expected {
+			t.Errorf("%s: unexpected summary %+v, %v", target, summary, err)
+		}
+	}
+
+	if summary, err := Run(context.Background(), config); err != nil || summary != (Summary{}) {
+		t.Errorf("unexpected summary of unchanged source %+v, %v", summary, err)
+	}
+	config.Resync = time.Nanosecond
+	if summary, err := Run(context.Background(), config); err != nil || summary.Copied != expected {
+		t.Errorf("unexpected summary of resync %+v, %v", summary, err)
+	}
+}
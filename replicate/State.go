@@ -0,0 +1,98 @@
+package replicate
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State keeps the cursors of replicated collections in a file, so runs continue where the previous one stopped
+type State struct {
+	path  string
+	mutex sync.Mutex
+	file  stateFile
+}
+
+type stateFile struct {
+	Cursors map[string]string `json:"cursors"`
+	// Started is when the collections were last replicated from their first document
+	Started map[string]time.Time `json:"started"`
+}
+
+// LoadState reads the state file, a missing file is an empty state. Without path the state is kept in memory.
+func LoadState(path string) (*State, error) {
+	var state = &State{path: path, file: stateFile{Cursors: map[string]string{}, Started: map[string]time.Time{}}}
+	if path == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state.file); err != nil {
+		return nil, err
+	}
+	// a state of older versions holds the cursors only, it starts over
+	if state.file.Cursors == nil || state.file.Started == nil {
+		state.file = stateFile{Cursors: map[string]string{}, Started: map[string]time.Time{}}
+	}
+	return state, nil
+}
+
+func (s *State) Cursor(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Cursors[key]
+}
+
+func (s *State) SetCursor(key string, cursor string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.file.Cursors[key] = cursor
+}
+
+func (s *State) Started(key string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Started[key]
+}
+
+// Restart replicates the collection from its first document again
+func (s *State) Restart(key string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.file.Cursors, key)
+	s.file.Started[key] = at
+}
+
+// Save writes the cursors to the file, replacing it so it is never left half written
+func (s *State) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), s.path)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"ns-exporter/config"
+	"ns-exporter/restore"
+	"ns-exporter/source"
+)
+
+// restoreUser writes the points of the user from InfluxDb back into the Nightscout of its import
+func restoreUser(ctx context.Context, s *settings, out io.Writer) error {
+	var entry *config.Import
+	for _, candidate := range s.importEntries() {
+		candidate := candidate
+		if candidate.User != *s.user {
+			continue
+		}
+		if entry != nil {
+			return fmt.Errorf("user %q has several imports, restore needs exactly one to write to", *s.user)
+		}
+		entry = &candidate
+	}
+	if entry == nil {
+		return fmt.Errorf("no import of user %q to restore into", *s.user)
+	}
+
+	settings, err := s.newImport(*entry)
+	if err != nil {
+		return err
+	}
+	if settings.Transform.Anonymizer != nil {
+		return errors.New("anonymized points can't be restored")
+	}
+	target, err := s.influxTarget(*entry)
+	if err != nil {
+		return err
+	}
+	if target.version != 2 {
+		// points are read with Flux, which only InfluxDB 2 serves
+		return fmt.Errorf("restore reads from InfluxDB 2 only, not from 'influx-version' %d", target.version)
+	}
+	if *s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *s.timeout)
+		defer cancel()
+	}
+
+	var opts = source.Options{User: settings.User, Location: settings.Location}
+	var client source.IImporter
+	if settings.NsUri != "" && settings.NsToken != "" {
+		client = source.NewNSClient(settings.NsUri, settings.NsToken, opts)
+		if err := client.Authorize(ctx); err != nil {
+			return err
+		}
+	} else if client, err = source.NewMongoClient(settings.MongoUri, settings.MongoDb, opts, ctx); err != nil {
+		return fmt.Errorf("can't connect to mongo-db %s: %w", settings.MongoDb, err)
+	}
+	defer client.Close(ctx)
+
+	influx := restore.NewInflux(target.uri, target.token, target.org, target.bucket)
+	defer influx.Close()
+
+	summary, err := restore.Run(ctx, restore.Config{
+		User:        settings.User,
+		From:        settings.From,
+		To:          settings.To,
+		Collections: settings.Collections,
+		Options:     *settings.Transform,
+		Source:      influx,
+		Target:      client,
+		DryRun:      *s.dryRun,
+		Out:         out,
+	})
+	var action = "restored"
+	if *s.dryRun {
+		action = "to restore"
+	}
+	fmt.Fprintf(out, "read %d points, %s %d documents, %d conflicts, %d failed\n", summary.Read, action, summary.Restored, summary.Conflicts, summary.Failed)
+	if err == nil && summary.Failed > 0 {
+		err = fmt.Errorf("%d documents failed to restore", summary.Failed)
+	}
+	return err
+}
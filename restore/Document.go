@@ -0,0 +1,166 @@
+package restore
+
+import (
+	"ns-exporter/transform"
+	"strconv"
+	"time"
+)
+
+// Record is a point read back from the sink
+type Record struct {
+	Measurement string
+	Time        time.Time
+	Tags        map[string]string
+	Fields      map[string]interface{}
+}
+
+// Id returns the source record id, written as tag or field depending on the id mode
+func (r Record) Id() string {
+	if id, ok := r.Tags["id"]; ok {
+		return id
+	}
+	id, _ := r.Fields["id"].(string)
+	return id
+}
+
+// App is set on documents created by the restore, APIv3 requires it
+const App = "ns-exporter"
+
+// createdAtLayout is how Nightscout uploaders write created_at
+const createdAtLayout = "2006-01-02T15:04:05.000Z"
+
+// devicestatusDevice is used when the device tag wasn't written, sources only read devicestatus of openaps devices
+const devicestatusDevice = "openaps://" + App
+
+// suggestedFields map openaps fields to the ones of openaps.suggested
+var suggestedFields = map[string]string{
+	"bg":           "bg",
+	"tick":         "tick",
+	"eventual_bg":  "eventualBG",
+	"target_bg":    "targetBG",
+	"insulin_req":  "insulinReq",
+	"cob":          "COB",
+	"bolus":        "units",
+	"tbs_rate":     "rate",
+	"tbs_duration": "duration",
+	"sens":         "sensitivityRatio",
+	"reason":       "reason",
+}
+
+// DeviceStatus rebuilds the devicestatus document of an openaps point.
+// Only the values written to the point are restored, e.g. predictions keep just their last value and are left out.
+func DeviceStatus(record Record) map[string]interface{} {
+	var at = record.Time.UTC().Format(createdAtLayout)
+	var doc = base(record)
+	doc["device"] = devicestatusDevice
+	if device := record.Tags["device"]; device != "" {
+		doc["device"] = device
+	}
+
+	var iob = map[string]interface{}{"time": at}
+	for field, name := range map[string]string{"iob": "iob", "basal_iob": "basaliob", "activity": "activity"} {
+		if value, ok := record.Fields[field]; ok {
+			iob[name] = value
+		}
+	}
+	var openaps = map[string]interface{}{"iob": iob}
+	if _, ok := record.Fields["bg"]; ok {
+		var suggested = map[string]interface{}{"timestamp": at}
+		for field, name := range suggestedFields {
+			if value, ok := record.Fields[field]; ok {
+				suggested[name] = value
+			}
+		}
+		openaps["suggested"] = suggested
+	}
+	doc["openaps"] = openaps
+	return doc
+}
+
+// treatmentFields map treatments fields to the ones of the document, other fields were whitelisted by their document name
+var treatmentFields = map[string]string{
+	"carbs":         "carbs",
+	"bolus":         "insulin",
+	"duration":      "duration",
+	"percent":       "percent",
+	"rate":          "rate",
+	"target_top":    "targetTop",
+	"target_bottom": "targetBottom",
+	"units":         "units",
+	"reason":        "reason",
+	"notes":         "notes",
+}
+
+// Treatment rebuilds the treatment document of a treatments point, its event type is derived from the written values.
+// Tags of options are left out, as they were not part of the source document.
+func Treatment(record Record, options transform.Options) map[string]interface{} {
+	var doc = base(record)
+	doc["enteredBy"] = App
+	if enteredBy := record.Tags["enteredBy"]; enteredBy != "" {
+		doc["enteredBy"] = enteredBy
+	}
+	for field, value := range record.Fields {
+		if name, ok := treatmentFields[field]; ok {
+			doc[name] = value
+		} else if field != "id" {
+			doc[field] = value
+		}
+	}
+	for tag, value := range record.Tags {
+		if _, ok := options.Tags[tag]; !ok && !reserved(tag) {
+			doc[tag] = value
+		}
+	}
+
+	var notes, _ = doc["notes"].(string)
+	switch {
+	case record.Tags["type"] == "tbs":
+		doc["eventType"] = "Temp Basal"
+	case record.Tags["type"] == "tt":
+		doc["eventType"] = "Temporary Target"
+	case doc["insulin"] != nil && doc["carbs"] != nil:
+		doc["eventType"] = "Meal Bolus"
+	case doc["insulin"] != nil:
+		doc["eventType"] = "Correction Bolus"
+		if smb, _ := strconv.ParseBool(record.Tags["smb"]); smb {
+			doc["isSMB"] = true
+			doc["type"] = "SMB"
+		}
+	case doc["carbs"] != nil:
+		doc["eventType"] = "Carb Correction"
+	case transform.NotedEvents[notes]:
+		// event types without values are written as their notes
+		doc["eventType"] = notes
+		delete(doc, "notes")
+	default:
+		doc["eventType"] = "Note"
+	}
+	return doc
+}
+
+// EventType returns the event type of a treatment document
+func EventType(doc map[string]interface{}) string {
+	eventType, _ := doc["eventType"].(string)
+	return eventType
+}
+
+func base(record Record) map[string]interface{} {
+	var doc = map[string]interface{}{
+		"created_at": record.Time.UTC().Format(createdAtLayout),
+		"date":       record.Time.UnixMilli(),
+		"app":        App,
+	}
+	if id := record.Id(); id != "" {
+		doc["identifier"] = id
+	}
+	return doc
+}
+
+func reserved(tag string) bool {
+	for _, name := range transform.ReservedTags {
+		if name == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"strconv"
+	"time"
+)
+
+// Reader reads the points of a user back from the sink
+type Reader interface {
+	Read(ctx context.Context, measurement string, user string, from time.Time, to time.Time, records chan<- Record) error
+}
+
+// Influx reads points from an InfluxDb 2 bucket with Flux
+type Influx struct {
+	client influxdb2.Client
+	org    string
+	bucket string
+}
+
+func NewInflux(uri string, token string, org string, bucket string) *Influx {
+	return &Influx{client: influxdb2.NewClient(uri, token), org: org, bucket: bucket}
+}
+
+// Read sends the points of the measurement and user within [from, to) to records, zero times leave the range open
+func (r *Influx) Read(ctx context.Context, measurement string, user string, from time.Time, to time.Time, records chan<- Record) error {
+	result, err := r.client.QueryAPI(r.org).Query(ctx, query(r.bucket, measurement, user, from, to))
+	if err != nil {
+		return fmt.Errorf("can't query InfluxDb bucket %s: %w", r.bucket, err)
+	}
+	defer result.Close()
+	for result.Next() {
+		// after the pivot tags are still in the group key, while fields are not
+		var record = Record{Measurement: measurement, Time: result.Record().Time(), Tags: map[string]string{}, Fields: map[string]interface{}{}}
+		for _, column := range result.TableMetadata().Columns() {
+			var name = column.Name()
+			var value = result.Record().ValueByKey(name)
+			switch {
+			case value == nil || name == "result" || name == "table" || name[0] == '_':
+			case column.IsGroup():
+				record.Tags[name] = fmt.Sprint(value)
+			default:
+				record.Fields[name] = value
+			}
+		}
+		records <- record
+	}
+	if result.Err() != nil {
+		return fmt.Errorf("can't read InfluxDb bucket %s: %w", r.bucket, result.Err())
+	}
+	return nil
+}
+
+func (r *Influx) Close() {
+	r.client.Close()
+}
+
+func query(bucket string, measurement string, user string, from time.Time, to time.Time) string {
+	var start, stop = "1970-01-01T00:00:00Z", "now()"
+	if !from.IsZero() {
+		start = from.UTC().Format(time.RFC3339Nano)
+	}
+	if !to.IsZero() {
+		stop = to.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r.user == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		strconv.Quote(bucket), start, stop, strconv.Quote(measurement), strconv.Quote(user))
+}
@@ -0,0 +1,164 @@
+// Package restore rebuilds Nightscout documents from the points written by the exporter and inserts them back.
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"ns-exporter/pipeline"
+	"ns-exporter/source"
+	"ns-exporter/transform"
+	"time"
+)
+
+// measurements are the ones written for each collection
+var measurements = map[string]string{pipeline.DeviceStatus: "openaps", pipeline.Treatments: "treatments"}
+
+type Config struct {
+	// User is the value of the user tag of the points
+	User string
+	From time.Time
+	To   time.Time
+	// Collections to restore, all when empty
+	Collections []string
+	// Options are the transform options the points were written with
+	Options transform.Options
+	Source  Reader
+	Target  source.IImporter
+	// DryRun only reports the documents which would be inserted to Out
+	DryRun bool
+	Out    io.Writer
+}
+
+// Summary counts the documents of a restore
+type Summary struct {
+	Read     int
+	Restored int
+	// Conflicts are documents skipped as the target already has them, or another one at the same time
+	Conflicts int
+	Failed    int
+}
+
+// Run restores the collections of the user. Documents are never overwritten: those conflicting with the target
+// are skipped and reported, so a restore can be repeated or resumed.
+func Run(ctx context.Context, config Config) (Summary, error) {
+	var summary Summary
+	for _, collection := range pipeline.Collections {
+		if _, ok := measurements[collection]; !ok {
+			// only devicestatus and treatments are rebuilt from their points
+			continue
+		}
+		if len(config.Collections) > 0 && !contains(config.Collections, collection) {
+			continue
+		}
+		if err := restoreCollection(ctx, config, collection, &summary); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+func restoreCollection(ctx context.Context, config Config, collection string, summary *Summary) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	records := make(chan Record)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- config.Source.Read(ctx, measurements[collection], config.User, config.From, config.To, records)
+		close(records)
+	}()
+
+	for record := range records {
+		summary.Read++
+		var doc map[string]interface{}
+		if collection == pipeline.DeviceStatus {
+			doc = DeviceStatus(record)
+		} else {
+			doc = Treatment(record, config.Options)
+		}
+
+		existing, err := config.Target.Find(collection, record.Id(), record.Time, ctx)
+		if err != nil {
+			cancel()
+			for range records {
+			}
+			return err
+		}
+		if conflict := conflicting(collection, doc, existing); conflict != nil {
+			summary.Conflicts++
+			report(config.Out, "conflict", collection, doc, conflict)
+			continue
+		}
+		if config.DryRun {
+			summary.Restored++
+			report(config.Out, "restore", collection, doc, nil)
+			continue
+		}
+		if err := config.Target.Insert(collection, doc, ctx); err != nil {
+			fmt.Println("error restoring ", collection, ": ", doc["created_at"], ", error: ", err)
+			summary.Failed++
+			continue
+		}
+		summary.Restored++
+	}
+	return <-errs
+}
+
+// conflicting returns the existing document matching the restored one: with the same identifier,
+// or created at the same time - openaps devicestatus, treatments of the same event type
+func conflicting(collection string, doc map[string]interface{}, existing []map[string]interface{}) map[string]interface{} {
+	for _, other := range existing {
+		switch {
+		case doc["identifier"] != nil && (other["identifier"] == doc["identifier"] || documentId(other["_id"]) == doc["identifier"]):
+			return other
+		case collection == pipeline.DeviceStatus && other["openaps"] != nil && sameTime(doc, other):
+			return other
+		case collection == pipeline.Treatments && sameTime(doc, other) && EventType(other) == EventType(doc):
+			return other
+		}
+	}
+	return nil
+}
+
+// documentId returns the _id as identifiers of legacy documents are written, Mongo decodes it as an ObjectID
+func documentId(id interface{}) interface{} {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return id
+}
+
+// sameTime compares created_at to the second, as uploaders write it with or without milliseconds
+func sameTime(doc map[string]interface{}, other map[string]interface{}) bool {
+	at, _ := doc["created_at"].(string)
+	otherAt, _ := other["created_at"].(string)
+	return len(at) >= 19 && len(otherAt) >= 19 && at[:19] == otherAt[:19]
+}
+
+// report prints the document as a JSON line, with the conflicting one
+func report(out io.Writer, action string, collection string, doc map[string]interface{}, conflict map[string]interface{}) {
+	if out == nil {
+		return
+	}
+	var line = map[string]interface{}{"action": action, "collection": collection, "document": doc}
+	if conflict != nil {
+		line["existing"] = conflict
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		fmt.Fprintln(out, action, collection, doc)
+		return
+	}
+	fmt.Fprintln(out, string(data))
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
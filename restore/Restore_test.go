@@ -0,0 +1,248 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/internal/nstest/nsclient"
+	"ns-exporter/model"
+	"ns-exporter/pipeline"
+	"ns-exporter/source"
+	"ns-exporter/transform"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testdata = "../testdata"
+
+// sourceOptions read the records of the fixtures as the test user
+var sourceOptions = source.Options{User: "test"}
+
+var testOptions = transform.Options{
+	ExtraFields: []string{"glucose", "profile", "percentage", "absorptionTime"},
+	IdMode:      transform.IdTag,
+	SourceTags:  true,
+	Tags:        map[string]string{"cohort": "a"},
+}
+
+// memoryReader serves records as they were written
+type memoryReader []Record
+
+func (m memoryReader) Read(_ context.Context, measurement string, user string, from time.Time, to time.Time, records chan<- Record) error {
+	for _, record := range m {
+		if record.Measurement == measurement && record.Tags["user"] == user && !record.Time.Before(from) && (to.IsZero() || record.Time.Before(to)) {
+			records <- record
+		}
+	}
+	return nil
+}
+
+func toRecord(point write.Point) Record {
+	var record = Record{Measurement: point.Name(), Time: point.Time(), Tags: map[string]string{}, Fields: map[string]interface{}{}}
+	for _, tag := range point.TagList() {
+		record.Tags[tag.Key] = tag.Value
+	}
+	for _, field := range point.FieldList() {
+		record.Fields[field.Key] = field.Value
+	}
+	return record
+}
+
+// export transforms the treatments the way the pipeline does and returns the points
+func export(entries []model.NsTreatment) []write.Point {
+	queue := make(chan model.NsTreatment)
+	points := make(chan write.Point)
+	go func() {
+		for _, entry := range entries {
+			queue <- entry
+		}
+		close(queue)
+	}()
+	go func() {
+		transform.Treatments(points, nil, transform.NewDeduplicator(time.Minute), queue, testOptions)
+		close(points)
+	}()
+	var result []write.Point
+	for point := range points {
+		result = append(result, point)
+	}
+	return result
+}
+
+func lines(points []write.Point) []string {
+	var result []string
+	for _, point := range points {
+		result = append(result, strings.TrimSpace(write.PointToLineProtocol(&point, time.Millisecond)))
+	}
+	return result
+}
+
+func loadTreatments(t *testing.T, client source.IExporter) []model.NsTreatment {
+	t.Helper()
+	queue := make(chan model.NsTreatment)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.LoadTreatments(queue, 100, 0, context.Background())
+		close(queue)
+	}()
+	var entries []model.NsTreatment
+	for entry := range queue {
+		entries = append(entries, entry)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// emptyServer is a fake Nightscout without any records
+// TestRestoreTreatments exports the fixtures, restores them into an empty Nightscout
+// and exports them again, which must yield the same points
+func TestRestoreTreatments(t *testing.T) {
+	for _, fixture := range nstest.Fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			original := loadTreatments(t, nsclient.Connect(t, nstest.NewServer(t, testdata, fixture), sourceOptions))
+			points := export(original)
+			var records memoryReader
+			for _, point := range points {
+				records = append(records, toRecord(point))
+			}
+
+			server := nstest.NewEmptyServer(t)
+			config := Config{User: "test", Collections: []string{pipeline.Treatments}, Options: testOptions, Source: records, Target: nsclient.Connect(t, server, sourceOptions)}
+			summary, err := Run(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if summary != (Summary{Read: len(points), Restored: len(points)}) {
+				t.Errorf("unexpected summary %+v", summary)
+			}
+			if restored := lines(export(loadTreatments(t, nsclient.Connect(t, server, sourceOptions)))); !reflect.DeepEqual(restored, lines(points)) {
+				t.Errorf("restored treatments differ:\n%s\nexpected\n%s", strings.Join(restored, "\n"), strings.Join(lines(points), "\n"))
+			}
+
+			// restored documents conflict with themselves, so a restore can be repeated
+			summary, err = Run(context.Background(), config)
+			if err != nil || summary != (Summary{Read: len(points), Conflicts: len(points)}) {
+				t.Errorf("unexpected summary of repeated restore %+v, %v", summary, err)
+			}
+		})
+	}
+}
+
+func TestRestoreConflictsAndDryRun(t *testing.T) {
+	var at = time.Date(2022, 6, 8, 10, 4, 59, 0, time.UTC)
+	var records = memoryReader{
+		// same time and event type as a record of the fixture, without id
+		{Measurement: "treatments", Time: at.Add(300 * time.Millisecond), Tags: map[string]string{"user": "test", "type": "bolus", "smb": "false"}, Fields: map[string]interface{}{"bolus": 0.3}},
+		// same time, other event type
+		{Measurement: "treatments", Time: at, Tags: map[string]string{"user": "test", "type": "carbs"}, Fields: map[string]interface{}{"carbs": int64(10)}},
+		{Measurement: "openaps", Time: at, Tags: map[string]string{"user": "test", "device": "openaps://rig"}, Fields: map[string]interface{}{"iob": 1.2, "bg": 120.0, "reason": "COB: 0"}},
+		{Measurement: "openaps", Time: at, Tags: map[string]string{"user": "other"}, Fields: map[string]interface{}{"iob": 1.0}},
+	}
+	server := nstest.NewServer(t, testdata, "oref0")
+	var out bytes.Buffer
+	summary, err := Run(context.Background(), Config{User: "test", Options: testOptions, Source: records, Target: nsclient.Connect(t, server, sourceOptions), DryRun: true, Out: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != (Summary{Read: 3, Restored: 2, Conflicts: 1}) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(server.Records(pipeline.Treatments)) != 5 || len(server.Records(pipeline.DeviceStatus)) != len(nstest.LoadRecords(t, filepath.Join(testdata, "devicestatus", "oref0.json"))) {
+		t.Error("dry run inserted documents")
+	}
+	var report = out.String()
+	for _, expected := range []string{`"action":"conflict"`, `"existing":{`, `"eventType":"Carb Correction"`, `"device":"openaps://rig"`, `"reason":"COB: 0"`} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("report misses %s:\n%s", expected, report)
+		}
+	}
+}
+
+// mongoTarget holds a document as Mongo returns it, with an ObjectID _id and no identifier
+type mongoTarget struct {
+	source.IImporter
+	existing map[string]interface{}
+	inserted int
+}
+
+func (m *mongoTarget) Find(_ string, _ string, _ time.Time, _ context.Context) ([]map[string]interface{}, error) {
+	return []map[string]interface{}{m.existing}, nil
+}
+
+func (m *mongoTarget) Insert(_ string, _ map[string]interface{}, _ context.Context) error {
+	m.inserted++
+	return nil
+}
+
+func TestRestoreConflictsWithMongoId(t *testing.T) {
+	id, err := primitive.ObjectIDFromHex("62a05ea2c6e1c2a5b1f3e6d1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var at = time.Date(2022, 6, 8, 10, 4, 59, 0, time.UTC)
+	var records = memoryReader{
+		{Measurement: "treatments", Time: at, Tags: map[string]string{"user": "test", "type": "carbs", "id": id.Hex()}, Fields: map[string]interface{}{"carbs": int64(10)}},
+	}
+	// the existing document was created at another time, only its _id matches
+	target := &mongoTarget{existing: map[string]interface{}{"_id": id, "eventType": "Note", "created_at": "2022-06-08T09:00:00.000Z"}}
+	summary, err := Run(context.Background(), Config{User: "test", Collections: []string{pipeline.Treatments}, Options: testOptions, Source: records, Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != (Summary{Read: 1, Conflicts: 1}) || target.inserted != 0 {
+		t.Errorf("unexpected summary %+v, %d inserted", summary, target.inserted)
+	}
+}
+
+func TestInfluxRead(t *testing.T) {
+	const result = "#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,string,string,double,long,string\n" +
+		"#group,false,false,true,true,false,true,true,true,true,false,false,false\n" +
+		"#default,_result,,,,,,,,,,,\n" +
+		",result,table,_start,_stop,_time,_measurement,id,type,user,bolus,carbs,notes\n" +
+		",,0,2022-06-01T00:00:00Z,2022-07-01T00:00:00Z,2022-06-08T09:30:00Z,treatments,62a0700d,bolus,john,2.5,25,pasta\n" +
+		",,1,2022-06-01T00:00:00Z,2022-07-01T00:00:00Z,2022-06-08T09:45:00Z,treatments,62a0700e,carbs,john,,10,\n"
+	var query string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		_, _ = body.ReadFrom(r.Body)
+		query = body.String()
+		w.Header().Set("Content-Type", "text/csv")
+		_, _ = w.Write([]byte(result))
+	}))
+	defer influx.Close()
+
+	reader := NewInflux(influx.URL, "token", "ns", "ns-john")
+	defer reader.Close()
+	records := make(chan Record, 10)
+	if err := reader.Read(context.Background(), "treatments", "john", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC), time.Time{}, records); err != nil {
+		t.Fatal(err)
+	}
+	close(records)
+	for _, expected := range []string{`from(bucket: \"ns-john\")`, `range(start: 2022-06-01T00:00:00Z, stop: now())`, `r.user == \"john\"`} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("query misses %s: %s", expected, query)
+		}
+	}
+
+	var read []Record
+	for record := range records {
+		read = append(read, record)
+	}
+	var expected = []Record{
+		{Measurement: "treatments", Time: time.Date(2022, 6, 8, 9, 30, 0, 0, time.UTC), Tags: map[string]string{"id": "62a0700d", "type": "bolus", "user": "john"}, Fields: map[string]interface{}{"bolus": 2.5, "carbs": int64(25), "notes": "pasta"}},
+		{Measurement: "treatments", Time: time.Date(2022, 6, 8, 9, 45, 0, 0, time.UTC), Tags: map[string]string{"id": "62a0700e", "type": "carbs", "user": "john"}, Fields: map[string]interface{}{"carbs": int64(10)}},
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("read %+v, expected %+v", read, expected)
+	}
+}
@@ -0,0 +1,180 @@
+// Package schema describes the measurements, tags and fields the exporter writes, and where their values come from.
+// The transforms add the fields through it, so it can't drift from the written points.
+package schema
+
+// Type is the type of the values of a field
+type Type string
+
+const (
+	Float   Type = "float"
+	Integer Type = "integer"
+	String  Type = "string"
+	Boolean Type = "boolean"
+)
+
+// Numeric reports whether values of the type can be charted
+func (t Type) Numeric() bool {
+	return t == Float || t == Integer
+}
+
+// Value converts numbers into the type, so integer fields don't turn into floats or the other way round
+func (t Type) Value(value interface{}) interface{} {
+	switch t {
+	case Float:
+		switch v := value.(type) {
+		case float32:
+			return float64(v)
+		case int:
+			return float64(v)
+		case int64:
+			return float64(v)
+		}
+	case Integer:
+		switch v := value.(type) {
+		case int:
+			return int64(v)
+		case float64:
+			return int64(v)
+		}
+	}
+	return value
+}
+
+type Field struct {
+	Name string `json:"name"`
+	Type Type   `json:"type"`
+	// Unit of the values, empty for text and ratios
+	Unit string `json:"unit,omitempty"`
+	// Source is the path of the record field the value is taken from, alternatives separated by |
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Source      string `json:"source"`
+	Description string `json:"description"`
+}
+
+type Measurement struct {
+	Name string `json:"name"`
+	// Collection is the Nightscout collection the points are made of
+	Collection  string `json:"collection,omitempty"`
+	Description string `json:"description"`
+	// Events are written at irregular times, e.g. treatments, rather than as a series of regular readings
+	Events bool    `json:"events"`
+	Tags   []Tag   `json:"tags"`
+	Fields []Field `json:"fields"`
+}
+
+// Field returns the field of the measurement
+func (m Measurement) Field(name string) (Field, bool) {
+	for _, field := range m.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+var (
+	userTag      = Tag{"user", "user", "user of the import, pseudonymized with anonymize"}
+	idTag        = Tag{"id", "identifier|_id", "record identifier, with id-mode tag; a field with id-mode field"}
+	localHourTag = Tag{"local_hour", "created_at|date", "hour in the user time zone, with local-time-tags"}
+	weekdayTag   = Tag{"weekday", "created_at|date", "weekday in the user time zone, with local-time-tags"}
+	// reasonSource holds the values oref0 and AndroidAPS only report in the text of the reason
+	reasonSource = "openaps.suggested.reason"
+)
+
+var OpenAps = Measurement{
+	Name:        "openaps",
+	Collection:  "devicestatus",
+	Description: "Loop state of AndroidAPS, oref0 and Loop uploads",
+	Tags:        []Tag{userTag, idTag, {"device", "device", "uploading device, with source-tags"}, localHourTag, weekdayTag},
+	Fields: []Field{
+		{"iob", Float, "U", "openaps.iob.iob", "insulin on board"},
+		{"basal_iob", Float, "U", "openaps.iob.basaliob", "basal insulin on board"},
+		{"activity", Float, "", "openaps.iob.activity", "insulin activity"},
+		{"bg", Float, "mg/dL", "openaps.suggested.bg", "BG the loop decided on"},
+		{"tick", Float, "mg/dL", "openaps.suggested.tick", "BG change since the previous reading"},
+		{"eventual_bg", Float, "mg/dL", "openaps.suggested.eventualBG", "predicted eventual BG"},
+		{"target_bg", Float, "mg/dL", "openaps.suggested.targetBG", "BG target"},
+		{"insulin_req", Float, "U", "openaps.suggested.insulinReq", "insulin required"},
+		{"cob", Float, "g", "openaps.suggested.COB", "carbs on board"},
+		{"bolus", Float, "U", "openaps.suggested.units", "suggested bolus"},
+		{"tbs_rate", Float, "U/h", "openaps.suggested.rate", "suggested temporary basal rate"},
+		{"tbs_duration", Integer, "min", "openaps.suggested.duration", "suggested temporary basal duration"},
+		{"sens", Float, "", "openaps.suggested.sensitivityRatio", "sensitivity ratio"},
+		{"pred_cob", Float, "mg/dL", "openaps.suggested.predBGs.COB", "last BG predicted with carbs on board"},
+		{"pred_iob", Float, "mg/dL", "openaps.suggested.predBGs.IOB", "last BG predicted with insulin on board"},
+		{"pred_uam", Float, "mg/dL", "openaps.suggested.predBGs.UAM", "last BG predicted with unannounced meals"},
+		{"pred_zt", Float, "mg/dL", "openaps.suggested.predBGs.ZT", "last BG predicted with zero temp"},
+		{"dev", Float, "mg/dL", reasonSource, "deviation, 'Dev:' of the reason"},
+		{"isf", Float, "mg/dL/U", reasonSource, "insulin sensitivity factor, 'ISF:' of the reason"},
+		{"isf_nt", Float, "mg/dL/U", reasonSource, "ISF without autosens, of the reason"},
+		{"isf_bg", Float, "mg/dL/U", reasonSource, "ISF at the current BG, of the reason"},
+		{"cr", Float, "g/U", reasonSource, "carb ratio, 'CR:' of the reason"},
+		{"reason", String, "", reasonSource, "reason of the loop decision"},
+	},
+}
+
+var Treatments = Measurement{
+	Name:        "treatments",
+	Collection:  "treatments",
+	Description: "Boluses, carbs, temporary basals and targets, and noted events",
+	Events:      true,
+	Tags: []Tag{userTag, idTag, {"type", "carbs|insulin|eventType", "carbs, bolus, tbs or tt"},
+		{"smb", "isSMB", "whether a bolus is a super micro bolus"},
+		{"enteredBy", "enteredBy", "entering app or user, with source-tags"}, localHourTag, weekdayTag},
+	Fields: []Field{
+		{"carbs", Integer, "g", "carbs", "carbs"},
+		{"bolus", Float, "U", "insulin", "bolus insulin"},
+		{"duration", Integer, "min", "duration", "duration of a temporary basal or target"},
+		{"percent", Integer, "%", "percent", "temporary basal percent"},
+		{"rate", Float, "U/h", "rate", "temporary basal rate"},
+		{"target_top", Float, "", "targetTop", "top of a temporary target, in its units"},
+		{"target_bottom", Float, "", "targetBottom", "bottom of a temporary target, in its units"},
+		{"units", String, "", "units", "units of a temporary target"},
+		{"reason", String, "", "reason", "reason of a temporary target"},
+		{"notes", String, "", "notes|eventType", "notes, or the event type of noted events"},
+	},
+}
+
+var Entries = Measurement{
+	Name:        "entries",
+	Collection:  "entries",
+	Description: "CGM readings and meter values",
+	Tags: []Tag{userTag, idTag, {"type", "sgv|mbg", "sgv or mbg"},
+		{"device", "device", "uploading device, with source-tags"}, localHourTag, weekdayTag},
+	Fields: []Field{
+		{"sgv", Integer, "mg/dL", "sgv", "sensor glucose"},
+		{"direction", String, "", "direction", "trend arrow"},
+		{"noise", Integer, "", "noise", "sensor noise level"},
+		{"mbg", Integer, "mg/dL", "mbg", "meter glucose"},
+	},
+}
+
+var Gaps = Measurement{
+	Name:        "gaps",
+	Description: "Times without devicestatus or CGM entries, with gap-threshold",
+	Events:      true,
+	Tags:        []Tag{userTag, {"type", "collection", "collection of the gap: devicestatus or entries"}},
+	Fields: []Field{
+		{"end", String, "", "created_at|date", "end of the gap, RFC3339"},
+		{"duration", Float, "min", "created_at|date", "duration of the gap"},
+		{"ongoing", Boolean, "", "created_at|date", "whether no record after the gap was read yet"},
+	},
+}
+
+// Measurements are written by the exporter, besides them points carry the configured tags and treatment fields
+var Measurements = []Measurement{OpenAps, Treatments, Entries, Gaps}
+
+// Lookup returns the measurement of the name
+func Lookup(name string) (Measurement, bool) {
+	for _, measurement := range Measurements {
+		if measurement.Name == name {
+			return measurement, true
+		}
+	}
+	return Measurement{}, false
+}
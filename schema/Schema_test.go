@@ -0,0 +1,46 @@
+package schema
+
+import "testing"
+
+func TestNamesAreUnique(t *testing.T) {
+	var measurements = map[string]bool{}
+	for _, measurement := range Measurements {
+		if measurements[measurement.Name] {
+			t.Errorf("measurement %s twice", measurement.Name)
+		}
+		measurements[measurement.Name] = true
+		var names = map[string]bool{}
+		for _, tag := range measurement.Tags {
+			names[tag.Name] = true
+		}
+		for _, field := range measurement.Fields {
+			if names[field.Name] {
+				t.Errorf("%s %s is both a tag and a field, or a field twice", measurement.Name, field.Name)
+			}
+			if field.Source == "" {
+				t.Errorf("%s %s has no source", measurement.Name, field.Name)
+			}
+			names[field.Name] = true
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	var cases = []struct {
+		kind     Type
+		value    interface{}
+		expected interface{}
+	}{
+		{Float, int64(3), 3.0},
+		{Float, float32(1.5), 1.5},
+		{Integer, 30.0, int64(30)},
+		{Integer, 30, int64(30)},
+		{String, "mg/dl", "mg/dl"},
+		{Boolean, true, true},
+	}
+	for _, c := range cases {
+		if value := c.kind.Value(c.value); value != c.expected {
+			t.Errorf("%s value of %#v is %#v, expected %#v", c.kind, c.value, value, c.expected)
+		}
+	}
+}
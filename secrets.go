@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretFiles reads secrets from files, such as mounted Docker or Kubernetes secrets.
+// A file is read again only when it changes, so long-running exports pick up rotated secrets.
+type secretFiles struct {
+	mutex sync.Mutex
+	files map[string]secretFile
+}
+
+type secretFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func (f *secretFiles) read(path string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read secret file: %w", err)
+	}
+	cached, ok := f.files[path]
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read secret file: %w", err)
+	}
+	var value = strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	if ok {
+		fmt.Println("secret file changed, reloaded: ", path)
+	}
+	if f.files == nil {
+		f.files = map[string]secretFile{}
+	}
+	f.files[path] = secretFile{modTime: info.ModTime(), size: info.Size(), value: value}
+	return value, nil
+}
+
+// secret resolves a setting which may be given either as value or as file, the import settings take precedence
+func (s *settings) secret(name string, global string, globalFile string, value string, file string) (string, error) {
+	if value == "" && file == "" {
+		value, file = global, globalFile
+	}
+	switch {
+	case value != "" && file != "":
+		return "", fmt.Errorf("'%s' and '%s-file' are both set", name, name)
+	case file != "":
+		return s.secrets.read(file)
+	}
+	return value, nil
+}
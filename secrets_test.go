@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ns-token")
+	if err := os.WriteFile(path, []byte("first-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var secrets = secretFiles{}
+	if value, err := secrets.read(path); err != nil || value != "first-token" {
+		t.Fatalf("read %q, %v", value, err)
+	}
+
+	if err := os.WriteFile(path, []byte("rotated-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var modified = time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := secrets.read(path); err != nil || value != "rotated-token" {
+		t.Errorf("changed file read %q, %v", value, err)
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secrets.read(path); err == nil {
+		t.Error("empty secret accepted")
+	}
+}
+
+func TestSecretSettings(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ns-token"), []byte("file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "influx-token"), []byte("influx-file-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	var data = `
+limit: 10
+influx-uri: http://influx:8086
+influx-token-file: ` + filepath.Join(dir, "influx-token") + `
+imports:
+  - user: john
+    ns-uri: https://john.example
+    ns-token-file: ` + filepath.Join(dir, "ns-token") + `
+  - user: jane
+    ns-uri: https://jane.example
+    ns-token: inline
+    ns-token-file: ` + filepath.Join(dir, "ns-token") + `
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := parse(t, "-config", path)
+
+	john, err := s.newImport(s.file.Imports[0])
+	if err != nil || john.NsToken != "file-token" {
+		t.Errorf("token %q, %v", john.NsToken, err)
+	}
+	if target, err := s.influxTarget(s.file.Imports[0]); err != nil || target.token != "influx-file-token" {
+		t.Errorf("influx token %q, %v", target.token, err)
+	}
+	if _, err := s.newImport(s.file.Imports[1]); err == nil || !strings.Contains(err.Error(), "both set") {
+		t.Errorf("expected error for token set twice, got %v", err)
+	}
+}
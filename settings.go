@@ -0,0 +1,682 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ns-exporter/alert"
+	"ns-exporter/config"
+	"ns-exporter/pipeline"
+	"ns-exporter/schema"
+	"ns-exporter/sink"
+	"ns-exporter/transform"
+	"strings"
+	"time"
+)
+
+// settings are the command line arguments, which may also come from environment variables and the config file
+type settings struct {
+	mongoUri        *string
+	mongoUriFile    *string
+	mongoDb         *string
+	nsUri           *string
+	nsToken         *string
+	nsTokenFile     *string
+	limit           *int64
+	skip            *int64
+	influxUri       *string
+	influxToken     *string
+	influxTokenFile *string
+	influxOrg       *string
+	influxBucket    *string
+	influxVersion   *int64
+	influxUsername  *string
+	influxPassword  *string
+	influxPassFile  *string
+	influxRP        *string
+	createBucket    *bool
+	retention       *time.Duration
+	configFile      *string
+	user            *string
+	treatmentFields *string
+	treatmentTags   *string
+	syncDeletes     *bool
+	idMode          *string
+	sourceTags      *bool
+	timezone        *string
+	localTimeTags   *bool
+	dedupTolerance  *time.Duration
+	timeout         *time.Duration
+	from            *string
+	to              *string
+	collections     *string
+	interval        *time.Duration
+	gapThreshold    *time.Duration
+	tags            *string
+	anonymize       *bool
+	anonymizeSecret *string
+	anonymizeFile   *string
+	anonymizeText   *string
+	shiftDays       *int64
+	dryRun          *bool
+
+	replicateNsUri        *string
+	replicateNsToken      *string
+	replicateNsTokenFile  *string
+	replicateMongoUri     *string
+	replicateMongoUriFile *string
+	replicateMongoDb      *string
+	replicateCollections  *string
+	replicateState        *string
+	replicateResync       *time.Duration
+
+	postgresUri       *string
+	postgresUriFile   *string
+	postgresTimescale *bool
+	postgresBatch     *int64
+	sqliteFile        *string
+	filesDir          *string
+	filesFormats      *string
+	otlpEndpoint      *string
+	otlpProtocol      *string
+	otlpHeaders       *string
+	mqttUri           *string
+	mqttUsername      *string
+	mqttPassword      *string
+	mqttPasswordFile  *string
+	mqttTopic         *string
+	mqttDiscovery     *bool
+	mqttPrefix        *string
+	alertLow          *int64
+	alertLowFor       *time.Duration
+	alertHigh         *int64
+	alertHighFor      *time.Duration
+	alertFall         *int64
+	alertNoLoop       *time.Duration
+	alertReservoir    *int64
+	alertBattery      *int64
+	alertSensorAge    *time.Duration
+	alertCooldown     *time.Duration
+	alertWebhooks     *string
+	grafanaDir        *string
+	describeFormat    *string
+
+	// file is the decoded config file, its imports can't be set by arguments
+	file    config.Config
+	secrets secretFiles
+}
+
+func newSettings(fs *flag.FlagSet) *settings {
+	return &settings{
+		mongoUri:        fs.String("mongo-uri", "", "Mongo-db uri to download from"),
+		mongoUriFile:    fs.String("mongo-uri-file", "", "File to read the Mongo-db uri from, e.g. a mounted secret"),
+		mongoDb:         fs.String("mongo-db", "", "Mongo-db database name"),
+		nsUri:           fs.String("ns-uri", "", "Nightscout server url to download from"),
+		nsToken:         fs.String("ns-token", "", "Nigthscout server API Authorization Token"),
+		nsTokenFile:     fs.String("ns-token-file", "", "File to read the Nightscout token from, e.g. a mounted secret"),
+		limit:           fs.Int64("limit", 0, "number of records to read from mongo-db"),
+		skip:            fs.Int64("skip", 0, "number of records to skip from mongo-db"),
+		influxUri:       fs.String("influx-uri", "", "InfluxDb uri to download from"),
+		influxToken:     fs.String("influx-token", "", "InfluxDb access token"),
+		influxTokenFile: fs.String("influx-token-file", "", "File to read the InfluxDb token from, e.g. a mounted secret"),
+		influxOrg:       fs.String("influx-org", "ns", "InfluxDb organization to use, {user} is replaced with the user of the import"),
+		influxBucket:    fs.String("influx-bucket", "ns", "InfluxDb bucket to use, {user} is replaced with the user of the import"),
+		influxVersion:   fs.Int64("influx-version", 2, "InfluxDb API version: 1 for InfluxDB 1.x, 2, or 3"),
+		influxUsername:  fs.String("influx-username", "", "InfluxDB 1.x user name, empty when authentication is disabled"),
+		influxPassword:  fs.String("influx-password", "", "InfluxDB 1.x password"),
+		influxPassFile:  fs.String("influx-password-file", "", "File to read the InfluxDB 1.x password from, e.g. a mounted secret"),
+		influxRP:        fs.String("influx-retention-policy", "", "InfluxDB 1.x retention policy to write to, the default policy of the database when empty"),
+		createBucket:    fs.Bool("influx-create-bucket", false, "Create the InfluxDb bucket when it does not exist"),
+		retention:       fs.Duration("influx-retention", 0, "Retention period of created InfluxDb buckets, 0 for infinite"),
+		configFile:      fs.String("config", "", "File to load configuration from, in JSON, YAML or TOML by its extension"),
+		user:            fs.String("user", "", "User name to be set on Influx record"),
+		treatmentFields: fs.String("treatment-fields", "", "Comma-separated extra treatment fields to write as Influx fields"),
+		treatmentTags:   fs.String("treatment-tags", "", "Comma-separated extra treatment fields to write as Influx tags"),
+		syncDeletes:     fs.Bool("sync-deletes", false, "Delete points of records which were soft-deleted in Nightscout, requires 'id-mode' tag"),
+		idMode:          fs.String("id-mode", "", "Write the source record id to Influx as 'field' or 'tag', empty to omit it"),
+		sourceTags:      fs.Bool("source-tags", false, "Add 'enteredBy' tag to treatments and 'device' tag to devicestatus"),
+		timezone:        fs.String("timezone", "", "IANA time zone of the user, used for timestamps without zone and local time tags"),
+		localTimeTags:   fs.Bool("local-time-tags", false, "Add 'local_hour' and 'weekday' tags in the user time zone"),
+		dedupTolerance:  fs.Duration("dedup-tolerance", time.Minute, "Records without id with equal content less than the tolerance apart are treated as duplicates"),
+		timeout:         fs.Duration("timeout", 0, "Maximum duration of the whole run, 0 for no limit"),
+		from:            fs.String("from", "", "Export records created at or after the time, RFC3339 or date"),
+		to:              fs.String("to", "", "Export records created before the time, RFC3339 or date"),
+		collections:     fs.String("collections", "", "Comma-separated collections to export: devicestatus, treatments, entries; devicestatus and treatments by default"),
+		interval:        fs.Duration("interval", 0, "Keep running and export every interval, 0 to export once"),
+		gapThreshold:    fs.Duration("gap-threshold", 0, "Report times without devicestatus or CGM entries longer than the threshold as gaps, 0 to disable"),
+		tags:            fs.String("tags", "", "Comma-separated name=value tags to add to every point"),
+		anonymize:       fs.Bool("anonymize", false, "Pseudonymize users and record ids, drop free text and shift times for research exports"),
+		anonymizeSecret: fs.String("anonymize-secret", "", "Secret the pseudonyms and time shifts are derived from"),
+		anonymizeFile:   fs.String("anonymize-secret-file", "", "File to read the anonymization secret from, e.g. a mounted secret"),
+		anonymizeText:   fs.String("anonymize-text", anonymizeDrop, "Free text of anonymized records is 'drop'ped or 'redact'ed"),
+		shiftDays:       fs.Int64("anonymize-shift-days", 0, "Maximum number of days times of anonymized users are shifted by, 0 keeps them"),
+		dryRun:          fs.Bool("dry-run", false, "Only report what restore would write"),
+
+		replicateNsUri:        fs.String("replicate-ns-uri", "", "Nightscout server url to replicate into"),
+		replicateNsToken:      fs.String("replicate-ns-token", "", "API Authorization Token of the Nightscout to replicate into"),
+		replicateNsTokenFile:  fs.String("replicate-ns-token-file", "", "File to read the token of the Nightscout to replicate into from"),
+		replicateMongoUri:     fs.String("replicate-mongo-uri", "", "Mongo-db uri to replicate into"),
+		replicateMongoUriFile: fs.String("replicate-mongo-uri-file", "", "File to read the Mongo-db uri to replicate into from"),
+		replicateMongoDb:      fs.String("replicate-mongo-db", "", "Mongo-db database name to replicate into"),
+		replicateCollections:  fs.String("replicate-collections", "", "Comma-separated collections to replicate: devicestatus, treatments, entries, profile; all by default"),
+		replicateState:        fs.String("replicate-state", "", "File to keep the replication progress in, so runs continue where the previous one stopped"),
+		replicateResync:       fs.Duration("replicate-resync", 24*time.Hour, "Replicate every document of a MongoDb source again after the duration, to copy changes of documents without srvModified; 0 never does"),
+
+		postgresUri:       fs.String("postgres-uri", "", "PostgreSQL uri to write to, in addition to or instead of InfluxDb"),
+		postgresUriFile:   fs.String("postgres-uri-file", "", "File to read the PostgreSQL uri from, e.g. a mounted secret"),
+		postgresTimescale: fs.Bool("postgres-timescale", false, "Turn the PostgreSQL tables into TimescaleDB hypertables when creating them"),
+		postgresBatch:     fs.Int64("postgres-batch", sink.DefaultPostgresBatch, "Number of rows of a table copied to PostgreSQL at once"),
+		sqliteFile:        fs.String("sqlite-file", "", "SQLite file to archive the exported records in, in addition to or instead of InfluxDb"),
+		filesDir:          fs.String("files-dir", "", "Directory to write Parquet or CSV files into, one per table, user and month"),
+		filesFormats:      fs.String("files-formats", sink.FormatParquet, "Comma-separated formats of the files: parquet, csv"),
+		otlpEndpoint:      fs.String("otlp-endpoint", "", "OpenTelemetry collector url to export glucose, insulin and carbs metrics to"),
+		otlpProtocol:      fs.String("otlp-protocol", sink.OTLPHttp, "OTLP protocol: grpc or http"),
+		otlpHeaders:       fs.String("otlp-headers", "", "Comma-separated name=value headers to send with every OTLP export"),
+		mqttUri:           fs.String("mqtt-uri", "", "MQTT broker to publish the latest values to, e.g. tcp://mqtt:1883"),
+		mqttUsername:      fs.String("mqtt-username", "", "MQTT user name"),
+		mqttPassword:      fs.String("mqtt-password", "", "MQTT password"),
+		mqttPasswordFile:  fs.String("mqtt-password-file", "", "File to read the MQTT password from, e.g. a mounted secret"),
+		mqttTopic:         fs.String("mqtt-topic", sink.DefaultMQTTTopic, "MQTT topic of the values, {user} and {name} are replaced with the user and the value name"),
+		mqttDiscovery:     fs.Bool("mqtt-discovery", false, "Publish Home Assistant discovery payloads, so the sensors appear automatically"),
+		mqttPrefix:        fs.String("mqtt-discovery-prefix", sink.DefaultMQTTDiscoveryPrefix, "Topic prefix of the Home Assistant discovery payloads"),
+		alertLow:          fs.Int64("alert-low", 0, "Alert when BG in mg/dL is below, 0 to disable"),
+		alertLowFor:       fs.Duration("alert-low-for", 0, "Alert on low BG only when it lasts for the duration"),
+		alertHigh:         fs.Int64("alert-high", 0, "Alert when BG in mg/dL is above, 0 to disable"),
+		alertHighFor:      fs.Duration("alert-high-for", 0, "Alert on high BG only when it lasts for the duration"),
+		alertFall:         fs.Int64("alert-fall", 0, "Alert when BG falls by at least the mg/dL per 5 minutes, 0 to disable"),
+		alertNoLoop:       fs.Duration("alert-no-loop", 0, "Alert when the loop uploaded no devicestatus for the duration, 0 to disable"),
+		alertReservoir:    fs.Int64("alert-reservoir", 0, "Alert when the pump reservoir is below the units, 0 to disable"),
+		alertBattery:      fs.Int64("alert-battery", 0, "Alert when the pump battery is below the percent, 0 to disable"),
+		alertSensorAge:    fs.Duration("alert-sensor-age", 0, "Alert when the last sensor change is older than the duration, 0 to disable"),
+		alertCooldown:     fs.Duration("alert-cooldown", alert.DefaultCooldown, "Time an alert of a user and rule is not repeated for"),
+		alertWebhooks:     fs.String("alert-webhooks", "", "Comma-separated [format:]url webhooks to send alerts to, format json, telegram or pushover"),
+		describeFormat:    fs.String("describe-format", describeTable, "Output of the describe command: table or json"),
+		grafanaDir:        fs.String("grafana-dir", "", "Grafana provisioning directory the grafana command writes the datasource and dashboard into, stdout gets the dashboard when empty"),
+	}
+}
+
+// importEntries returns the imports of the arguments and of the config file, not yet merged with the global settings
+func (s *settings) importEntries() []config.Import {
+	var result []config.Import
+	if (*s.mongoUri != "" || *s.mongoUriFile != "") && *s.mongoDb != "" {
+		result = append(result, config.Import{User: *s.user, MongoDb: *s.mongoDb})
+	}
+	if *s.nsUri != "" && (*s.nsToken != "" || *s.nsTokenFile != "") {
+		result = append(result, config.Import{User: *s.user, NsUri: *s.nsUri, NsToken: *s.nsToken, NsTokenFile: *s.nsTokenFile})
+	}
+	return append(result, s.file.Imports...)
+}
+
+// newImport merges the import with the global settings, settings of the import take precedence
+func (s *settings) newImport(entry config.Import) (pipeline.Import, error) {
+	var result = pipeline.Import{
+		User:     entry.User,
+		MongoDb:  entry.MongoDb,
+		NsUri:    entry.NsUri,
+		Limit:    *s.limit,
+		Skip:     *s.skip,
+		Interval: *s.interval,
+	}
+	if entry.Limit != 0 {
+		result.Limit = entry.Limit
+	}
+	if entry.Skip != 0 {
+		result.Skip = entry.Skip
+	}
+	if *s.configFile != "" && result.Limit <= 0 {
+		return result, errors.New("'limit' must be greater than 0")
+	}
+	if *s.syncDeletes && entry.User == "" {
+		// points are deleted by their user, without it a deletion would match the points of every user
+		return result, errors.New("'user' must be set to 'sync-deletes'")
+	}
+
+	var err error
+	if result.MongoUri, err = s.secret("mongo-uri", *s.mongoUri, *s.mongoUriFile, entry.MongoUri, entry.MongoUriFile); err != nil {
+		return result, err
+	}
+	if entry.NsUri != "" {
+		if result.NsToken, err = s.secret("ns-token", "", "", entry.NsToken, entry.NsTokenFile); err != nil {
+			return result, err
+		}
+	}
+	if result.Location, err = loadLocation(combine(*s.timezone, entry.Timezone)); err != nil {
+		return result, err
+	}
+	if result.From, err = parseTime(combine(*s.from, entry.From), result.Location); err != nil {
+		return result, fmt.Errorf("invalid 'from': %w", err)
+	}
+	if result.To, err = parseTime(combine(*s.to, entry.To), result.Location); err != nil {
+		return result, fmt.Errorf("invalid 'to': %w", err)
+	}
+	if !result.From.IsZero() && !result.To.IsZero() && !result.From.Before(result.To) {
+		return result, errors.New("'from' must be before 'to'")
+	}
+	if entry.Interval != "" {
+		if result.Interval, err = time.ParseDuration(entry.Interval); err != nil {
+			return result, fmt.Errorf("invalid 'interval': %w", err)
+		}
+	}
+
+	result.Collections = splitList(*s.collections)
+	if len(entry.Collections) > 0 {
+		result.Collections = entry.Collections
+	}
+	for _, collection := range result.Collections {
+		if !contains(pipeline.Collections, collection) {
+			return result, fmt.Errorf("unknown collection %q, expected one of %v", collection, pipeline.Collections)
+		}
+	}
+
+	options, err := s.importOptions(entry)
+	if err != nil {
+		return result, err
+	}
+	if *s.syncDeletes && options.IdMode != transform.IdTag {
+		// without the id tag a deletion would match every point of the user at the time of the record
+		return result, errors.New("'id-mode' must be 'tag' to 'sync-deletes'")
+	}
+	result.Transform = &options
+	return result, nil
+}
+
+// importOptions overrides the global transform options with the ones of the import
+func (s *settings) importOptions(entry config.Import) (transform.Options, error) {
+	options, err := s.transformOptions()
+	if err != nil {
+		return options, err
+	}
+	if len(entry.TreatmentFields) > 0 {
+		options.ExtraFields = entry.TreatmentFields
+	}
+	if len(entry.TreatmentTags) > 0 {
+		options.ExtraTags = entry.TreatmentTags
+	}
+	if entry.IdMode != "" {
+		options.IdMode = entry.IdMode
+	}
+	if entry.SourceTags != nil {
+		options.SourceTags = *entry.SourceTags
+	}
+	if entry.LocalTimeTags != nil {
+		options.LocalTimeTags = *entry.LocalTimeTags
+	}
+	if entry.Anonymize != nil {
+		options.Anonymizer = nil
+		if *entry.Anonymize {
+			if options.Anonymizer, err = s.anonymizer(); err != nil {
+				return options, err
+			}
+		}
+	}
+	for name, value := range entry.Tags {
+		options.Tags[name] = value
+	}
+	return options, checkOptions(options)
+}
+
+func (s *settings) transformOptions() (transform.Options, error) {
+	tags, err := config.SplitTags(*s.tags)
+	if err != nil {
+		return transform.Options{}, err
+	}
+	var options = transform.Options{
+		ExtraFields:   splitList(*s.treatmentFields),
+		ExtraTags:     splitList(*s.treatmentTags),
+		IdMode:        *s.idMode,
+		SourceTags:    *s.sourceTags,
+		LocalTimeTags: *s.localTimeTags,
+		Tags:          tags,
+	}
+	if *s.anonymize {
+		if options.Anonymizer, err = s.anonymizer(); err != nil {
+			return options, err
+		}
+	}
+	return options, checkOptions(options)
+}
+
+const (
+	anonymizeDrop   = "drop"
+	anonymizeRedact = "redact"
+)
+
+func (s *settings) anonymizer() (*transform.Anonymizer, error) {
+	secret, err := s.secret("anonymize-secret", *s.anonymizeSecret, *s.anonymizeFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case secret == "":
+		return nil, errors.New("'anonymize-secret' must be set to anonymize")
+	case *s.anonymizeText != anonymizeDrop && *s.anonymizeText != anonymizeRedact:
+		return nil, errors.New("'anonymize-text' must be either 'drop' or 'redact'")
+	case *s.shiftDays < 0:
+		return nil, errors.New("'anonymize-shift-days' must not be negative")
+	}
+	return &transform.Anonymizer{Secret: secret, RedactText: *s.anonymizeText == anonymizeRedact, MaxShiftDays: int(*s.shiftDays)}, nil
+}
+
+func checkOptions(options transform.Options) error {
+	if options.IdMode != "" && options.IdMode != transform.IdField && options.IdMode != transform.IdTag {
+		return errors.New("'id-mode' must be either 'field' or 'tag'")
+	}
+	for _, name := range transform.ReservedTags {
+		if _, ok := options.Tags[name]; ok {
+			return fmt.Errorf("tag %q is reserved", name)
+		}
+	}
+	// whitelisted treatment fields would replace the tags and fields the exporter writes
+	for _, name := range append(append([]string{}, options.ExtraFields...), options.ExtraTags...) {
+		if _, ok := schema.Treatments.Field(name); ok || contains(transform.ReservedTags, name) {
+			return fmt.Errorf("treatment field %q collides with a tag or field written by the exporter", name)
+		}
+	}
+	for _, name := range options.ExtraTags {
+		if contains(options.ExtraFields, name) {
+			return fmt.Errorf("treatment field %q can't be both a field and a tag", name)
+		}
+	}
+	return nil
+}
+
+// userPlaceholder in org and bucket names routes every user to its own org or bucket
+const userPlaceholder = "{user}"
+
+// influxTarget is the InfluxDb bucket an import is written to, for InfluxDB 1.x and 3 the bucket is the database
+type influxTarget struct {
+	version         int64
+	uri             string
+	token           string
+	org             string
+	bucket          string
+	username        string
+	password        string
+	retentionPolicy string
+	createBucket    bool
+	retention       time.Duration
+}
+
+func (s *settings) influxTarget(entry config.Import) (influxTarget, error) {
+	var target = influxTarget{
+		version:         *s.influxVersion,
+		uri:             combine(*s.influxUri, entry.InfluxUri),
+		org:             combine(*s.influxOrg, entry.InfluxOrg),
+		bucket:          combine(*s.influxBucket, entry.InfluxBucket),
+		username:        combine(*s.influxUsername, entry.InfluxUsername),
+		retentionPolicy: combine(*s.influxRP, entry.InfluxRetentionPolicy),
+		createBucket:    *s.createBucket,
+		retention:       *s.retention,
+	}
+	if entry.InfluxVersion != 0 {
+		target.version = entry.InfluxVersion
+	}
+	if entry.CreateBucket != nil {
+		target.createBucket = *entry.CreateBucket
+	}
+	var err error
+	if entry.Retention != "" {
+		if target.retention, err = time.ParseDuration(entry.Retention); err != nil {
+			return target, fmt.Errorf("invalid 'influx-retention': %w", err)
+		}
+	}
+	if strings.Contains(target.org+target.bucket, userPlaceholder) {
+		if entry.User == "" {
+			return target, fmt.Errorf("user must be set to route it to %s/%s", target.org, target.bucket)
+		}
+		// anonymized users are routed by their pseudonym, so bucket names don't reveal them either
+		options, err := s.importOptions(entry)
+		if err != nil {
+			return target, err
+		}
+		target.org = strings.ReplaceAll(target.org, userPlaceholder, options.UserTag(entry.User))
+		target.bucket = strings.ReplaceAll(target.bucket, userPlaceholder, options.UserTag(entry.User))
+	}
+	if target.version == 1 {
+		if target.password, err = s.secret("influx-password", *s.influxPassword, *s.influxPassFile, entry.InfluxPassword, entry.InfluxPasswordFile); err != nil {
+			return target, err
+		}
+	} else if target.token, err = s.secret("influx-token", *s.influxToken, *s.influxTokenFile, entry.InfluxToken, entry.InfluxTokenFile); err != nil {
+		return target, err
+	}
+	if target.version == 3 && *s.syncDeletes {
+		return target, errors.New("'sync-deletes' is not supported by InfluxDB 3, which can't delete points")
+	}
+	return target, target.check()
+}
+
+// check reports the missing InfluxDb settings of the version
+func (t influxTarget) check() error {
+	switch {
+	case t.version < 1 || t.version > 3:
+		return fmt.Errorf("unsupported 'influx-version' %d, expected 1, 2 or 3", t.version)
+	case t.uri == "":
+		return errors.New("InfluxDB uri not supplied")
+	case t.token == "" && t.version != 1:
+		return errors.New("InfluxDB token not supplied")
+	case t.org == "" && t.version == 2:
+		return errors.New("InfluxDB org not supplied")
+	case t.bucket == "" && t.version == 2:
+		return errors.New("InfluxDB bucket not supplied")
+	case t.bucket == "":
+		return errors.New("InfluxDB database not supplied")
+	case t.username == "" && t.password != "":
+		return errors.New("InfluxDB password supplied without username")
+	}
+	return nil
+}
+
+func (t influxTarget) String() string {
+	switch t.version {
+	case 1:
+		if t.retentionPolicy != "" {
+			return fmt.Sprintf("%s database %s retention policy %s", t.uri, t.bucket, t.retentionPolicy)
+		}
+		return fmt.Sprintf("%s database %s", t.uri, t.bucket)
+	case 3:
+		return fmt.Sprintf("%s database %s", t.uri, t.bucket)
+	}
+	return fmt.Sprintf("%s org %s bucket %s", t.uri, t.org, t.bucket)
+}
+
+// newSink connects to the target with the API of its version
+func (t influxTarget) newSink() sink.Sink {
+	switch t.version {
+	case 1:
+		influx := sink.NewInfluxV1(t.uri, t.bucket, t.retentionPolicy, t.username, t.password)
+		if t.createBucket {
+			influx.CreateDatabase(t.retention)
+		}
+		return influx
+	case 3:
+		return sink.NewInfluxV3(t.uri, t.token, t.bucket)
+	}
+	influx := sink.NewInflux(t.uri, t.token, t.org, t.bucket)
+	if t.createBucket {
+		influx.CreateBucket(t.retention)
+	}
+	return influx
+}
+
+// influxConfigured reports whether the import is written to InfluxDb, which is required unless there are shared sinks
+func (s *settings) influxConfigured(entry config.Import) bool {
+	return combine(*s.influxUri, entry.InfluxUri) != "" || (!s.postgresConfigured() && *s.sqliteFile == "" && *s.filesDir == "" && *s.otlpEndpoint == "" && *s.mqttUri == "")
+}
+
+// sharedSinks opens the sinks every import is written to, besides its InfluxDb bucket
+func (s *settings) sharedSinks() ([]sink.Sink, error) {
+	var result []sink.Sink
+	postgres, err := s.postgres()
+	if err != nil {
+		return nil, err
+	}
+	if postgres != nil {
+		result = append(result, postgres)
+	}
+	if *s.sqliteFile != "" {
+		archive, err := sink.NewSQLite(*s.sqliteFile)
+		if err != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, err
+		}
+		result = append(result, archive)
+	}
+	if *s.filesDir != "" {
+		files, err := sink.NewFiles(*s.filesDir, splitList(*s.filesFormats)...)
+		if err != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, err
+		}
+		result = append(result, files)
+	}
+	if *s.otlpEndpoint != "" {
+		otlp, err := s.otlp()
+		if err != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, err
+		}
+		result = append(result, otlp)
+	}
+	if *s.mqttUri != "" {
+		mqtt, err := s.mqtt()
+		if err != nil {
+			for _, opened := range result {
+				opened.Close()
+			}
+			return nil, err
+		}
+		result = append(result, mqtt)
+	}
+	return result, nil
+}
+
+// mqtt returns the MQTT sink shared by all imports
+func (s *settings) mqtt() (*sink.MQTT, error) {
+	password, err := s.secret("mqtt-password", *s.mqttPassword, *s.mqttPasswordFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(*s.mqttTopic, "{name}") {
+		return nil, errors.New("'mqtt-topic' must contain {name}")
+	}
+	mqtt := sink.NewMQTT(*s.mqttUri, *s.mqttUsername, password, *s.mqttTopic)
+	if *s.mqttDiscovery {
+		mqtt.Discovery(*s.mqttPrefix)
+	}
+	return mqtt, nil
+}
+
+// monitor returns the alert rules of all imports, nil when no webhooks are configured
+func (s *settings) monitor() (*alert.Monitor, error) {
+	var webhooks []alert.Webhook
+	for _, spec := range splitList(*s.alertWebhooks) {
+		webhook, err := alert.ParseWebhook(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'alert-webhooks': %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if len(webhooks) == 0 {
+		return nil, nil
+	}
+	return alert.NewMonitor(alert.Rules{
+		Low:       float64(*s.alertLow),
+		LowFor:    *s.alertLowFor,
+		High:      float64(*s.alertHigh),
+		HighFor:   *s.alertHighFor,
+		Fall:      float64(*s.alertFall),
+		NoLoop:    *s.alertNoLoop,
+		Reservoir: float64(*s.alertReservoir),
+		Battery:   float64(*s.alertBattery),
+		SensorAge: *s.alertSensorAge,
+		Cooldown:  *s.alertCooldown,
+	}, webhooks...), nil
+}
+
+// otlp returns the OpenTelemetry sink shared by all imports
+func (s *settings) otlp() (*sink.OTLP, error) {
+	headers, err := config.SplitTags(*s.otlpHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'otlp-headers': %w", err)
+	}
+	return sink.NewOTLP(*s.otlpEndpoint, *s.otlpProtocol, headers)
+}
+
+func (s *settings) postgresConfigured() bool {
+	return *s.postgresUri != "" || *s.postgresUriFile != ""
+}
+
+// postgres returns the PostgreSQL sink shared by all imports, nil when it is not configured
+func (s *settings) postgres() (*sink.Postgres, error) {
+	if !s.postgresConfigured() {
+		return nil, nil
+	}
+	uri, err := s.secret("postgres-uri", *s.postgresUri, *s.postgresUriFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if *s.postgresBatch <= 0 {
+		return nil, errors.New("'postgres-batch' must be greater than 0")
+	}
+	postgres, err := sink.NewPostgres(uri)
+	if err != nil {
+		return nil, err
+	}
+	postgres.Batch(int(*s.postgresBatch))
+	if *s.postgresTimescale {
+		postgres.Timescale()
+	}
+	return postgres, nil
+}
+
+// parseTime accepts RFC3339 timestamps and dates, which are taken in the location of the user
+func parseTime(value string, location *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if location == nil {
+		location = time.UTC
+	}
+	if result, err := time.Parse(time.RFC3339, value); err == nil {
+		return result, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, location)
+}
+
+func combine(values ...string) string {
+	var result = ""
+	for _, value := range values {
+		if value != "" {
+			result = value
+		}
+	}
+	return result
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// loadLocation returns the named time zone, or nil when no name is given
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", name, err)
+	}
+	return location, nil
+}
@@ -0,0 +1,389 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"net/url"
+	"ns-exporter/transform"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatParquet = "parquet"
+	FormatCSV     = "csv"
+	// FilesMonthLayout names the month directories of the partitions
+	FilesMonthLayout = "2006-01"
+)
+
+// Files writes the points into Parquet and CSV files for data science tools, one file per table, user and month
+// in a partitioned layout: <dir>/<table>/user=<user>/month=<yyyy-mm>/<table>.<format>.
+// The columns are the ones of the SQL tables, in the same order. The rows of a month are read from its file
+// when it is first changed, and every flush rewrites the files of the changed months and drops them from memory,
+// so incremental and scheduled runs add to the months instead of replacing them.
+type Files struct {
+	dir     string
+	formats []string
+
+	mutex      sync.Mutex
+	partitions map[partition]map[rowKey][]interface{}
+	dirty      map[partition]bool
+}
+
+// partition is the file of a table holding the rows of a user in a month
+type partition struct {
+	measurement string
+	user        string
+	month       string
+}
+
+// NewFiles writes into dir in each of the formats, Parquet when none is given
+func NewFiles(dir string, formats ...string) (*Files, error) {
+	if len(formats) == 0 {
+		formats = []string{FormatParquet}
+	}
+	for _, format := range formats {
+		if format != FormatParquet && format != FormatCSV {
+			return nil, fmt.Errorf("unknown file format %q, expected %s or %s", format, FormatParquet, FormatCSV)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Files{dir: dir, formats: formats, partitions: map[partition]map[rowKey][]interface{}{}, dirty: map[partition]bool{}}, nil
+}
+
+func (s *Files) Write(_ context.Context, point *write.Point) error {
+	table, ok := sqlTables[point.Name()]
+	if !ok {
+		return fmt.Errorf("no file table for measurement %s", point.Name())
+	}
+	key, row, err := table.row(point)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var at = partition{measurement: point.Name(), user: key.user, month: key.time.Format(FilesMonthLayout)}
+	rows, err := s.load(at)
+	if err != nil {
+		return err
+	}
+	rows[key] = row
+	s.dirty[at] = true
+	return nil
+}
+
+// Delete removes the row of the record, or every row of the user at the time when ids are not written as tags
+func (s *Files) Delete(_ context.Context, deletion transform.Deletion) error {
+	if _, ok := sqlTables[deletion.Measurement]; !ok {
+		return fmt.Errorf("no file table for measurement %s", deletion.Measurement)
+	}
+	var at = deletion.Time.UTC()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var p = partition{measurement: deletion.Measurement, user: deletion.User, month: at.Format(FilesMonthLayout)}
+	rows, err := s.load(p)
+	if err != nil {
+		return err
+	}
+	for key := range rows {
+		if key.time.Equal(at) && (deletion.Id == "" || key.key == deletion.Id) {
+			delete(rows, key)
+			s.dirty[p] = true
+		}
+	}
+	if !s.dirty[p] {
+		delete(s.partitions, p)
+	}
+	return nil
+}
+
+// Flush rewrites the files of the partitions changed since the last flush, which are then read again when changed
+func (s *Files) Flush(_ context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for p := range s.dirty {
+		if err := s.writePartition(p); err != nil {
+			return err
+		}
+		delete(s.dirty, p)
+		delete(s.partitions, p)
+	}
+	return nil
+}
+
+// Close writes the changed partitions
+func (s *Files) Close() error {
+	return s.Flush(context.Background())
+}
+
+// load returns the rows of the partition, read from the file of the first format which exists
+func (s *Files) load(p partition) (map[rowKey][]interface{}, error) {
+	if rows, ok := s.partitions[p]; ok {
+		return rows, nil
+	}
+	var table = sqlTables[p.measurement]
+	var rows = map[rowKey][]interface{}{}
+	for _, format := range s.formats {
+		var path = filepath.Join(s.partitionDir(p), table.name+"."+format)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var read [][]interface{}
+		if format == FormatParquet {
+			read, err = table.readParquet(data)
+		} else {
+			read, err = table.readCSV(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		for _, row := range read {
+			var user, _ = row[0].(string)
+			var at, _ = row[1].(time.Time)
+			var key, _ = row[2].(string)
+			rows[rowKey{user: user, time: at, key: key}] = row
+		}
+		break
+	}
+	s.partitions[p] = rows
+	return rows, nil
+}
+
+func (s *Files) partitionDir(p partition) string {
+	return filepath.Join(s.dir, sqlTables[p.measurement].name, "user="+url.PathEscape(p.user), "month="+p.month)
+}
+
+func (s *Files) writePartition(p partition) error {
+	var table = sqlTables[p.measurement]
+	var rows = sortedRows(s.partitions[p])
+	var dir = s.partitionDir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, format := range s.formats {
+		var path = filepath.Join(dir, table.name+"."+format)
+		var err error
+		if format == FormatParquet {
+			err = replaceFile(path, func(w io.Writer) error { return table.writeParquet(w, rows) })
+		} else {
+			err = replaceFile(path, func(w io.Writer) error { return table.writeCSV(w, rows) })
+		}
+		if err != nil {
+			return fmt.Errorf("can't write %s: %w", path, err)
+		}
+	}
+	fmt.Println("wrote rows to files: ", len(rows), ", table: ", table.name, ", month: ", p.month)
+	return nil
+}
+
+// replaceFile writes a temporary file next to path and renames it, so readers never see a partial file
+func replaceFile(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// sortedRows orders the rows by time and key, so exporting the same records gives the same files
+func sortedRows(partition map[rowKey][]interface{}) [][]interface{} {
+	var keys = make([]rowKey, 0, len(partition))
+	for key := range partition {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].time.Equal(keys[j].time) {
+			return keys[i].time.Before(keys[j].time)
+		}
+		return keys[i].key < keys[j].key
+	})
+	var rows = make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, partition[key])
+	}
+	return rows
+}
+
+// parquetTypes are the Parquet types of the column kinds, text is UTF-8
+var parquetTypes = map[columnKind]string{
+	kindFloat: "type=DOUBLE",
+	kindInt:   "type=INT64",
+	kindText:  "type=BYTE_ARRAY, convertedtype=UTF8",
+	kindBool:  "type=BOOLEAN",
+}
+
+// parquetSchema describes the columns in the order of columnNames, time is in milliseconds since the epoch
+func (t sqlTable) parquetSchema() []string {
+	var schema = []string{
+		"name=user, " + parquetTypes[kindText] + ", repetitiontype=REQUIRED",
+		"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=REQUIRED",
+		"name=key, " + parquetTypes[kindText] + ", repetitiontype=REQUIRED",
+	}
+	for _, column := range t.columns {
+		schema = append(schema, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", column.name, parquetTypes[column.kind]))
+	}
+	return append(schema, "name=extra, "+parquetTypes[kindText]+", repetitiontype=OPTIONAL")
+}
+
+func (t sqlTable) writeParquet(w io.Writer, rows [][]interface{}) error {
+	parquet, err := writer.NewCSVWriterFromWriter(t.parquetSchema(), w, 1)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var record = append([]interface{}(nil), row...)
+		for i, value := range record {
+			if at, ok := value.(time.Time); ok {
+				record[i] = at.UnixMilli()
+			}
+		}
+		if err := parquet.Write(record); err != nil {
+			return err
+		}
+	}
+	return parquet.WriteStop()
+}
+
+// writeCSV writes a header with the column names, missing values are empty and times are in SQLiteTimeLayout
+func (t sqlTable) writeCSV(w io.Writer, rows [][]interface{}) error {
+	var out = csv.NewWriter(w)
+	if err := out.Write(t.columnNames()); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var record = make([]string, len(row))
+		for i, value := range row {
+			record[i] = csvValue(value)
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// readParquet returns the rows of a file written by writeParquet, missing values are nil
+func (t sqlTable) readParquet(data []byte) ([][]interface{}, error) {
+	file, err := buffer.NewBufferFile(data)
+	if err != nil {
+		return nil, err
+	}
+	parquet, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer parquet.ReadStop()
+	var count = parquet.GetNumRows()
+	var names = t.columnNames()
+	var rows = make([][]interface{}, count)
+	for i := range rows {
+		rows[i] = make([]interface{}, len(names))
+	}
+	for column := range names {
+		values, _, _, err := parquet.ReadColumnByIndex(int64(column), count)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(values)) != count {
+			return nil, fmt.Errorf("column %s has %d of %d values", names[column], len(values), count)
+		}
+		for i, value := range values {
+			if millis, ok := value.(int64); ok && column == 1 {
+				value = time.UnixMilli(millis).UTC()
+			}
+			rows[i][column] = value
+		}
+	}
+	return rows, nil
+}
+
+// readCSV returns the rows of a file written by writeCSV, empty values are nil
+func (t sqlTable) readCSV(data []byte) ([][]interface{}, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var names = t.columnNames()
+	if len(records) == 0 || strings.Join(records[0], ",") != strings.Join(names, ",") {
+		return nil, fmt.Errorf("unexpected header, expected %v", names)
+	}
+	var kinds = []columnKind{kindText, kindText, kindText}
+	for _, column := range t.columns {
+		kinds = append(kinds, column.kind)
+	}
+	kinds = append(kinds, kindText)
+
+	var rows [][]interface{}
+	for _, record := range records[1:] {
+		var row = make([]interface{}, len(record))
+		for i, text := range record {
+			if row[i], err = csvParse(text, kinds[i]); err != nil {
+				return nil, fmt.Errorf("%s: %w", names[i], err)
+			}
+		}
+		if row[1], err = time.Parse(SQLiteTimeLayout, record[1]); err != nil {
+			return nil, err
+		}
+		// the key columns are never missing
+		row[0], row[2] = record[0], record[2]
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func csvParse(text string, kind columnKind) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+	switch kind {
+	case kindFloat:
+		return strconv.ParseFloat(text, 64)
+	case kindInt:
+		return strconv.ParseInt(text, 10, 64)
+	case kindBool:
+		return strconv.ParseBool(text)
+	}
+	return text, nil
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().Format(SQLiteTimeLayout)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,146 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"ns-exporter/transform"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	files, err := NewFiles(dir, FormatParquet, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var at = time.Date(2022, 6, 30, 23, 55, 0, 0, time.UTC)
+	var points = []*write.Point{
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "b").AddTag("type", "sgv").AddField("sgv", 125).SetTime(at.Add(5 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "a").AddTag("type", "sgv").AddField("sgv", 120).AddField("direction", "Flat").SetTime(at),
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "c").AddTag("type", "sgv").AddField("sgv", 130).SetTime(at.Add(-5 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "jane doe").AddTag("type", "bolus").AddTag("smb", "true").AddTag("weekday", "Thursday").AddField("bolus", 0.3).SetTime(at),
+	}
+	for _, point := range points {
+		if err := files.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := files.Delete(ctx, transform.Deletion{Measurement: "entries", User: "john", Id: "c", Time: at.Add(-5 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "entries", "user=john", "month=2022-06", "entries.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = "user,time,key,type,sgv,mbg,direction,noise,device,extra\n" +
+		"john,2022-06-30T23:55:00.000Z,a,sgv,120,,Flat,,,\n"
+	if string(data) != expected {
+		t.Errorf("unexpected csv\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "entries", "user=john", "month=2022-07", "entries.parquet")); err != nil {
+		t.Errorf("the entry of the next month is not in its partition: %v", err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "treatments", "user=jane%20doe", "month=2022-06", "treatments.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := buffer.NewBufferFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parquet, err := reader.NewParquetReader(file, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parquet.ReadStop()
+	rows, err := parquet.ReadByNumber(int(parquet.GetNumRows()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := json.Marshal(rows)
+	for _, value := range []string{`"User":"jane doe"`, `"Time":1656633300000`, `"Key":"bolus"`, `"Bolus":0.3`, `"Smb":true`, `"Carbs":null`, `"Extra":"{\"weekday\":\"Thursday\"}"`} {
+		if !strings.Contains(string(read), value) {
+			t.Errorf("%s not in %s", value, read)
+		}
+	}
+}
+
+func TestFilesFormats(t *testing.T) {
+	if _, err := NewFiles(t.TempDir(), "xlsx"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+// TestFilesKeepEarlierRuns adds the rows of later runs to the months written before, read from either format
+func TestFilesKeepEarlierRuns(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	var at = time.Date(2022, 6, 8, 10, 0, 0, 0, time.UTC)
+	var entry = func(id string, sgv int, offset time.Duration) *write.Point {
+		return influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", id).AddTag("type", "sgv").
+			AddField("sgv", sgv).SetTime(at.Add(offset))
+	}
+	var run = func(formats []string, points []*write.Point, deletions ...transform.Deletion) {
+		files, err := NewFiles(dir, formats...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, point := range points {
+			if err := files.Write(ctx, point); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, deletion := range deletions {
+			if err := files.Delete(ctx, deletion); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := files.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(files.partitions) != 0 {
+			t.Errorf("partitions kept in memory after flush: %d", len(files.partitions))
+		}
+	}
+
+	run([]string{FormatParquet}, []*write.Point{entry("a", 120, 0).AddField("direction", "Flat")})
+	// read from the parquet file
+	run([]string{FormatParquet, FormatCSV}, []*write.Point{entry("b", 125, 5*time.Minute)})
+	// read from the csv file, the deletion of the first run's entry is applied to the file
+	run([]string{FormatCSV, FormatParquet}, []*write.Point{entry("c", 130, 10*time.Minute)},
+		transform.Deletion{Measurement: "entries", User: "john", Id: "b", Time: at.Add(5 * time.Minute)})
+
+	data, err := os.ReadFile(filepath.Join(dir, "entries", "user=john", "month=2022-06", "entries.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = "user,time,key,type,sgv,mbg,direction,noise,device,extra\n" +
+		"john,2022-06-08T10:00:00.000Z,a,sgv,120,,Flat,,,\n" +
+		"john,2022-06-08T10:10:00.000Z,c,sgv,130,,,,,\n"
+	if string(data) != expected {
+		t.Errorf("unexpected csv\n%s", data)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "entries", "user=john", "month=2022-06", "entries.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := sqlTables["entries"].readParquet(data)
+	if err != nil || len(rows) != 2 || rows[0][2] != "a" || rows[0][4] != int64(120) || rows[0][5] != nil || rows[1][2] != "c" {
+		t.Errorf("unexpected parquet rows %v, %v", rows, err)
+	}
+}
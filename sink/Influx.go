@@ -0,0 +1,139 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"ns-exporter/transform"
+	"sync"
+	"time"
+)
+
+type Influx struct {
+	client influxdb2.Client
+	writer api.WriteAPIBlocking
+	org    string
+	bucket string
+
+	createBucket bool
+	retention    time.Duration
+	mutex        sync.Mutex
+	ensured      bool
+}
+
+func NewInflux(uri string, token string, org string, bucket string) *Influx {
+	client := influxdb2.NewClient(uri, token)
+	return &Influx{
+		client: client,
+		writer: client.WriteAPIBlocking(org, bucket),
+		org:    org,
+		bucket: bucket,
+	}
+}
+
+// CreateBucket makes the sink create its bucket before the first write when it does not exist,
+// with the retention period or infinite retention when it is zero
+func (s *Influx) CreateBucket(retention time.Duration) *Influx {
+	s.createBucket = true
+	s.retention = retention
+	return s
+}
+
+func (s *Influx) Write(ctx context.Context, point *write.Point) error {
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+	return s.writer.WritePoint(ctx, point)
+}
+
+func (s *Influx) Delete(ctx context.Context, deletion transform.Deletion) error {
+	if deletion.User == "" {
+		return errNoDeletionUser
+	}
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+	return s.client.DeleteAPI().DeleteWithName(ctx, s.org, s.bucket, deletion.Time, deletion.Time, predicate(deletion))
+}
+
+// ensureBucket creates the bucket once, failures are retried on the next write
+func (s *Influx) ensureBucket(ctx context.Context) error {
+	if !s.createBucket {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ensured {
+		return nil
+	}
+
+	org, err := s.client.OrganizationsAPI().FindOrganizationByName(ctx, s.org)
+	if err != nil {
+		return fmt.Errorf("can't find InfluxDb org %s: %w", s.org, err)
+	}
+	// bucket names are unique only within an org
+	found, err := s.findBucket(ctx, *org.Id)
+	if err != nil {
+		return fmt.Errorf("can't find InfluxDb bucket %s: %w", s.bucket, err)
+	}
+	if !found {
+		var rule = domain.RetentionRule{Type: domain.RetentionRuleTypeExpire, EverySeconds: int64(s.retention.Seconds())}
+		if _, err := s.client.BucketsAPI().CreateBucketWithName(ctx, org, s.bucket, rule); err != nil {
+			return fmt.Errorf("can't create InfluxDb bucket %s: %w", s.bucket, err)
+		}
+		fmt.Println("created InfluxDb bucket: ", s.bucket, ", org: ", s.org, ", retention: ", s.retention)
+	}
+	s.ensured = true
+	return nil
+}
+
+// bucketsPage is the number of buckets listed at once, the API returns 20 by default
+const bucketsPage = 100
+
+// findBucket reports whether the bucket exists in the org
+func (s *Influx) findBucket(ctx context.Context, orgId string) (bool, error) {
+	for offset := 0; ; offset += bucketsPage {
+		buckets, err := s.client.BucketsAPI().FindBucketsByOrgID(ctx, orgId, api.PagingWithLimit(bucketsPage), api.PagingWithOffset(offset))
+		if err != nil {
+			return false, err
+		}
+		for _, bucket := range *buckets {
+			if bucket.Name == s.bucket {
+				return true, nil
+			}
+		}
+		if len(*buckets) < bucketsPage {
+			return false, nil
+		}
+	}
+}
+
+// Ping checks the server is reachable, it does not verify the token
+func (s *Influx) Ping(ctx context.Context) error {
+	ok, err := s.client.Ping(ctx)
+	if err == nil && !ok {
+		err = fmt.Errorf("unexpected ping response")
+	}
+	return err
+}
+
+func (s *Influx) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// errNoDeletionUser rejects deletions which would match the points of every user at the time
+var errNoDeletionUser = errors.New("deletion without user rejected, it would delete the points of every user")
+
+// predicate selects the point of the record, narrowed down to exact record when ids are written as tags
+func predicate(deletion transform.Deletion) string {
+	var predicate = fmt.Sprintf("_measurement=%q AND user=%q", deletion.Measurement, deletion.User)
+	if deletion.Id != "" {
+		predicate += fmt.Sprintf(" AND id=%q", deletion.Id)
+	}
+	return predicate
+}
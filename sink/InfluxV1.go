@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"io"
+	"net/http"
+	"net/url"
+	"ns-exporter/transform"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxV1 writes points to InfluxDB 1.x through its /write endpoint, into a database and retention policy.
+// Points keep the measurements, tags and fields of the v2 sink, so the same queries work on both.
+type InfluxV1 struct {
+	uri             string
+	database        string
+	retentionPolicy string
+	username        string
+	password        string
+	client          *http.Client
+
+	createDatabase bool
+	retention      time.Duration
+	mutex          sync.Mutex
+	ensured        bool
+}
+
+// NewInfluxV1 writes into the database, with the default retention policy when it is empty
+// and without authentication when the username is empty
+func NewInfluxV1(uri string, database string, retentionPolicy string, username string, password string) *InfluxV1 {
+	return &InfluxV1{
+		uri:             strings.TrimSuffix(uri, "/"),
+		database:        database,
+		retentionPolicy: retentionPolicy,
+		username:        username,
+		password:        password,
+		client:          &http.Client{},
+	}
+}
+
+// CreateDatabase makes the sink create its database before the first write when it does not exist,
+// with the retention period of its default policy or infinite retention when it is zero
+func (s *InfluxV1) CreateDatabase(retention time.Duration) *InfluxV1 {
+	s.createDatabase = true
+	s.retention = retention
+	return s
+}
+
+func (s *InfluxV1) Write(ctx context.Context, point *write.Point) error {
+	if err := s.ensureDatabase(ctx); err != nil {
+		return err
+	}
+	var params = url.Values{"db": {s.database}, "precision": {"ns"}}
+	if s.retentionPolicy != "" {
+		params.Set("rp", s.retentionPolicy)
+	}
+	var body = write.PointToLineProtocol(point, time.Nanosecond)
+	_, err := s.do(ctx, http.MethodPost, "/write?"+params.Encode(), "text/plain; charset=utf-8", strings.NewReader(body))
+	return err
+}
+
+func (s *InfluxV1) Delete(ctx context.Context, deletion transform.Deletion) error {
+	if deletion.User == "" {
+		return errNoDeletionUser
+	}
+	if err := s.ensureDatabase(ctx); err != nil {
+		return err
+	}
+	return s.query(ctx, influxqlDelete(deletion))
+}
+
+// ensureDatabase creates the database once, failures are retried on the next write
+func (s *InfluxV1) ensureDatabase(ctx context.Context) error {
+	if !s.createDatabase {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ensured {
+		return nil
+	}
+
+	// CREATE DATABASE fails when the database exists with another retention, so existing ones are left alone
+	data, err := s.do(ctx, http.MethodPost, "/query?"+url.Values{"q": {"SHOW DATABASES"}}.Encode(), "", nil)
+	if err != nil {
+		return fmt.Errorf("can't list InfluxDb databases: %w", err)
+	}
+	var result influxV1Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("can't list InfluxDb databases: %w", err)
+	}
+	if !result.contains(s.database) {
+		if err := s.query(ctx, influxqlCreateDatabase(s.database, s.retention)); err != nil {
+			return fmt.Errorf("can't create InfluxDb database %s: %w", s.database, err)
+		}
+		fmt.Println("created InfluxDb database: ", s.database, ", retention: ", s.retention)
+	}
+	s.ensured = true
+	return nil
+}
+
+// query runs an InfluxQL statement in the database, statement errors are reported in the response body
+func (s *InfluxV1) query(ctx context.Context, statement string) error {
+	var params = url.Values{"db": {s.database}, "q": {statement}}
+	data, err := s.do(ctx, http.MethodPost, "/query?"+params.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	var result influxV1Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("unexpected InfluxDb response: %w", err)
+	}
+	return result.err()
+}
+
+func (s *InfluxV1) do(ctx context.Context, method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.uri+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return influxResponse(s.client.Do(req))
+}
+
+// Ping checks the server is reachable, it does not verify the credentials
+func (s *InfluxV1) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, http.MethodGet, "/ping", "", nil)
+	return err
+}
+
+func (s *InfluxV1) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// influxV1Result is the response of the query endpoint, errors of statements are returned with status 200
+type influxV1Result struct {
+	Error   string `json:"error"`
+	Results []struct {
+		Error  string `json:"error"`
+		Series []struct {
+			Values [][]interface{} `json:"values"`
+		} `json:"series"`
+	} `json:"results"`
+}
+
+func (r influxV1Result) err() error {
+	if r.Error != "" {
+		return fmt.Errorf("InfluxDb error: %s", r.Error)
+	}
+	for _, result := range r.Results {
+		if result.Error != "" {
+			return fmt.Errorf("InfluxDb error: %s", result.Error)
+		}
+	}
+	return nil
+}
+
+// contains reports whether the first column of the series holds the name, as in SHOW DATABASES
+func (r influxV1Result) contains(name string) bool {
+	for _, result := range r.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				if len(values) > 0 && values[0] == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// influxResponse reads the body of a successful response, or the error message of a failed one
+func influxResponse(resp *http.Response, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &message) == nil && message.Error != "" {
+			return nil, fmt.Errorf("InfluxDb responded %s: %s", resp.Status, message.Error)
+		}
+		return nil, fmt.Errorf("InfluxDb responded %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// influxqlDelete selects the point of the record the same way the v2 predicate does
+func influxqlDelete(deletion transform.Deletion) string {
+	var statement = fmt.Sprintf("DELETE FROM %s WHERE time = %s AND %s = %s", influxqlIdentifier(deletion.Measurement),
+		influxqlString(deletion.Time.UTC().Format(time.RFC3339Nano)), influxqlIdentifier("user"), influxqlString(deletion.User))
+	if deletion.Id != "" {
+		statement += fmt.Sprintf(" AND %s = %s", influxqlIdentifier("id"), influxqlString(deletion.Id))
+	}
+	return statement
+}
+
+func influxqlCreateDatabase(database string, retention time.Duration) string {
+	var duration = "INF"
+	if retention > 0 {
+		duration = fmt.Sprintf("%ds", int64(retention.Seconds()))
+	}
+	return fmt.Sprintf("CREATE DATABASE %s WITH DURATION %s", influxqlIdentifier(database), duration)
+}
+
+func influxqlIdentifier(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+func influxqlString(value string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + `'`
+}
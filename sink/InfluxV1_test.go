@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/transform"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxV1(t *testing.T) {
+	var statements, lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "exporter" || password != "secret" {
+			t.Errorf("unexpected credentials %s %s", user, password)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/query":
+			var statement = r.URL.Query().Get("q")
+			statements = append(statements, statement)
+			if statement == "SHOW DATABASES" {
+				fmt.Fprint(w, `{"results": [{"series": [{"name": "databases", "columns": ["name"], "values": [["_internal"]]}]}]}`)
+			} else {
+				fmt.Fprint(w, `{"results": [{"statement_id": 0}]}`)
+			}
+		case "/write":
+			if r.URL.Query().Get("db") != "ns" || r.URL.Query().Get("rp") != "year" || r.URL.Query().Get("precision") != "ns" {
+				t.Errorf("unexpected write %s", r.URL)
+			}
+			data, _ := io.ReadAll(r.Body)
+			lines = append(lines, string(data))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	influx := NewInfluxV1(server.URL, "ns", "year", "exporter", "secret").CreateDatabase(30 * 24 * time.Hour)
+	defer influx.Close()
+	for i := 0; i < 2; i++ {
+		point := influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("carbs", 10).SetTime(at)
+		if err := influx.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := influx.Delete(ctx, transform.Deletion{Measurement: "treatments", User: "jo'hn", Id: "a", Time: at}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = []string{
+		"SHOW DATABASES",
+		`CREATE DATABASE "ns" WITH DURATION 2592000s`,
+		`DELETE FROM "treatments" WHERE time = '2022-06-08T06:00:00Z' AND "user" = 'jo\'hn' AND "id" = 'a'`,
+	}
+	if strings.Join(statements, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected statements\n%s", strings.Join(statements, "\n"))
+	}
+	if len(lines) != 2 || lines[0] != "treatments,user=john carbs=10i 1654668000000000000\n" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func TestInfluxV1Errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/write" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "database not found: \"ns\""}`)
+			return
+		}
+		fmt.Fprint(w, `{"results": [{"statement_id": 0, "error": "error parsing query"}]}`)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	influx := NewInfluxV1(server.URL, "ns", "", "", "")
+	point := influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("carbs", 10).SetTime(time.Now())
+	if err := influx.Write(ctx, point); err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := influx.Delete(ctx, transform.Deletion{Measurement: "treatments", User: "john", Time: time.Now()}); err == nil || !strings.Contains(err.Error(), "error parsing query") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := influx.Delete(ctx, transform.Deletion{Measurement: "treatments", Time: time.Now()}); err != errNoDeletionUser {
+		t.Errorf("deletion without user not rejected: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"net/http"
+	"net/url"
+	"ns-exporter/transform"
+	"strings"
+	"time"
+)
+
+// ErrInfluxV3Delete is returned for deletions, InfluxDB 3 does not delete single points
+var ErrInfluxV3Delete = errors.New("InfluxDB 3 can't delete points")
+
+// InfluxV3 writes points to InfluxDB 3 through its write_lp endpoint, the database is created by the first write.
+// Points keep the measurements, tags and fields of the v2 sink.
+type InfluxV3 struct {
+	uri      string
+	token    string
+	database string
+	client   *http.Client
+}
+
+func NewInfluxV3(uri string, token string, database string) *InfluxV3 {
+	return &InfluxV3{uri: strings.TrimSuffix(uri, "/"), token: token, database: database, client: &http.Client{}}
+}
+
+func (s *InfluxV3) Write(ctx context.Context, point *write.Point) error {
+	var params = url.Values{"db": {s.database}, "precision": {"nanosecond"}}
+	var body = write.PointToLineProtocol(point, time.Nanosecond)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.uri+"/api/v3/write_lp?"+params.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	_, err = influxResponse(s.client.Do(req))
+	return err
+}
+
+func (s *InfluxV3) Delete(context.Context, transform.Deletion) error {
+	return ErrInfluxV3Delete
+}
+
+// Ping checks the server is reachable
+func (s *InfluxV3) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.uri+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	_, err = influxResponse(s.client.Do(req))
+	return err
+}
+
+func (s *InfluxV3) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
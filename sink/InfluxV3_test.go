@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/transform"
+	"testing"
+	"time"
+)
+
+func TestInfluxV3(t *testing.T) {
+	var lines []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected authorization %s", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/ping":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v3/write_lp":
+			if r.URL.Query().Get("db") != "ns-john" || r.URL.Query().Get("precision") != "nanosecond" {
+				t.Errorf("unexpected write %s", r.URL)
+			}
+			data, _ := io.ReadAll(r.Body)
+			lines = append(lines, string(data))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	influx := NewInfluxV3(server.URL+"/", "token", "ns-john")
+	defer influx.Close()
+	if err := influx.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	point := influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("type", "sgv").AddField("sgv", 120).SetTime(at)
+	if err := influx.Write(ctx, point); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != "entries,user=john,type=sgv sgv=120i 1654668000000000000\n" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	if err := influx.Delete(ctx, transform.Deletion{Measurement: "entries", Time: at}); !errors.Is(err, ErrInfluxV3Delete) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
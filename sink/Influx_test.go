@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/transform"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxDeletePredicate(t *testing.T) {
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	var cases = map[string]transform.Deletion{
+		`_measurement="openaps" AND user="test"`:                  {Measurement: "openaps", User: "test", Time: at},
+		`_measurement="treatments" AND user="test" AND id="a\"b"`: {Measurement: "treatments", User: "test", Id: `a"b`, Time: at},
+	}
+	for expected, deletion := range cases {
+		if actual := predicate(deletion); actual != expected {
+			t.Errorf("predicate %s, expected %s", actual, expected)
+		}
+	}
+
+	// no request is sent for a deletion without user
+	influx := NewInflux("http://localhost:1", "token", "ns", "ns")
+	defer influx.Close()
+	if err := influx.Delete(context.Background(), transform.Deletion{Measurement: "treatments", Time: at}); err != errNoDeletionUser {
+		t.Errorf("deletion without user not rejected: %v", err)
+	}
+}
+
+func TestInfluxCreatesMissingBucket(t *testing.T) {
+	var created map[string]interface{}
+	var creations = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/orgs":
+			fmt.Fprint(w, `{"orgs": [{"id": "org1", "name": "ns"}]}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/buckets":
+			// a bucket of the same name in another org does not count
+			if r.URL.Query().Get("orgID") != "org1" {
+				fmt.Fprint(w, `{"buckets": [{"id": "b0", "orgID": "org0", "name": "ns-john"}]}`)
+				return
+			}
+			// the buckets of the org are listed page by page
+			var buckets []string
+			if offset, _ := strconv.Atoi(r.URL.Query().Get("offset")); offset == 0 {
+				for i := 0; i < bucketsPage; i++ {
+					buckets = append(buckets, fmt.Sprintf(`{"id": "o%d", "orgID": "org1", "name": "other-%d"}`, i, i))
+				}
+			}
+			fmt.Fprintf(w, `{"buckets": [%s]}`, strings.Join(buckets, ","))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/buckets":
+			creations++
+			if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"id": "b1", "orgID": "org1", "name": "ns-john"}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/write":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	influx := NewInflux(server.URL, "token", "ns", "ns-john").CreateBucket(30 * 24 * time.Hour)
+	defer influx.Close()
+	for i := 0; i < 2; i++ {
+		point := influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("carbs", 10).SetTime(time.Now())
+		if err := influx.Write(context.Background(), point); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if creations != 1 || created["orgID"] != "org1" || created["name"] != "ns-john" {
+		t.Fatalf("unexpected bucket created: %v", created)
+	}
+	rules, _ := created["retentionRules"].([]interface{})
+	if len(rules) != 1 || rules[0].(map[string]interface{})["everySeconds"] != float64(30*24*3600) {
+		t.Errorf("unexpected retention rules: %v", created["retentionRules"])
+	}
+}
@@ -0,0 +1,292 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMQTTTopic is where the values are published, {user} and {name} are replaced with the user and the sensor name
+	DefaultMQTTTopic = "ns/{user}/{name}"
+	// DefaultMQTTDiscoveryPrefix is the topic prefix Home Assistant listens for discovery payloads on
+	DefaultMQTTDiscoveryPrefix = "homeassistant"
+	mqttTreatment              = "treatment"
+)
+
+// mqttSensor is a value published to its own topic, announced to Home Assistant as a sensor
+type mqttSensor struct {
+	title string
+	unit  string
+}
+
+var mqttSensors = map[string]mqttSensor{
+	"bg":          {"BG", "mg/dL"},
+	"iob":         {"IOB", "U"},
+	"cob":         {"COB", "g"},
+	"basal":       {"Basal", "U/h"},
+	mqttTreatment: {"Last treatment", ""},
+}
+
+// mqttValues are the sensors of the fields, by measurement and field. The BG the loop decided on stands in
+// for the sensor glucose, entries are not exported by default.
+var mqttValues = map[string]map[string]string{
+	"entries": {"sgv": "bg"},
+	"openaps": {"bg": "bg", "iob": "iob", "cob": "cob", "tbs_rate": "basal"},
+}
+
+// mqttMessage is a JSON payload waiting to be published
+type mqttMessage struct {
+	user    string
+	sensor  string
+	time    time.Time
+	payload map[string]interface{}
+	// standIn values are replaced by the ones of entries, whatever their time
+	standIn bool
+}
+
+// MQTT publishes the latest glucose and loop values of every user as retained JSON messages, so displays
+// subscribing later get them too, and the treatments newer than the ones published before.
+// Messages are collected and published on Flush, so a run publishes only the newest value of every sensor
+// whatever the order the records are read in. Deletions are ignored.
+type MQTT struct {
+	client    mqtt.Client
+	topic     string
+	discovery string
+
+	mutex      sync.Mutex
+	latest     map[string]mqttMessage
+	treatments map[string][]mqttMessage
+	published  map[string]time.Time
+	announced  map[string]bool
+}
+
+// NewMQTT publishes to the broker uri, e.g. tcp://mqtt:1883, with the topic template, DefaultMQTTTopic when empty.
+// The connection is made on first use.
+func NewMQTT(uri string, username string, password string, topic string) *MQTT {
+	if topic == "" {
+		topic = DefaultMQTTTopic
+	}
+	var options = mqtt.NewClientOptions().
+		AddBroker(uri).
+		SetClientID(fmt.Sprintf("ns-exporter-%d", time.Now().UnixNano())).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true)
+	return &MQTT{
+		client:     mqtt.NewClient(options),
+		topic:      topic,
+		latest:     map[string]mqttMessage{},
+		treatments: map[string][]mqttMessage{},
+		published:  map[string]time.Time{},
+		announced:  map[string]bool{},
+	}
+}
+
+// Discovery makes the sink publish Home Assistant discovery payloads under the prefix before the first value
+// of every sensor, so the sensors appear without configuration
+func (s *MQTT) Discovery(prefix string) *MQTT {
+	if prefix == "" {
+		prefix = DefaultMQTTDiscoveryPrefix
+	}
+	s.discovery = prefix
+	return s
+}
+
+func (s *MQTT) Write(_ context.Context, point *write.Point) error {
+	var values = map[string]interface{}{}
+	var user string
+	for _, tag := range point.TagList() {
+		if tag.Key == "user" {
+			user = tag.Value
+		} else {
+			values[tag.Key] = tag.Value
+		}
+	}
+	for _, field := range point.FieldList() {
+		values[field.Key] = field.Value
+	}
+	var at = point.Time().UTC()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if point.Name() == "treatments" {
+		values["time"] = at.Format(time.RFC3339)
+		delete(values, "id")
+		if at.After(s.published[s.topicOf(user, mqttTreatment)]) {
+			s.treatments[user] = append(s.treatments[user], mqttMessage{user: user, sensor: mqttTreatment, time: at, payload: values})
+		}
+		return nil
+	}
+	for field, sensor := range mqttValues[point.Name()] {
+		value, ok := values[field]
+		if !ok {
+			continue
+		}
+		var payload = map[string]interface{}{"value": value, "time": at.Format(time.RFC3339)}
+		if direction, ok := values["direction"]; ok && sensor == "bg" {
+			payload["direction"] = direction
+		}
+		var topic = s.topicOf(user, sensor)
+		var standIn = sensor == "bg" && point.Name() != "entries"
+		var latest, exists = s.latest[topic]
+		var newer = at.After(latest.time)
+		if exists && latest.standIn != standIn {
+			newer = latest.standIn
+		}
+		if newer && at.After(s.published[topic]) {
+			s.latest[topic] = mqttMessage{user: user, sensor: sensor, time: at, payload: payload, standIn: standIn}
+		}
+	}
+	return nil
+}
+
+// Delete does nothing, published values are replaced by newer ones
+func (s *MQTT) Delete(context.Context, transform.Deletion) error {
+	return nil
+}
+
+// Flush publishes the latest value of every sensor and the new treatments, oldest first.
+// Before the first treatment of a user is published only the newest one is, so backfills don't replay history.
+func (s *MQTT) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var messages []mqttMessage
+	for _, message := range s.latest {
+		messages = append(messages, message)
+	}
+	for user, treatments := range s.treatments {
+		sort.Slice(treatments, func(i, j int) bool { return treatments[i].time.Before(treatments[j].time) })
+		if s.published[s.topicOf(user, mqttTreatment)].IsZero() {
+			treatments = treatments[len(treatments)-1:]
+		}
+		messages = append(messages, treatments...)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].time.Before(messages[j].time) })
+	if err := s.connect(ctx); err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if err := s.publish(ctx, message); err != nil {
+			return err
+		}
+	}
+	fmt.Println("published MQTT messages: ", len(messages))
+	s.latest = map[string]mqttMessage{}
+	s.treatments = map[string][]mqttMessage{}
+	return nil
+}
+
+func (s *MQTT) publish(ctx context.Context, message mqttMessage) error {
+	var topic = s.topicOf(message.user, message.sensor)
+	if s.discovery != "" && !s.announced[topic] {
+		config, payload := s.discoveryPayload(message.user, message.sensor, topic)
+		if err := s.send(ctx, config, payload); err != nil {
+			return err
+		}
+		s.announced[topic] = true
+	}
+	payload, err := json.Marshal(message.payload)
+	if err != nil {
+		return err
+	}
+	if err := s.send(ctx, topic, payload); err != nil {
+		return err
+	}
+	s.published[topic] = message.time
+	return nil
+}
+
+// send publishes a retained message with QoS 1
+func (s *MQTT) send(ctx context.Context, topic string, payload []byte) error {
+	if err := waitMQTT(ctx, s.client.Publish(topic, 1, true, payload)); err != nil {
+		return fmt.Errorf("can't publish to MQTT topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// discoveryPayload returns the config topic and payload of the Home Assistant sensor reading the topic,
+// sensors of a user are grouped into one device
+func (s *MQTT) discoveryPayload(user string, sensor string, topic string) (string, []byte) {
+	var node = "ns_exporter_" + mqttId(user)
+	var config = map[string]interface{}{
+		"name":                  mqttSensors[sensor].title,
+		"unique_id":             node + "_" + sensor,
+		"state_topic":           topic,
+		"json_attributes_topic": topic,
+		"value_template":        "{{ value_json.value }}",
+		"device": map[string]interface{}{
+			"identifiers":  []string{node},
+			"name":         "Nightscout " + user,
+			"manufacturer": "ns-exporter",
+		},
+	}
+	if sensor == mqttTreatment {
+		config["value_template"] = "{{ value_json.type }}"
+	} else {
+		config["unit_of_measurement"] = mqttSensors[sensor].unit
+		config["state_class"] = "measurement"
+	}
+	payload, _ := json.Marshal(config)
+	return fmt.Sprintf("%s/sensor/%s/%s/config", s.discovery, node, sensor), payload
+}
+
+// topicOf fills the template, wildcards and separators in the user name are replaced
+func (s *MQTT) topicOf(user string, sensor string) string {
+	var replacer = strings.NewReplacer("{user}", strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(user), "{name}", sensor)
+	return replacer.Replace(s.topic)
+}
+
+var mqttIdPattern = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mqttId makes a name usable in Home Assistant ids and discovery topics
+func mqttId(name string) string {
+	return mqttIdPattern.ReplaceAllString(name, "_")
+}
+
+func (s *MQTT) connect(ctx context.Context) error {
+	if s.client.IsConnected() {
+		return nil
+	}
+	if err := waitMQTT(ctx, s.client.Connect()); err != nil {
+		return fmt.Errorf("can't connect to MQTT broker: %w", err)
+	}
+	return nil
+}
+
+// waitMQTT waits for the operation to complete, or the context to be done
+func waitMQTT(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping connects to the broker, which checks the credentials too
+func (s *MQTT) Ping(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.connect(ctx)
+}
+
+// Close publishes the collected messages and disconnects
+func (s *MQTT) Close() error {
+	var err = s.Flush(context.Background())
+	if s.client.IsConnected() {
+		s.client.Disconnect(250)
+	}
+	return err
+}
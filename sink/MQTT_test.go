@@ -0,0 +1,132 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/internal/mqtttest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTT(t *testing.T) {
+	broker := mqtttest.NewBroker(t, "display", "secret")
+	ctx := context.Background()
+	publisher := NewMQTT(broker.URL, "display", "secret", "").Discovery("")
+	if err := publisher.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	var points = []*write.Point{
+		// newest first, as the sources read them
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("type", "sgv").AddField("sgv", 125).AddField("direction", "FortyFiveUp").SetTime(at.Add(5 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("type", "sgv").AddField("sgv", 120).AddField("direction", "Flat").SetTime(at),
+		influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("iob", 1.5).AddField("cob", 20.0).SetTime(at),
+		// the BG of the loop only stands in for entries
+		influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("bg", 140.0).SetTime(at.Add(7 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("id", "b").AddTag("type", "SMB").AddField("bolus", 0.3).SetTime(at.Add(time.Minute)),
+		influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("id", "a").AddTag("type", "carbs").AddField("carbs", 20).SetTime(at),
+	}
+	for _, point := range points {
+		if err := publisher.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a new treatment and an older value are published in the next run, only the treatment is new
+	for _, point := range []*write.Point{
+		influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("type", "tbs").AddField("rate", 0.5).SetTime(at.Add(10 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("type", "sgv").AddField("sgv", 110).SetTime(at.Add(-5 * time.Minute)),
+	} {
+		if err := publisher.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var retained = broker.Retained()
+	var expected = map[string]string{
+		"ns/john/bg":        `{"direction":"FortyFiveUp","time":"2022-06-08T06:05:00Z","value":125}`,
+		"ns/john/iob":       `{"time":"2022-06-08T06:00:00Z","value":1.5}`,
+		"ns/john/cob":       `{"time":"2022-06-08T06:00:00Z","value":20}`,
+		"ns/john/treatment": `{"rate":0.5,"time":"2022-06-08T06:10:00Z","type":"tbs"}`,
+	}
+	for topic, payload := range expected {
+		if retained[topic] != payload {
+			t.Errorf("%s: %s, expected %s", topic, retained[topic], payload)
+		}
+	}
+
+	var treatments, bgs int
+	for _, message := range broker.Messages() {
+		switch message.Topic {
+		case "ns/john/treatment":
+			treatments++
+		case "ns/john/bg":
+			bgs++
+		}
+	}
+	// the first run publishes only the newest treatment
+	if treatments != 2 || bgs != 1 {
+		t.Errorf("unexpected messages %d treatments, %d bg", treatments, bgs)
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(retained["homeassistant/sensor/ns_exporter_john/bg/config"]), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["state_topic"] != "ns/john/bg" || config["unit_of_measurement"] != "mg/dL" || config["unique_id"] != "ns_exporter_john_bg" {
+		t.Errorf("unexpected discovery %v", config)
+	}
+	if !strings.Contains(retained["homeassistant/sensor/ns_exporter_john/treatment/config"], `"value_template":"{{ value_json.type }}"`) {
+		t.Errorf("unexpected treatment discovery %s", retained["homeassistant/sensor/ns_exporter_john/treatment/config"])
+	}
+}
+
+// TestMQTTDeviceStatusOnly publishes the BG of the loop, entries are not exported by default
+func TestMQTTDeviceStatusOnly(t *testing.T) {
+	broker := mqtttest.NewBroker(t, "", "")
+	ctx := context.Background()
+	publisher := NewMQTT(broker.URL, "", "", "")
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	for _, point := range []*write.Point{
+		influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("bg", 140.0).AddField("iob", 1.5).SetTime(at.Add(5 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("bg", 130.0).AddField("iob", 1.2).SetTime(at),
+	} {
+		if err := publisher.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bg := broker.Retained()["ns/john/bg"]; bg != `{"time":"2022-06-08T06:05:00Z","value":140}` {
+		t.Errorf("unexpected bg %s", bg)
+	}
+}
+
+func TestMQTTTopics(t *testing.T) {
+	publisher := NewMQTT("tcp://localhost:1883", "", "", "home/{name}/{user}")
+	if topic := publisher.topicOf("jo/hn+#", "bg"); topic != "home/bg/jo_hn__" {
+		t.Errorf("unexpected topic %s", topic)
+	}
+	if id := mqttId("john.doe@example"); id != "john_doe_example" {
+		t.Errorf("unexpected id %s", id)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	broker := mqtttest.NewBroker(t, "display", "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := NewMQTT(broker.URL, "display", "wrong", "").Ping(ctx); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
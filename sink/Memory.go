@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"context"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory keeps points as line protocol, for dry runs and tests
+type Memory struct {
+	mutex     sync.Mutex
+	lines     []string
+	deletions []transform.Deletion
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (s *Memory) Write(_ context.Context, point *write.Point) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lines = append(s.lines, strings.TrimSuffix(write.PointToLineProtocol(point, time.Nanosecond), "\n"))
+	return nil
+}
+
+func (s *Memory) Delete(_ context.Context, deletion transform.Deletion) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deletions = append(s.deletions, deletion)
+	return nil
+}
+
+func (s *Memory) Close() error {
+	return nil
+}
+
+// Lines returns the written points in line protocol, in order of writing
+func (s *Memory) Lines() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func (s *Memory) Deletions() []transform.Deletion {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]transform.Deletion(nil), s.deletions...)
+}
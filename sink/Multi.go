@@ -0,0 +1,67 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+	"strings"
+)
+
+// Multi writes every point and deletion to all of its sinks, e.g. to both InfluxDb and PostgreSQL.
+// A failure of one sink does not keep the point from the others.
+type Multi struct {
+	sinks []Sink
+}
+
+func NewMulti(sinks ...Sink) *Multi {
+	return &Multi{sinks: sinks}
+}
+
+func (s *Multi) Write(ctx context.Context, point *write.Point) error {
+	var errs []error
+	for _, target := range s.sinks {
+		if err := target.Write(ctx, point); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (s *Multi) Delete(ctx context.Context, deletion transform.Deletion) error {
+	var errs []error
+	for _, target := range s.sinks {
+		if err := target.Delete(ctx, deletion); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (s *Multi) Flush(ctx context.Context) error {
+	var errs []error
+	for _, target := range s.sinks {
+		if flusher, ok := target.(Flusher); ok {
+			if err := flusher.Flush(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return joinErrors(errs)
+}
+
+// Close leaves the sinks open, they may be shared with other imports
+func (s *Multi) Close() error {
+	return nil
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,19 @@
+package sink
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"testing"
+	"time"
+)
+
+func TestMultiWritesAllSinks(t *testing.T) {
+	first, second := NewMemory(), NewMemory()
+	multi := NewMulti(first, NewTenant(second, "jane"))
+	point := influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("carbs", 10).SetTime(time.Unix(0, 0))
+
+	// the point rejected by the guarded sink is still written to the other one
+	if err := multi.Write(context.Background(), point); err == nil || len(first.Lines()) != 1 || len(second.Lines()) != 0 {
+		t.Errorf("unexpected error %v, lines %v and %v", err, first.Lines(), second.Lines())
+	}
+}
@@ -0,0 +1,249 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	collector "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	metrics "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"ns-exporter/transform"
+	"sort"
+	"sync"
+)
+
+const (
+	OTLPGrpc = "grpc"
+	OTLPHttp = "http"
+	// OTLPMetricsPath is where OTLP/HTTP receivers take metrics, added to endpoints without a path
+	OTLPMetricsPath = "/v1/metrics"
+	otlpBatch       = 1000
+)
+
+// otlpMetric is the gauge a field of a measurement is emitted as
+type otlpMetric struct {
+	name string
+	unit string
+}
+
+// otlpMetrics are the fields emitted as gauges, by measurement and field
+var otlpMetrics = map[string]map[string]otlpMetric{
+	"entries": {
+		"sgv": {"nightscout.glucose", "mg/dL"},
+		"mbg": {"nightscout.glucose", "mg/dL"},
+	},
+	"openaps": {
+		"iob":      {"nightscout.iob", "U"},
+		"cob":      {"nightscout.cob", "g"},
+		"tbs_rate": {"nightscout.basal", "U/h"},
+	},
+	"treatments": {
+		"rate":  {"nightscout.basal", "U/h"},
+		"bolus": {"nightscout.bolus", "U"},
+	},
+}
+
+// OTLP emits glucose, insulin and carbs on board, basal rates and boluses as OTLP gauges, so they can be sent
+// to any backend an OpenTelemetry collector exports to. Data points have the user and type attributes, type is
+// the type tag of the point or its collection. Other fields are not emitted and deletions are ignored,
+// as metrics can't be retracted. Data points are buffered and exported in batches, Flush exports the rest.
+type OTLP struct {
+	endpoint string
+	headers  map[string]string
+	export   func(ctx context.Context, request *collector.ExportMetricsServiceRequest) error
+	close    func() error
+
+	mutex   sync.Mutex
+	pending map[otlpMetric][]*metrics.NumberDataPoint
+	count   int
+}
+
+// NewOTLP exports to the endpoint with the protocol, grpc or http. The scheme of the endpoint url selects
+// TLS, e.g. http://collector:4317 for plain gRPC or https://collector:4318 for OTLP/HTTP over TLS.
+// Headers are sent with every export, e.g. for authentication.
+func NewOTLP(endpoint string, protocol string, headers map[string]string) (*OTLP, error) {
+	uri, err := url.Parse(endpoint)
+	if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected http:// or https:// url", endpoint)
+	}
+	var s = &OTLP{endpoint: endpoint, headers: headers, pending: map[otlpMetric][]*metrics.NumberDataPoint{}}
+	switch protocol {
+	case OTLPGrpc:
+		var creds = insecure.NewCredentials()
+		if uri.Scheme == "https" {
+			creds = credentials.NewTLS(&tls.Config{})
+		}
+		conn, err := grpc.Dial(uri.Host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		var client = collector.NewMetricsServiceClient(conn)
+		s.export = func(ctx context.Context, request *collector.ExportMetricsServiceRequest) error {
+			for name, value := range s.headers {
+				ctx = metadata.AppendToOutgoingContext(ctx, name, value)
+			}
+			_, err := client.Export(ctx, request)
+			return err
+		}
+		s.close = conn.Close
+	case OTLPHttp:
+		if uri.Path == "" || uri.Path == "/" {
+			uri.Path = OTLPMetricsPath
+		}
+		var client = &http.Client{}
+		s.export = func(ctx context.Context, request *collector.ExportMetricsServiceRequest) error {
+			return s.post(ctx, client, uri.String(), request)
+		}
+		s.close = func() error {
+			client.CloseIdleConnections()
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, expected %s or %s", protocol, OTLPGrpc, OTLPHttp)
+	}
+	return s, nil
+}
+
+func (s *OTLP) Write(ctx context.Context, point *write.Point) error {
+	var fields = otlpMetrics[point.Name()]
+	if len(fields) == 0 {
+		return nil
+	}
+	var user, kind string
+	for _, tag := range point.TagList() {
+		switch tag.Key {
+		case "user":
+			user = tag.Value
+		case "type":
+			kind = tag.Value
+		}
+	}
+	if kind == "" {
+		kind = sqlTables[point.Name()].name
+	}
+	var attributes = []*common.KeyValue{otlpAttribute("user", user), otlpAttribute("type", kind)}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, field := range point.FieldList() {
+		metric, ok := fields[field.Key]
+		if !ok {
+			continue
+		}
+		var dataPoint = &metrics.NumberDataPoint{Attributes: attributes, TimeUnixNano: uint64(point.Time().UnixNano())}
+		switch value := field.Value.(type) {
+		case float64:
+			dataPoint.Value = &metrics.NumberDataPoint_AsDouble{AsDouble: value}
+		case int64:
+			dataPoint.Value = &metrics.NumberDataPoint_AsInt{AsInt: value}
+		case uint64:
+			dataPoint.Value = &metrics.NumberDataPoint_AsInt{AsInt: int64(value)}
+		default:
+			continue
+		}
+		s.pending[metric] = append(s.pending[metric], dataPoint)
+		s.count++
+	}
+	if s.count < otlpBatch {
+		return nil
+	}
+	return s.flush(ctx)
+}
+
+// Delete does nothing, exported metrics can't be retracted
+func (s *OTLP) Delete(context.Context, transform.Deletion) error {
+	return nil
+}
+
+// Flush exports the buffered data points
+func (s *OTLP) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flush(ctx)
+}
+
+// flush exports the pending data points in one request, they are kept pending when it fails
+func (s *OTLP) flush(ctx context.Context) error {
+	if s.count == 0 {
+		return nil
+	}
+	if err := s.export(ctx, s.request()); err != nil {
+		return fmt.Errorf("can't export metrics to %s: %w", s.endpoint, err)
+	}
+	fmt.Println("exported data points to OTLP: ", s.count)
+	s.pending = map[otlpMetric][]*metrics.NumberDataPoint{}
+	s.count = 0
+	return nil
+}
+
+// request holds a gauge of every metric with pending data points, ordered by name
+func (s *OTLP) request() *collector.ExportMetricsServiceRequest {
+	var gauges []*metrics.Metric
+	for metric, dataPoints := range s.pending {
+		gauges = append(gauges, &metrics.Metric{
+			Name: metric.name,
+			Unit: metric.unit,
+			Data: &metrics.Metric_Gauge{Gauge: &metrics.Gauge{DataPoints: dataPoints}},
+		})
+	}
+	sort.Slice(gauges, func(i, j int) bool { return gauges[i].Name < gauges[j].Name })
+	return &collector.ExportMetricsServiceRequest{ResourceMetrics: []*metrics.ResourceMetrics{{
+		Resource:     &resource.Resource{Attributes: []*common.KeyValue{otlpAttribute("service.name", "ns-exporter")}},
+		ScopeMetrics: []*metrics.ScopeMetrics{{Scope: &common.InstrumentationScope{Name: "ns-exporter"}, Metrics: gauges}},
+	}}}
+}
+
+// post sends the request as OTLP/HTTP binary protobuf
+func (s *OTLP) post(ctx context.Context, client *http.Client, uri string, request *collector.ExportMetricsServiceRequest) error {
+	data, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("receiver responded %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Ping exports an empty request, which receivers accept without storing anything
+func (s *OTLP) Ping(ctx context.Context) error {
+	return s.export(ctx, &collector.ExportMetricsServiceRequest{})
+}
+
+// Close exports the buffered data points and closes the connection
+func (s *OTLP) Close() error {
+	var err = s.Flush(context.Background())
+	if closeErr := s.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func otlpAttribute(key string, value string) *common.KeyValue {
+	return &common.KeyValue{Key: key, Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}}}
+}
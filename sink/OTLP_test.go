@@ -0,0 +1,168 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	collector "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"ns-exporter/transform"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpReceiver is a fake collector keeping the exported requests and the authorization header
+type otlpReceiver struct {
+	collector.UnimplementedMetricsServiceServer
+	mutex         sync.Mutex
+	requests      []*collector.ExportMetricsServiceRequest
+	authorization string
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, request *collector.ExportMetricsServiceRequest) (*collector.ExportMetricsServiceResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = append(r.requests, request)
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		r.authorization = md.Get("authorization")[0]
+	}
+	return &collector.ExportMetricsServiceResponse{}, nil
+}
+
+// dataPoints lists the received data points as "name[unit] attributes value", sorted
+func (r *otlpReceiver) dataPoints() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var lines []string
+	for _, request := range r.requests {
+		for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			for _, point := range metric.GetGauge().DataPoints {
+				var attributes []string
+				for _, attribute := range point.Attributes {
+					attributes = append(attributes, attribute.Key+"="+attribute.Value.GetStringValue())
+				}
+				var value interface{} = point.GetAsDouble()
+				if point.GetAsInt() != 0 {
+					value = point.GetAsInt()
+				}
+				lines = append(lines, fmt.Sprintf("%s[%s] %s %v %d", metric.Name, metric.Unit, strings.Join(attributes, ","), value, point.TimeUnixNano))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+var otlpAt = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+
+var otlpPoints = []*write.Point{
+	influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("type", "sgv").AddField("sgv", 120).AddField("direction", "Flat").SetTime(otlpAt),
+	influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("iob", 1.5).AddField("cob", 20.0).AddField("bg", 120.0).SetTime(otlpAt),
+	influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("type", "SMB").AddField("bolus", 0.3).SetTime(otlpAt),
+	influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("type", "tbs").AddField("rate", 1.2).AddField("duration", 30).SetTime(otlpAt),
+	influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("notes", "Site Change").SetTime(otlpAt),
+}
+
+var otlpExpected = []string{
+	"nightscout.basal[U/h] user=john,type=tbs 1.2 1654668000000000000",
+	"nightscout.bolus[U] user=john,type=SMB 0.3 1654668000000000000",
+	"nightscout.cob[g] user=john,type=devicestatus 20 1654668000000000000",
+	"nightscout.glucose[mg/dL] user=john,type=sgv 120 1654668000000000000",
+	"nightscout.iob[U] user=john,type=devicestatus 1.5 1654668000000000000",
+}
+
+func writeOTLP(t *testing.T, otlp *OTLP) {
+	ctx := context.Background()
+	for _, point := range otlpPoints {
+		if err := otlp.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := otlp.Delete(ctx, transform.Deletion{Measurement: "entries", User: "john", Time: otlpAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := otlp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOTLPGrpc(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receiver = &otlpReceiver{}
+	server := grpc.NewServer()
+	collector.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	otlp, err := NewOTLP("http://"+listener.Addr().String(), OTLPGrpc, map[string]string{"authorization": "Bearer token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeOTLP(t, otlp)
+
+	if actual := receiver.dataPoints(); strings.Join(actual, "\n") != strings.Join(otlpExpected, "\n") {
+		t.Errorf("unexpected data points\n%s", strings.Join(actual, "\n"))
+	}
+	if len(receiver.requests) != 1 || receiver.authorization != "Bearer token" {
+		t.Errorf("unexpected requests %d, authorization %q", len(receiver.requests), receiver.authorization)
+	}
+	var service = receiver.requests[0].ResourceMetrics[0].Resource.Attributes[0]
+	if service.Key != "service.name" || service.Value.GetStringValue() != "ns-exporter" {
+		t.Errorf("unexpected resource %v", service)
+	}
+}
+
+func TestOTLPHttp(t *testing.T) {
+	var receiver = &otlpReceiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != OTLPMetricsPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected request %s %s", r.URL, r.Header.Get("Content-Type"))
+		}
+		data, _ := io.ReadAll(r.Body)
+		var request collector.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(data, &request); err != nil {
+			t.Error(err)
+		}
+		receiver.requests = append(receiver.requests, &request)
+		receiver.authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	otlp, err := NewOTLP(server.URL, OTLPHttp, map[string]string{"Authorization": "Bearer token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeOTLP(t, otlp)
+
+	if actual := receiver.dataPoints(); strings.Join(actual, "\n") != strings.Join(otlpExpected, "\n") {
+		t.Errorf("unexpected data points\n%s", strings.Join(actual, "\n"))
+	}
+	if receiver.authorization != "Bearer token" {
+		t.Errorf("unexpected authorization %q", receiver.authorization)
+	}
+}
+
+func TestOTLPSettings(t *testing.T) {
+	for _, endpoint := range []string{"collector:4317", "ftp://collector", "http://"} {
+		if _, err := NewOTLP(endpoint, OTLPGrpc, nil); err == nil {
+			t.Errorf("endpoint %s accepted", endpoint)
+		}
+	}
+	if _, err := NewOTLP("http://collector:4318", "thrift", nil); err == nil {
+		t.Error("unknown protocol accepted")
+	}
+}
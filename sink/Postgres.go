@@ -0,0 +1,214 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"ns-exporter/transform"
+	"strings"
+	"sync"
+)
+
+// DefaultPostgresBatch is the number of rows of a table copied at once
+const DefaultPostgresBatch = 1000
+
+// Postgres writes points into typed tables, one per collection, updating the rows of records written again.
+// Rows are buffered and copied in batches, Flush writes the rest.
+type Postgres struct {
+	pool      *pgxpool.Pool
+	timescale bool
+	batch     int
+
+	mutex   sync.Mutex
+	ensured bool
+	pending pendingRows
+}
+
+// NewPostgres prepares the connection pool, connections are made on first use
+func NewPostgres(uri string) (*Postgres, error) {
+	config, err := pgxpool.ParseConfig(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PostgreSQL uri: %w", err)
+	}
+	config.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	return &Postgres{pool: pool, batch: DefaultPostgresBatch, pending: pendingRows{}}, nil
+}
+
+// Timescale makes the sink turn its tables into TimescaleDB hypertables when it creates them,
+// the timescaledb extension has to be installed in the database
+func (s *Postgres) Timescale() *Postgres {
+	s.timescale = true
+	return s
+}
+
+// Batch sets the number of rows of a table buffered before they are copied, 1 writes every point at once
+func (s *Postgres) Batch(size int) *Postgres {
+	if size > 0 {
+		s.batch = size
+	}
+	return s
+}
+
+func (s *Postgres) Write(ctx context.Context, point *write.Point) error {
+	table, ok := sqlTables[point.Name()]
+	if !ok {
+		return fmt.Errorf("no PostgreSQL table for measurement %s", point.Name())
+	}
+	key, row, err := table.row(point)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending.add(table.name, key, row) < s.batch {
+		return nil
+	}
+	return s.flush(ctx, table)
+}
+
+// Delete removes the row of the record, or every row of the user at the time when ids are not written as tags
+func (s *Postgres) Delete(ctx context.Context, deletion transform.Deletion) error {
+	table, ok := sqlTables[deletion.Measurement]
+	if !ok {
+		return fmt.Errorf("no PostgreSQL table for measurement %s", deletion.Measurement)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// pending rows are written first, so the deletion applies to them too
+	if err := s.flush(ctx, table); err != nil {
+		return err
+	}
+	query, args := table.postgresDelete(deletion)
+	_, err := s.pool.Exec(ctx, query, args...)
+	return err
+}
+
+// Flush writes the buffered rows of every table
+func (s *Postgres) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range sqlMeasurements() {
+		if err := s.flush(ctx, sqlTables[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush copies the pending rows of the table into a temporary table and upserts them from there,
+// as COPY itself can't update existing rows. Rows are kept pending when it fails.
+func (s *Postgres) flush(ctx context.Context, table sqlTable) error {
+	var rows = s.pending.rows(table.name)
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := s.ensureTables(ctx); err != nil {
+		return err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var staging = "ns_exporter_" + table.name
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pgx.Identifier{staging}.Sanitize(), pgx.Identifier{table.name}.Sanitize())); err != nil {
+		return fmt.Errorf("can't create staging table of %s: %w", table.name, err)
+	}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{staging}, table.columnNames(), pgx.CopyFromRows(rows)); err != nil {
+		return fmt.Errorf("can't copy rows of %s: %w", table.name, err)
+	}
+	if _, err := tx.Exec(ctx, table.postgresUpsert(staging)); err != nil {
+		return fmt.Errorf("can't upsert rows of %s: %w", table.name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	fmt.Println("copied rows to PostgreSQL: ", len(rows), ", table: ", table.name)
+	delete(s.pending, table.name)
+	return nil
+}
+
+// ensureTables creates the tables once, failures are retried on the next flush
+func (s *Postgres) ensureTables(ctx context.Context) error {
+	if s.ensured {
+		return nil
+	}
+	for _, name := range sqlMeasurements() {
+		for _, statement := range sqlTables[name].postgresCreate(s.timescale) {
+			if _, err := s.pool.Exec(ctx, statement); err != nil {
+				return fmt.Errorf("can't create PostgreSQL table %s: %w", sqlTables[name].name, err)
+			}
+		}
+	}
+	s.ensured = true
+	return nil
+}
+
+// Ping checks the database is reachable with the credentials of the uri
+func (s *Postgres) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// Close writes the buffered rows and closes the connections
+func (s *Postgres) Close() error {
+	var err = s.Flush(context.Background())
+	s.pool.Close()
+	return err
+}
+
+// postgresTypes are the SQL types of the column kinds
+var postgresTypes = map[columnKind]string{
+	kindFloat: "double precision",
+	kindInt:   "bigint",
+	kindText:  "text",
+	kindBool:  "boolean",
+}
+
+func (t sqlTable) postgresCreate(timescale bool) []string {
+	var columns = []string{`"user" text NOT NULL`, `"time" timestamptz NOT NULL`, `"key" text NOT NULL DEFAULT ''`}
+	for _, column := range t.columns {
+		columns = append(columns, pgx.Identifier{column.name}.Sanitize()+" "+postgresTypes[column.kind])
+	}
+	columns = append(columns, `"extra" jsonb`, `PRIMARY KEY ("user", "time", "key")`)
+	var statements = []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", pgx.Identifier{t.name}.Sanitize(), strings.Join(columns, ",\n\t")),
+	}
+	if timescale {
+		statements = append(statements, fmt.Sprintf("SELECT create_hypertable('%s', 'time', if_not_exists => TRUE, migrate_data => TRUE)", t.name))
+	}
+	return statements
+}
+
+// postgresUpsert moves the rows of the staging table into the table, replacing the ones of the same records
+func (t sqlTable) postgresUpsert(staging string) string {
+	var columns, updates []string
+	for _, name := range t.columnNames() {
+		columns = append(columns, pgx.Identifier{name}.Sanitize())
+		if name != "user" && name != "time" && name != "key" {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", pgx.Identifier{name}.Sanitize(), pgx.Identifier{name}.Sanitize()))
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (\"user\", \"time\", \"key\") DO UPDATE SET %s",
+		pgx.Identifier{t.name}.Sanitize(), strings.Join(columns, ", "), strings.Join(columns, ", "),
+		pgx.Identifier{staging}.Sanitize(), strings.Join(updates, ", "))
+}
+
+// postgresDelete matches the rows the same way the Influx predicate matches points
+func (t sqlTable) postgresDelete(deletion transform.Deletion) (string, []interface{}) {
+	var query = fmt.Sprintf(`DELETE FROM %s WHERE "user" = $1 AND "time" = $2`, pgx.Identifier{t.name}.Sanitize())
+	var args = []interface{}{deletion.User, deletion.Time}
+	if deletion.Id != "" {
+		query += ` AND "key" = $3`
+		args = append(args, deletion.Id)
+	}
+	return query, args
+}
@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// SQLiteSchemaVersion is kept as user_version of the file, files of a newer schema are not written
+	SQLiteSchemaVersion = 1
+	// SQLiteTimeLayout is how times are stored, it sorts as text and is understood by the SQLite date functions
+	SQLiteTimeLayout = "2006-01-02T15:04:05.000Z"
+	sqliteBatch      = 1000
+)
+
+// SQLite archives points in a local database file with the same tables as Postgres, for offline queries.
+// Writing a record again updates its row, so the archive can be refreshed by exporting again.
+// Rows are buffered and written in batches, Flush writes the rest.
+type SQLite struct {
+	db *sql.DB
+
+	mutex   sync.Mutex
+	pending pendingRows
+}
+
+// NewSQLite opens the file, creating it and its tables when they do not exist
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes the writes, which SQLite does anyway
+	db.SetMaxOpenConns(1)
+	if err := createSQLiteTables(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't open SQLite archive %s: %w", path, err)
+	}
+	return &SQLite{db: db, pending: pendingRows{}}, nil
+}
+
+func createSQLiteTables(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > SQLiteSchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d", version, SQLiteSchemaVersion)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, name := range sqlMeasurements() {
+		if _, err := tx.Exec(sqlTables[name].sqliteCreate()); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", SQLiteSchemaVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) Write(ctx context.Context, point *write.Point) error {
+	table, ok := sqlTables[point.Name()]
+	if !ok {
+		return fmt.Errorf("no SQLite table for measurement %s", point.Name())
+	}
+	key, row, err := table.row(point)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending.add(table.name, key, row) < sqliteBatch {
+		return nil
+	}
+	return s.flush(ctx, table)
+}
+
+// Delete removes the row of the record, or every row of the user at the time when ids are not written as tags
+func (s *SQLite) Delete(ctx context.Context, deletion transform.Deletion) error {
+	table, ok := sqlTables[deletion.Measurement]
+	if !ok {
+		return fmt.Errorf("no SQLite table for measurement %s", deletion.Measurement)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// pending rows are written first, so the deletion applies to them too
+	if err := s.flush(ctx, table); err != nil {
+		return err
+	}
+	query, args := table.sqliteDelete(deletion)
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Flush writes the buffered rows of every table
+func (s *SQLite) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, name := range sqlMeasurements() {
+		if err := s.flush(ctx, sqlTables[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush upserts the pending rows of the table in a single transaction, they are kept pending when it fails
+func (s *SQLite) flush(ctx context.Context, table sqlTable) error {
+	var rows = s.pending.rows(table.name)
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statement, err := tx.PrepareContext(ctx, table.sqliteUpsert())
+	if err != nil {
+		return fmt.Errorf("can't prepare upsert of %s: %w", table.name, err)
+	}
+	defer statement.Close()
+	for _, row := range rows {
+		if _, err := statement.ExecContext(ctx, sqliteRow(row)...); err != nil {
+			return fmt.Errorf("can't upsert row of %s: %w", table.name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	delete(s.pending, table.name)
+	return nil
+}
+
+// Ping checks the file can be read
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close writes the buffered rows and closes the file
+func (s *SQLite) Close() error {
+	var err = s.Flush(context.Background())
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sqliteTypes are the column types of the column kinds, booleans are stored as 0 and 1
+var sqliteTypes = map[columnKind]string{
+	kindFloat: "REAL",
+	kindInt:   "INTEGER",
+	kindText:  "TEXT",
+	kindBool:  "INTEGER",
+}
+
+func (t sqlTable) sqliteCreate() string {
+	var columns = []string{`"user" TEXT NOT NULL`, `"time" TEXT NOT NULL`, `"key" TEXT NOT NULL DEFAULT ''`}
+	for _, column := range t.columns {
+		columns = append(columns, fmt.Sprintf("%q %s", column.name, sqliteTypes[column.kind]))
+	}
+	columns = append(columns, `"extra" TEXT`, `PRIMARY KEY ("user", "time", "key")`)
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %q (\n\t%s\n) WITHOUT ROWID", t.name, strings.Join(columns, ",\n\t"))
+}
+
+// sqliteUpsert inserts a row, replacing the one of the same record
+func (t sqlTable) sqliteUpsert() string {
+	var columns, params, updates []string
+	for _, name := range t.columnNames() {
+		columns = append(columns, fmt.Sprintf("%q", name))
+		params = append(params, "?")
+		if name != "user" && name != "time" && name != "key" {
+			updates = append(updates, fmt.Sprintf("%q = excluded.%q", name, name))
+		}
+	}
+	return fmt.Sprintf(`INSERT INTO %q (%s) VALUES (%s) ON CONFLICT ("user", "time", "key") DO UPDATE SET %s`,
+		t.name, strings.Join(columns, ", "), strings.Join(params, ", "), strings.Join(updates, ", "))
+}
+
+// sqliteDelete matches the rows the same way the Influx predicate matches points
+func (t sqlTable) sqliteDelete(deletion transform.Deletion) (string, []interface{}) {
+	var query = fmt.Sprintf(`DELETE FROM %q WHERE "user" = ? AND "time" = ?`, t.name)
+	var args = []interface{}{deletion.User, deletion.Time.UTC().Format(SQLiteTimeLayout)}
+	if deletion.Id != "" {
+		query += ` AND "key" = ?`
+		args = append(args, deletion.Id)
+	}
+	return query, args
+}
+
+// sqliteRow stores times as text in SQLiteTimeLayout
+func sqliteRow(row []interface{}) []interface{} {
+	var result = append([]interface{}(nil), row...)
+	for i, value := range result {
+		if at, ok := value.(time.Time); ok {
+			result[i] = at.UTC().Format(SQLiteTimeLayout)
+		}
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.db")
+	ctx := context.Background()
+	archive, err := NewSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	var points = []*write.Point{
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "a").AddTag("type", "sgv").AddField("sgv", 120).AddField("direction", "Flat").SetTime(at),
+		influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "b").AddTag("type", "sgv").AddField("sgv", 125).SetTime(at.Add(5 * time.Minute)),
+		influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddTag("type", "bolus").AddTag("smb", "true").AddTag("weekday", "Wednesday").AddField("bolus", 0.3).SetTime(at),
+		influxdb2.NewPointWithMeasurement("openaps").AddTag("user", "john").AddField("iob", 1.5).AddField("tbs_duration", 30).SetTime(at),
+	}
+	for _, point := range points {
+		if err := archive.Write(ctx, point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// exporting the record again updates its row
+	if err := archive.Write(ctx, influxdb2.NewPointWithMeasurement("entries").AddTag("user", "john").AddTag("id", "a").AddTag("type", "sgv").AddField("sgv", 121).SetTime(at)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Delete(ctx, transform.Deletion{Measurement: "entries", User: "john", Id: "b", Time: at.Add(5 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var key, stored string
+	var sgv int64
+	var direction sql.NullString
+	if err := db.QueryRow(`SELECT key, time, sgv, direction FROM entries WHERE "user" = 'john'`).Scan(&key, &stored, &sgv, &direction); err != nil {
+		t.Fatal(err)
+	}
+	if key != "a" || stored != "2022-06-08T06:00:00.000Z" || sgv != 121 || direction.Valid {
+		t.Errorf("unexpected entry %s %s %d %v", key, stored, sgv, direction)
+	}
+	var smb bool
+	var extra string
+	if err := db.QueryRow(`SELECT smb, extra FROM treatments WHERE key = 'bolus' AND time >= '2022-06-08'`).Scan(&smb, &extra); err != nil || !smb || extra != `{"weekday":"Wednesday"}` {
+		t.Errorf("unexpected treatment %v %s, %v", smb, extra, err)
+	}
+	var duration int64
+	if err := db.QueryRow(`SELECT tbs_duration FROM devicestatus WHERE strftime('%H', time) = '06'`).Scan(&duration); err != nil || duration != 30 {
+		t.Errorf("unexpected devicestatus %d, %v", duration, err)
+	}
+
+	if _, err := db.Exec("PRAGMA user_version = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSQLite(path); err == nil {
+		t.Error("archive of newer schema opened")
+	}
+}
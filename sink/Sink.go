@@ -0,0 +1,27 @@
+// Package sink contains the destinations points are written to.
+package sink
+
+import (
+	"context"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+)
+
+// Sink stores points, it must be safe for concurrent use
+type Sink interface {
+	Write(ctx context.Context, point *write.Point) error
+	// Delete removes the point of a soft-deleted record
+	Delete(ctx context.Context, deletion transform.Deletion) error
+	Close() error
+}
+
+// Flusher is implemented by sinks which buffer points, Flush writes what they hold.
+// The pipeline flushes the sink of every import once its points are written.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Pinger is implemented by sinks which can check they are reachable without writing anything
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// columnKind is the type of a column, each database writes it with its own SQL type
+type columnKind int
+
+const (
+	kindFloat columnKind = iota
+	kindInt
+	kindText
+	kindBool
+)
+
+// column is filled from the field or tag named source
+type column struct {
+	name   string
+	source string
+	kind   columnKind
+}
+
+// sqlTable holds the points of a measurement in SQL databases. Rows are identified by user, time and key,
+// the record id or the type when ids are not written, so writing a record again updates its row.
+type sqlTable struct {
+	name    string
+	columns []column
+}
+
+// rowKey is the identity of a row, the primary key of every table
+type rowKey struct {
+	user string
+	time time.Time
+	key  string
+}
+
+// sqlTables are the tables of the measurements, the point fields and tags without a column are kept in extra
+var sqlTables = map[string]sqlTable{
+	"openaps": {name: "devicestatus", columns: []column{
+		{"iob", "iob", kindFloat}, {"basal_iob", "basal_iob", kindFloat}, {"activity", "activity", kindFloat},
+		{"bg", "bg", kindFloat}, {"tick", "tick", kindFloat}, {"eventual_bg", "eventual_bg", kindFloat},
+		{"target_bg", "target_bg", kindFloat}, {"insulin_req", "insulin_req", kindFloat}, {"cob", "cob", kindFloat},
+		{"bolus", "bolus", kindFloat}, {"tbs_rate", "tbs_rate", kindFloat}, {"tbs_duration", "tbs_duration", kindInt},
+		{"sens", "sens", kindFloat}, {"dev", "dev", kindFloat}, {"isf", "isf", kindFloat}, {"isf_nt", "isf_nt", kindFloat},
+		{"isf_bg", "isf_bg", kindFloat}, {"cr", "cr", kindFloat}, {"pred_cob", "pred_cob", kindFloat},
+		{"pred_iob", "pred_iob", kindFloat}, {"pred_uam", "pred_uam", kindFloat}, {"pred_zt", "pred_zt", kindFloat},
+		{"reason", "reason", kindText}, {"device", "device", kindText},
+	}},
+	"treatments": {name: "treatments", columns: []column{
+		{"type", "type", kindText}, {"carbs", "carbs", kindInt}, {"bolus", "bolus", kindFloat}, {"smb", "smb", kindBool},
+		{"duration", "duration", kindInt}, {"percent", "percent", kindInt}, {"rate", "rate", kindFloat},
+		{"target_top", "target_top", kindFloat}, {"target_bottom", "target_bottom", kindFloat}, {"units", "units", kindText},
+		{"reason", "reason", kindText}, {"notes", "notes", kindText}, {"entered_by", "enteredBy", kindText},
+	}},
+	"entries": {name: "entries", columns: []column{
+		{"type", "type", kindText}, {"sgv", "sgv", kindInt}, {"mbg", "mbg", kindInt}, {"direction", "direction", kindText},
+		{"noise", "noise", kindInt}, {"device", "device", kindText},
+	}},
+	"gaps": {name: "gaps", columns: []column{
+		{"type", "type", kindText}, {"end_time", "end", kindText}, {"duration", "duration", kindFloat}, {"ongoing", "ongoing", kindBool},
+	}},
+}
+
+// sqlMeasurements returns the measurements with a table in a stable order
+func sqlMeasurements() []string {
+	var names []string
+	for name := range sqlTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// columnNames are the columns of the rows: the key columns, the typed ones and extra
+func (t sqlTable) columnNames() []string {
+	var names = []string{"user", "time", "key"}
+	for _, column := range t.columns {
+		names = append(names, column.name)
+	}
+	return append(names, "extra")
+}
+
+// row maps the fields and tags of the point to the columns of the table, in the order of columnNames.
+// Extra is a JSON object, or nil when every field and tag has its column.
+func (t sqlTable) row(point *write.Point) (rowKey, []interface{}, error) {
+	var values = map[string]interface{}{}
+	for _, tag := range point.TagList() {
+		values[tag.Key] = tag.Value
+	}
+	for _, field := range point.FieldList() {
+		values[field.Key] = field.Value
+	}
+
+	var user, _ = values["user"].(string)
+	var key = rowKey{user: user, time: point.Time().UTC()}
+	if id, ok := values["id"]; ok {
+		key.key = fmt.Sprint(id)
+	} else if kind, ok := values["type"].(string); ok {
+		// without ids, records of different types at the same time are still told apart
+		key.key = kind
+	}
+	delete(values, "user")
+	delete(values, "id")
+
+	var row = []interface{}{key.user, key.time, key.key}
+	for _, column := range t.columns {
+		value, ok := values[column.source]
+		if !ok {
+			row = append(row, nil)
+			continue
+		}
+		converted, err := columnValue(value, column.kind)
+		if err != nil {
+			return key, nil, fmt.Errorf("%s of %s: %w", column.source, t.name, err)
+		}
+		row = append(row, converted)
+		delete(values, column.source)
+	}
+
+	var extra interface{}
+	if len(values) > 0 {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return key, nil, err
+		}
+		extra = string(data)
+	}
+	return key, append(row, extra), nil
+}
+
+// columnValue converts field values, and tags which are always strings, to the kind of the column
+func columnValue(value interface{}, kind columnKind) (interface{}, error) {
+	switch kind {
+	case kindFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case uint64:
+			return float64(v), nil
+		}
+	case kindInt:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case uint64:
+			return int64(v), nil
+		case float64:
+			return int64(v), nil
+		}
+	case kindBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case kindText:
+		return fmt.Sprint(value), nil
+	}
+	return nil, fmt.Errorf("can't write %v as %v", value, kind)
+}
+
+// pendingRows buffers the rows of each table until they are written in a batch.
+// A record written twice before is kept once, with its last values.
+type pendingRows map[string]map[rowKey][]interface{}
+
+// add buffers the row and returns the number of rows pending for the table
+func (p pendingRows) add(table string, key rowKey, row []interface{}) int {
+	if p[table] == nil {
+		p[table] = map[rowKey][]interface{}{}
+	}
+	p[table][key] = row
+	return len(p[table])
+}
+
+func (p pendingRows) rows(table string) [][]interface{} {
+	var rows = make([][]interface{}, 0, len(p[table]))
+	for _, row := range p[table] {
+		rows = append(rows, row)
+	}
+	return rows
+}
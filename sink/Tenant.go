@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/transform"
+)
+
+// Tenant guards a sink of a single user: points and deletions of any other user are rejected,
+// so data of one tenant can't end up tagged as another one, whatever the transforms produce
+type Tenant struct {
+	sink Sink
+	user string
+}
+
+func NewTenant(sink Sink, user string) *Tenant {
+	return &Tenant{sink: sink, user: user}
+}
+
+func (s *Tenant) Write(ctx context.Context, point *write.Point) error {
+	var user = ""
+	for _, tag := range point.TagList() {
+		if tag.Key == "user" {
+			user = tag.Value
+		}
+	}
+	if user != s.user {
+		return fmt.Errorf("point of user %q rejected by sink of user %q", user, s.user)
+	}
+	return s.sink.Write(ctx, point)
+}
+
+func (s *Tenant) Delete(ctx context.Context, deletion transform.Deletion) error {
+	if deletion.User == "" {
+		return errNoDeletionUser
+	}
+	if deletion.User != s.user {
+		return fmt.Errorf("deletion of user %q rejected by sink of user %q", deletion.User, s.user)
+	}
+	return s.sink.Delete(ctx, deletion)
+}
+
+// Flush flushes the guarded sink, when it buffers points
+func (s *Tenant) Flush(ctx context.Context) error {
+	if flusher, ok := s.sink.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+// Close leaves the guarded sink open, it may be shared with other tenants
+func (s *Tenant) Close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package sink
+
+import (
+	"context"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"ns-exporter/transform"
+	"testing"
+	"time"
+)
+
+func TestTenantRejectsOtherUsers(t *testing.T) {
+	memory := NewMemory()
+	tenant := NewTenant(memory, "john")
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	if err := tenant.Write(ctx, influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "john").AddField("carbs", 10).SetTime(at)); err != nil {
+		t.Error(err)
+	}
+	if err := tenant.Write(ctx, influxdb2.NewPointWithMeasurement("treatments").AddTag("user", "jane").AddField("carbs", 20).SetTime(at)); err == nil {
+		t.Error("point of other user written")
+	}
+	if err := tenant.Write(ctx, influxdb2.NewPointWithMeasurement("treatments").AddField("carbs", 30).SetTime(at)); err == nil {
+		t.Error("point without user written")
+	}
+	if err := tenant.Delete(ctx, transform.Deletion{Measurement: "treatments", User: "jane", Time: at}); err == nil {
+		t.Error("deletion of other user passed")
+	}
+	// a tenant without user doesn't pass deletions matching every user
+	if err := NewTenant(memory, "").Delete(ctx, transform.Deletion{Measurement: "treatments", Time: at}); err == nil {
+		t.Error("deletion without user passed")
+	}
+
+	if lines := memory.Lines(); len(lines) != 1 || len(memory.Deletions()) != 0 {
+		t.Errorf("unexpected lines %v, deletions %v", lines, memory.Deletions())
+	}
+}
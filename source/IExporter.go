@@ -0,0 +1,80 @@
+package source
+
+import (
+	"context"
+	"ns-exporter/model"
+	"time"
+)
+
+// IExporter reads the records of a single Nightscout instance
+type IExporter interface {
+	Authorize(ctx context.Context) error
+	LoadDeviceStatuses(queue chan model.NsEntry, limit int64, skip int64, ctx context.Context) error
+	LoadTreatments(queue chan model.NsTreatment, limit int64, skip int64, ctx context.Context) error
+	LoadEntries(queue chan model.NsSgv, limit int64, skip int64, ctx context.Context) error
+	Close(ctx context.Context)
+}
+
+// Options apply to records of every source
+type Options struct {
+	// User is set on every record read
+	User string
+	// Location is used for timestamps written without zone
+	Location *time.Location
+	// IncludeInvalid makes soft-deleted records to be read too, to propagate their deletion
+	IncludeInvalid bool
+	// From and To limit records to the time range, zero values leave it open
+	From time.Time
+	To   time.Time
+}
+
+// createdAtLayout is how Nightscout uploaders write created_at, which makes it comparable as a string
+const createdAtLayout = "2006-01-02T15:04:05.000Z"
+
+// InRange reports whether the record time is within [From, To)
+func (o Options) InRange(at time.Time) bool {
+	return (o.From.IsZero() || !at.Before(o.From)) && (o.To.IsZero() || at.Before(o.To))
+}
+
+// createdAtRange returns the bounds of the range as created_at values, empty for open ones.
+// Queries by created_at narrow the records down, InRange is still checked on the resolved record time.
+func (o Options) createdAtRange() (string, string) {
+	var from, to string
+	if !o.From.IsZero() {
+		from = o.From.UTC().Format(createdAtLayout)
+	}
+	if !o.To.IsZero() {
+		to = o.To.UTC().Format(createdAtLayout)
+	}
+	return from, to
+}
+
+// createdAtMargin is the largest UTC offset: created_at written with an offset or without zone compares
+// as a string by its local time, up to the margin away from the UTC bounds
+const createdAtMargin = 14 * time.Hour
+
+// createdAtQueryRange returns created_at bounds widened by the margin, so that queries include every record
+// of the range whatever the offset of its created_at, InRange then checks the resolved time
+func (o Options) createdAtQueryRange() (string, string) {
+	var wide = o
+	if !o.From.IsZero() {
+		wide.From = o.From.Add(-createdAtMargin)
+	}
+	if !o.To.IsZero() {
+		wide.To = o.To.Add(createdAtMargin)
+	}
+	return wide.createdAtRange()
+}
+
+// dateRange returns the bounds of the range as epoch milliseconds of the date field, zero for open ones.
+// Entries carry no created_at, so they are queried by date.
+func (o Options) dateRange() (int64, int64) {
+	var from, to int64
+	if !o.From.IsZero() {
+		from = o.From.UnixMilli()
+	}
+	if !o.To.IsZero() {
+		to = o.To.UnixMilli()
+	}
+	return from, to
+}
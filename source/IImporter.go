@@ -0,0 +1,19 @@
+package source
+
+import (
+	"context"
+	"time"
+)
+
+// IImporter writes documents into a single Nightscout instance
+type IImporter interface {
+	IExporter
+	// Find returns documents of the collection with the identifier, or created within a second of the time
+	Find(collection string, identifier string, at time.Time, ctx context.Context) ([]map[string]interface{}, error)
+	Insert(collection string, doc map[string]interface{}, ctx context.Context) error
+}
+
+// aroundRange returns created_at bounds of the second around the time
+func aroundRange(at time.Time) (string, string) {
+	return Options{From: at.Add(-time.Second), To: at.Add(time.Second)}.createdAtRange()
+}
@@ -0,0 +1,29 @@
+package source
+
+import "context"
+
+// IReplica reads and writes raw documents of a Nightscout instance, for replication between instances
+type IReplica interface {
+	Authorize(ctx context.Context) error
+	// LoadDocuments returns up to limit documents of the collection changed after the cursor, oldest first.
+	// An empty cursor starts from the first document.
+	LoadDocuments(collection string, cursor string, limit int64, ctx context.Context) ([]Document, error)
+	// Replace writes the document by its identifier, creating it when it doesn't exist
+	Replace(collection string, doc Document, ctx context.Context) error
+	// Delete soft-deletes the document with the identifier
+	Delete(collection string, identifier string, ctx context.Context) error
+	Close(ctx context.Context)
+}
+
+// Document is a raw Nightscout document
+type Document struct {
+	Identifier string
+	// Cursor is the position of the document in the changes of its collection
+	Cursor string
+	Data   map[string]interface{}
+}
+
+// Deleted reports whether the document is soft-deleted
+func (d Document) Deleted() bool {
+	return d.Data["isValid"] == false
+}
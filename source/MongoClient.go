@@ -0,0 +1,433 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"ns-exporter/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MongoClient struct {
+	mongoUri string
+	mongoDb  string
+	db       *mongo.Database
+	client   *mongo.Client
+	options  Options
+}
+
+func NewMongoClient(uri string, db string, opts Options, ctx context.Context) (*MongoClient, error) {
+	c := &MongoClient{
+		mongoUri: uri,
+		mongoDb:  db,
+		options:  opts,
+	}
+
+	client, err := mongo.NewClient(options.Client().ApplyURI(c.mongoUri))
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	c.db = client.Database(c.mongoDb)
+	return c, nil
+}
+
+func (c *MongoClient) Authorize(_ context.Context) error {
+	return nil
+}
+
+func (c *MongoClient) LoadDeviceStatuses(queue chan model.NsEntry, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadDeviceStatuses from MongoDB, limit: ", limit, ", skip: ", skip)
+
+	collection := c.db.Collection("devicestatus")
+	filter := c.validFilter(bson.M{"openaps": bson.M{"$exists": true}})
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var count = 0
+	for cur.Next(ctx) {
+		var entry model.NsEntry
+		err := cur.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("can't decode devicestatus %s: %w", cur.Current.String(), err)
+		}
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping devicestatus: ", err)
+			continue
+		}
+		if !c.options.InRange(entry.Time) {
+			continue
+		}
+		entry.User = c.options.User
+
+		queue <- entry
+
+		count++
+
+		fmt.Println("devicestatus time: ", entry.Time, "iob:", entry.OpenAps.IOB.IOB, ", bg: ", entry.OpenAps.Suggested.Bg)
+	}
+	fmt.Println("total devicestatuses sent: ", count)
+	return cur.Err()
+}
+
+func (c *MongoClient) LoadTreatments(queue chan model.NsTreatment, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadTreatments from MongoDB, limit: ", limit, ", skip: ", skip)
+	collection := c.db.Collection("treatments")
+	filter := c.validFilter(bson.M{})
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var count = 0
+	for cur.Next(ctx) {
+		var entry model.NsTreatment
+		err := cur.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("can't decode treatment %s: %w", cur.Current.String(), err)
+		}
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping treatment: ", err)
+			continue
+		}
+		if !c.options.InRange(entry.CreatedAt) {
+			continue
+		}
+		entry.User = c.options.User
+
+		queue <- entry
+		count++
+
+		fmt.Println("treatment time: ", entry.CreatedAt, ", type: ", entry.EventType)
+	}
+
+	fmt.Println("total treatments sent: ", count)
+	return cur.Err()
+}
+
+func (c *MongoClient) LoadEntries(queue chan model.NsSgv, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadEntries from MongoDB, limit: ", limit, ", skip: ", skip)
+	collection := c.db.Collection("entries")
+	filter := bson.M{}
+	if !c.options.IncludeInvalid {
+		filter["isValid"] = bson.M{"$ne": false}
+	}
+	from, to := c.options.dateRange()
+	var date = bson.M{}
+	if from > 0 {
+		date["$gte"] = from
+	}
+	if to > 0 {
+		date["$lt"] = to
+	}
+	if len(date) > 0 {
+		filter["date"] = date
+	}
+
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "date", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	var count = 0
+	for cur.Next(ctx) {
+		var entry model.NsSgv
+		err := cur.Decode(&entry)
+		if err != nil {
+			return fmt.Errorf("can't decode entry %s: %w", cur.Current.String(), err)
+		}
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping entry: ", err)
+			continue
+		}
+		if !c.options.InRange(entry.Time) {
+			continue
+		}
+		entry.User = c.options.User
+
+		queue <- entry
+		count++
+	}
+
+	fmt.Println("total entries sent: ", count)
+	return cur.Err()
+}
+
+// validFilter excludes soft-deleted records unless they are requested to propagate deletes,
+// and records out of the time range: created_at is a string with any offset or a BSON date, some records
+// only have date or mills. InRange is checked on the resolved time of the records found.
+func (c *MongoClient) validFilter(filter bson.M) bson.M {
+	if !c.options.IncludeInvalid {
+		filter["isValid"] = bson.M{"$ne": false}
+	}
+	if c.options.From.IsZero() && c.options.To.IsZero() {
+		return filter
+	}
+	from, to := c.options.createdAtQueryRange()
+	fromDate, toDate := c.options.dateRange()
+	var createdAt, createdAtDate, date = bson.M{}, bson.M{}, bson.M{}
+	if from != "" {
+		createdAt["$gte"] = from
+		createdAtDate["$gte"] = c.options.From
+		date["$gte"] = fromDate
+	}
+	if to != "" {
+		createdAt["$lt"] = to
+		createdAtDate["$lt"] = c.options.To
+		date["$lt"] = toDate
+	}
+	filter["$or"] = bson.A{
+		bson.M{"created_at": createdAt},
+		bson.M{"created_at": createdAtDate},
+		bson.M{"created_at": bson.M{"$exists": false}, "date": date},
+		bson.M{"created_at": bson.M{"$exists": false}, "mills": date},
+	}
+	return filter
+}
+
+func (c *MongoClient) Close(ctx context.Context) {
+	c.client.Disconnect(ctx)
+}
+
+func (c *MongoClient) Find(collection string, identifier string, at time.Time, ctx context.Context) ([]map[string]interface{}, error) {
+	from, to := aroundRange(at)
+	var or = []bson.M{{"created_at": bson.M{"$gte": from, "$lt": to}}}
+	if identifier != "" {
+		or = append(or, bson.M{"identifier": identifier})
+		if id, err := primitive.ObjectIDFromHex(identifier); err == nil {
+			or = append(or, bson.M{"_id": id})
+		}
+	}
+	cur, err := c.db.Collection(collection).Find(ctx, bson.M{"$or": or})
+	if err != nil {
+		return nil, err
+	}
+	var found []map[string]interface{}
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("can't decode %s: %w", collection, err)
+	}
+	return found, nil
+}
+
+// Insert stores the document, an identifier taken from a Mongo _id becomes its _id again
+func (c *MongoClient) Insert(collection string, doc map[string]interface{}, ctx context.Context) error {
+	if identifier, ok := doc["identifier"].(string); ok {
+		if id, err := primitive.ObjectIDFromHex(identifier); err == nil {
+			doc["_id"] = id
+		}
+	}
+	_, err := c.db.Collection(collection).InsertOne(ctx, doc)
+	return err
+}
+
+// mongoCursor is the position in the two orders documents are read in: documents written through APIv3 by their
+// srvModified and _id, so their changes are read again, and documents of older Nightscout versions by their _id.
+// Changes of the latter are not seen, Mongo keeps no modification time of them.
+type mongoCursor struct {
+	modified   int64
+	modifiedId primitive.ObjectID
+	legacyId   primitive.ObjectID
+}
+
+// parseMongoCursor reads "srvModified/_id/_id", a single _id is the cursor of earlier versions
+func parseMongoCursor(cursor string) (mongoCursor, error) {
+	var result mongoCursor
+	if cursor == "" {
+		return result, nil
+	}
+	var parts = strings.Split(cursor, "/")
+	var err error
+	switch len(parts) {
+	case 1:
+		result.legacyId, err = primitive.ObjectIDFromHex(parts[0])
+	case 3:
+		if result.modified, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+			result.modifiedId, err = objectIdOrZero(parts[1])
+		}
+		if err == nil {
+			result.legacyId, err = objectIdOrZero(parts[2])
+		}
+	default:
+		err = errors.New("unexpected format")
+	}
+	return result, err
+}
+
+func objectIdOrZero(hex string) (primitive.ObjectID, error) {
+	if hex == "" {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(hex)
+}
+
+func (c mongoCursor) String() string {
+	return fmt.Sprintf("%d/%s/%s", c.modified, hexOrEmpty(c.modifiedId), hexOrEmpty(c.legacyId))
+}
+
+func hexOrEmpty(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return ""
+	}
+	return id.Hex()
+}
+
+// srvModified returns the modification time Nightscout sets on documents written through APIv3
+func srvModified(data bson.M) (int64, bool) {
+	switch v := data["srvModified"].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// LoadDocuments reads the documents with srvModified changed after the cursor, then the ones without it inserted after it.
+// Changes of documents without srvModified are only seen by reading the collection from the start again.
+func (c *MongoClient) LoadDocuments(collection string, cursor string, limit int64, ctx context.Context) ([]Document, error) {
+	position, err := parseMongoCursor(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s cursor %q: %w", collection, cursor, err)
+	}
+
+	var modified = bson.M{"$or": []bson.M{
+		{"srvModified": bson.M{"$gt": position.modified}},
+		{"srvModified": position.modified, "_id": bson.M{"$gt": position.modifiedId}},
+	}}
+	found, err := c.findDocuments(collection, modified, bson.D{{Key: "srvModified", Value: 1}, {Key: "_id", Value: 1}}, limit, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || int64(len(found)) < limit {
+		// srvModified is null or missing
+		var legacy = bson.M{"srvModified": nil, "_id": bson.M{"$gt": position.legacyId}}
+		var remaining int64
+		if limit > 0 {
+			remaining = limit - int64(len(found))
+		}
+		more, err := c.findDocuments(collection, legacy, bson.D{{Key: "_id", Value: 1}}, remaining, ctx)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, more...)
+	}
+
+	var result []Document
+	for _, data := range found {
+		id, ok := data["_id"].(primitive.ObjectID)
+		if !ok {
+			return nil, fmt.Errorf("%s document with unsupported _id %v", collection, data["_id"])
+		}
+		if at, ok := srvModified(data); ok {
+			position.modified, position.modifiedId = at, id
+		} else {
+			position.legacyId = id
+		}
+		identifier, _ := data["identifier"].(string)
+		if identifier == "" {
+			identifier = id.Hex()
+		}
+		result = append(result, Document{Identifier: identifier, Cursor: position.String(), Data: data})
+	}
+	return result, nil
+}
+
+func (c *MongoClient) findDocuments(collection string, filter bson.M, sort bson.D, limit int64, ctx context.Context) ([]bson.M, error) {
+	opts := options.Find().SetSort(sort)
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := c.db.Collection(collection).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var found []bson.M
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("can't decode %s: %w", collection, err)
+	}
+	return found, nil
+}
+
+// Replace upserts the document by its identifier, keeping the _id of documents read from Mongo
+func (c *MongoClient) Replace(collection string, doc Document, ctx context.Context) error {
+	var data = bson.M{}
+	for key, value := range doc.Data {
+		data[key] = value
+	}
+	data["identifier"] = doc.Identifier
+	var filter = bson.M{"identifier": doc.Identifier}
+	if id, ok := data["_id"].(primitive.ObjectID); ok {
+		filter = bson.M{"_id": id}
+	} else if id, err := primitive.ObjectIDFromHex(doc.Identifier); err == nil {
+		data["_id"] = id
+		filter = bson.M{"_id": id}
+	} else {
+		// documents of APIv3 get a new _id, it differs between instances
+		delete(data, "_id")
+	}
+	_, err := c.db.Collection(collection).ReplaceOne(ctx, filter, data, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (c *MongoClient) Delete(collection string, identifier string, ctx context.Context) error {
+	var filter = bson.M{"identifier": identifier}
+	if id, err := primitive.ObjectIDFromHex(identifier); err == nil {
+		filter = bson.M{"$or": []bson.M{filter, {"_id": id}}}
+	}
+	_, err := c.db.Collection(collection).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"isValid": false}})
+	return err
+}
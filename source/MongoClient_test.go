@@ -0,0 +1,53 @@
+package source
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestMongoCursor(t *testing.T) {
+	var id, _ = primitive.ObjectIDFromHex("62a05ea2c6e1c2a5b1f3e6d1")
+	var cases = []struct {
+		cursor   string
+		expected mongoCursor
+	}{
+		{"", mongoCursor{}},
+		// cursors of earlier versions continue with the documents inserted after them
+		{"62a05ea2c6e1c2a5b1f3e6d1", mongoCursor{legacyId: id}},
+		{"1654682400000/62a05ea2c6e1c2a5b1f3e6d1/", mongoCursor{modified: 1654682400000, modifiedId: id}},
+		{"0//62a05ea2c6e1c2a5b1f3e6d1", mongoCursor{legacyId: id}},
+	}
+	for _, c := range cases {
+		cursor, err := parseMongoCursor(c.cursor)
+		if err != nil || cursor != c.expected {
+			t.Errorf("%q: cursor %+v, %v, expected %+v", c.cursor, cursor, err, c.expected)
+		}
+		if again, err := parseMongoCursor(cursor.String()); err != nil || again != cursor {
+			t.Errorf("%q: formatted as %q, read as %+v", c.cursor, cursor.String(), again)
+		}
+	}
+	for _, invalid := range []string{"62a05ea2", "1/2", "x/62a05ea2c6e1c2a5b1f3e6d1/"} {
+		if _, err := parseMongoCursor(invalid); err == nil {
+			t.Errorf("invalid cursor %q accepted", invalid)
+		}
+	}
+}
+
+func TestMongoValidFilter(t *testing.T) {
+	var from, to = time.Date(2022, 6, 8, 7, 0, 0, 0, time.UTC), time.Date(2022, 6, 8, 8, 0, 0, 0, time.UTC)
+	var client = &MongoClient{options: Options{From: from, To: to}}
+	var or = client.validFilter(bson.M{})["$or"].(bson.A)
+	// created_at of 07:30 UTC with an offset compares by its local time
+	var createdAt = or[0].(bson.M)["created_at"].(bson.M)
+	if at := "2022-06-08T10:30:00+03:00"; at < createdAt["$gte"].(string) || at >= createdAt["$lt"].(string) {
+		t.Errorf("%s out of the created_at bounds %v", at, createdAt)
+	}
+	if dates := or[1].(bson.M)["created_at"].(bson.M); dates["$gte"] != from || dates["$lt"] != to {
+		t.Errorf("unexpected BSON date bounds %v", dates)
+	}
+	if date := or[2].(bson.M)["date"].(bson.M); date["$gte"] != from.UnixMilli() || date["$lt"] != to.UnixMilli() {
+		t.Errorf("unexpected date bounds %v", date)
+	}
+}
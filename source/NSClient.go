@@ -0,0 +1,454 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"ns-exporter/model"
+	"strconv"
+	"strings"
+	"time"
+)
+import "github.com/go-resty/resty/v2"
+
+type NSClient struct {
+	nsUri   string
+	nsToken string
+	jwt     string
+	options Options
+}
+
+type nsDeviceStatusResult struct {
+	Status  int             `json:"status"`
+	Records []model.NsEntry `json:"result"`
+}
+type nsTreatmentsResult struct {
+	Status  int                 `json:"status"`
+	Records []model.NsTreatment `json:"result"`
+}
+type nsEntriesResult struct {
+	Status  int           `json:"status"`
+	Records []model.NsSgv `json:"result"`
+}
+type nsJwtResult struct {
+	Token string `json:"token"`
+}
+
+func NewNSClient(uri string, token string, opts Options) *NSClient {
+	return &NSClient{
+		nsUri:   strings.TrimRight(uri, "/"),
+		nsToken: token,
+		options: opts,
+	}
+}
+
+func (c *NSClient) Authorize(ctx context.Context) error {
+	client := resty.New()
+	result := &nsJwtResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetResult(result).
+		SetHeader("Accept", "application/json").
+		Get(c.nsUri + "/api/v2/authorization/request/" + c.nsToken)
+
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't authorize in NS: %w", err)
+	}
+	c.jwt = result.Token
+	return nil
+}
+
+func (c *NSClient) LoadDeviceStatuses(queue chan model.NsEntry, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadDeviceStatuses from NS, limit: ", limit, ", skip: ", skip)
+
+	client := resty.New()
+
+	entries := &nsDeviceStatusResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParams(c.query(limit, skip)).
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		SetHeader("Accept", "application/json").
+		SetResult(entries).
+		Get(c.nsUri + "/api/v3/devicestatus")
+
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't load devicestatus from NS: %w", err)
+	}
+
+	var oldest time.Time
+	for _, entry := range entries.Records {
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping devicestatus: ", err)
+			continue
+		}
+		oldest = entry.Time
+		if strings.HasPrefix(entry.Device, "openaps") && (c.options.IncludeInvalid || entry.Valid()) && c.options.InRange(entry.Time) {
+			entry.User = c.options.User
+			queue <- entry
+		}
+	}
+
+	if c.options.IncludeInvalid {
+		// search never returns soft-deleted documents, they are only visible in the history
+		since := c.historySince(oldest, len(entries.Records), limit)
+		return loadHistory(c, "devicestatus", since, limit, ctx, func(entry model.NsEntry) {
+			if strings.HasPrefix(entry.Device, "openaps") && !entry.Valid() &&
+				entry.ResolveTime(c.options.Location) == nil && c.options.InRange(entry.Time) {
+				entry.User = c.options.User
+				queue <- entry
+			}
+		})
+	}
+	return nil
+}
+
+func (c *NSClient) LoadTreatments(queue chan model.NsTreatment, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadTreatments from NS, limit: ", limit, ", skip: ", skip)
+
+	client := resty.New()
+
+	entries := &nsTreatmentsResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParams(c.query(limit, skip)).
+		SetResult(entries).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Get(c.nsUri + "/api/v3/treatments")
+
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't load treatments from NS: %w", err)
+	}
+	var oldest time.Time
+	for _, entry := range entries.Records {
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping treatment: ", err)
+			continue
+		}
+		oldest = entry.CreatedAt
+		if (c.options.IncludeInvalid || entry.Valid()) && c.options.InRange(entry.CreatedAt) {
+			entry.User = c.options.User
+			queue <- entry
+		}
+	}
+
+	if c.options.IncludeInvalid {
+		since := c.historySince(oldest, len(entries.Records), limit)
+		return loadHistory(c, "treatments", since, limit, ctx, func(entry model.NsTreatment) {
+			if !entry.Valid() && entry.ResolveTime(c.options.Location) == nil && c.options.InRange(entry.CreatedAt) {
+				entry.User = c.options.User
+				queue <- entry
+			}
+		})
+	}
+	return nil
+}
+
+func (c *NSClient) LoadEntries(queue chan model.NsSgv, limit int64, skip int64, ctx context.Context) error {
+	fmt.Println("LoadEntries from NS, limit: ", limit, ", skip: ", skip)
+
+	client := resty.New()
+
+	entries := &nsEntriesResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParams(c.dateQuery(limit, skip)).
+		SetResult(entries).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Get(c.nsUri + "/api/v3/entries")
+
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't load entries from NS: %w", err)
+	}
+	var oldest time.Time
+	for _, entry := range entries.Records {
+		if err := entry.ResolveTime(c.options.Location); err != nil {
+			fmt.Println("skipping entry: ", err)
+			continue
+		}
+		oldest = entry.Time
+		if (c.options.IncludeInvalid || entry.Valid()) && c.options.InRange(entry.Time) {
+			entry.User = c.options.User
+			queue <- entry
+		}
+	}
+
+	if c.options.IncludeInvalid {
+		since := c.historySince(oldest, len(entries.Records), limit)
+		return loadHistory(c, "entries", since, limit, ctx, func(entry model.NsSgv) {
+			if !entry.Valid() && entry.ResolveTime(c.options.Location) == nil && c.options.InRange(entry.Time) {
+				entry.User = c.options.User
+				queue <- entry
+			}
+		})
+	}
+	return nil
+}
+
+// query pages the collection from the newest records, within the time range
+func (c *NSClient) query(limit int64, skip int64) map[string]string {
+	var query = map[string]string{
+		"skip":      strconv.FormatInt(skip, 10),
+		"limit":     strconv.FormatInt(limit, 10),
+		"sort$desc": "created_at",
+	}
+	from, to := c.options.createdAtQueryRange()
+	if from != "" {
+		query["created_at$gte"] = from
+	}
+	if to != "" {
+		query["created_at$lt"] = to
+	}
+	return query
+}
+
+// dateQuery pages entries from the newest records by their date, within the time range
+func (c *NSClient) dateQuery(limit int64, skip int64) map[string]string {
+	var query = map[string]string{
+		"skip":      strconv.FormatInt(skip, 10),
+		"limit":     strconv.FormatInt(limit, 10),
+		"sort$desc": "date",
+	}
+	from, to := c.options.dateRange()
+	if from > 0 {
+		query["date$gte"] = strconv.FormatInt(from, 10)
+	}
+	if to > 0 {
+		query["date$lt"] = strconv.FormatInt(to, 10)
+	}
+	return query
+}
+
+// historySince returns the srvModified the history of soft-deleted records is read from. Records are modified
+// after their creation, so a full page bounds it by its oldest record, otherwise it starts at the range.
+func (c *NSClient) historySince(oldest time.Time, count int, limit int64) time.Time {
+	if int64(count) >= limit && !oldest.IsZero() {
+		return oldest
+	}
+	return c.options.From
+}
+
+// loadHistory pages the documents of the collection modified since the given time, including soft-deleted ones,
+// by their srvModified until a page comes back short
+func loadHistory[T any](c *NSClient, collection string, since time.Time, limit int64, ctx context.Context, record func(T)) error {
+	var cursor = "0"
+	if !since.IsZero() {
+		// the history is read from documents modified after the cursor
+		cursor = strconv.FormatInt(since.UnixMilli()-1, 10)
+	}
+	for {
+		documents, err := c.LoadDocuments(collection, cursor, limit, ctx)
+		if err != nil {
+			return err
+		}
+		for _, document := range documents {
+			var entry T
+			data, err := json.Marshal(document.Data)
+			if err == nil {
+				err = json.Unmarshal(data, &entry)
+			}
+			if err != nil {
+				return fmt.Errorf("can't decode %s %s of the history: %w", collection, document.Identifier, err)
+			}
+			record(entry)
+			cursor = document.Cursor
+		}
+		if int64(len(documents)) < limit {
+			return nil
+		}
+	}
+}
+
+func (c *NSClient) Close(_ context.Context) {}
+
+// checkResponse turns http error statuses into errors, resty only fails on transport errors
+func checkResponse(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("unexpected response status: %s", resp.Status())
+	}
+	return nil
+}
+
+type nsDocumentsResult struct {
+	Status  int                      `json:"status"`
+	Records []map[string]interface{} `json:"result"`
+}
+type nsDocumentResult struct {
+	Status int                    `json:"status"`
+	Record map[string]interface{} `json:"result"`
+}
+
+func (c *NSClient) Find(collection string, identifier string, at time.Time, ctx context.Context) ([]map[string]interface{}, error) {
+	client := resty.New()
+	var found []map[string]interface{}
+	if identifier != "" {
+		document := &nsDocumentResult{}
+		resp, err := client.R().
+			SetContext(ctx).
+			SetResult(document).
+			SetHeader("Accept", "application/json").
+			SetAuthScheme("Bearer").
+			SetAuthToken(c.jwt).
+			Get(c.nsUri + "/api/v3/" + collection + "/" + url.PathEscape(identifier))
+		// soft-deleted documents (410) don't conflict with the one to be inserted
+		var missing = err == nil && (resp.StatusCode() == http.StatusNotFound || resp.StatusCode() == http.StatusGone)
+		if !missing {
+			if err := checkResponse(resp, err); err != nil {
+				return nil, fmt.Errorf("can't find %s %s in NS: %w", collection, identifier, err)
+			}
+			if document.Record != nil {
+				found = append(found, document.Record)
+			}
+		}
+	}
+
+	from, to := aroundRange(at)
+	documents := &nsDocumentsResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"created_at$gte": from,
+			"created_at$lt":  to,
+			"sort$desc":      "created_at",
+			"limit":          "100",
+		}).
+		SetResult(documents).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Get(c.nsUri + "/api/v3/" + collection)
+	if err := checkResponse(resp, err); err != nil {
+		return nil, fmt.Errorf("can't find %s at %s in NS: %w", collection, at, err)
+	}
+	return append(found, documents.Records...), nil
+}
+
+// Insert creates the document through APIv3, which requires its date and app
+func (c *NSClient) Insert(collection string, doc map[string]interface{}, ctx context.Context) error {
+	client := resty.New()
+	resp, err := client.R().
+		SetContext(ctx).
+		SetBody(doc).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Post(c.nsUri + "/api/v3/" + collection)
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't insert %s into NS: %w", collection, err)
+	}
+	return nil
+}
+
+// serverFields are set by Nightscout itself and can't be written through APIv3
+var serverFields = []string{"_id", "srvCreated", "srvModified", "subject", "modifiedBy"}
+
+// LoadDocuments reads the history of the collection, the cursor is srvModified of the last document read
+func (c *NSClient) LoadDocuments(collection string, cursor string, limit int64, ctx context.Context) ([]Document, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	client := resty.New()
+	documents := &nsDocumentsResult{}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{"limit": strconv.FormatInt(limit, 10)}).
+		SetResult(documents).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Get(c.nsUri + "/api/v3/" + collection + "/history/" + url.PathEscape(cursor))
+	if err := checkResponse(resp, err); err != nil {
+		return nil, fmt.Errorf("can't load %s history from NS: %w", collection, err)
+	}
+
+	var result []Document
+	for _, data := range documents.Records {
+		identifier, _ := data["identifier"].(string)
+		modified, ok := data["srvModified"].(float64)
+		if identifier == "" || !ok {
+			return nil, fmt.Errorf("%s document without identifier or srvModified: %v", collection, data)
+		}
+		result = append(result, Document{Identifier: identifier, Cursor: strconv.FormatInt(int64(modified), 10), Data: data})
+	}
+	return result, nil
+}
+
+// Replace creates or replaces the document through APIv3, legacy documents get the date and app it requires
+func (c *NSClient) Replace(collection string, doc Document, ctx context.Context) error {
+	var data = map[string]interface{}{}
+	for key, value := range doc.Data {
+		data[key] = value
+	}
+	for _, key := range serverFields {
+		delete(data, key)
+	}
+	data["identifier"] = doc.Identifier
+	if data["date"] == nil {
+		if at, err := documentTime(data); err == nil {
+			data["date"] = at.UnixMilli()
+		}
+	}
+	if data["app"] == nil {
+		data["app"] = "ns-exporter"
+	}
+
+	client := resty.New()
+	resp, err := client.R().
+		SetContext(ctx).
+		SetBody(data).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Put(c.nsUri + "/api/v3/" + collection + "/" + url.PathEscape(doc.Identifier))
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't replace %s %s in NS: %w", collection, doc.Identifier, err)
+	}
+	return nil
+}
+
+func (c *NSClient) Delete(collection string, identifier string, ctx context.Context) error {
+	client := resty.New()
+	resp, err := client.R().
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		SetAuthScheme("Bearer").
+		SetAuthToken(c.jwt).
+		Delete(c.nsUri + "/api/v3/" + collection + "/" + url.PathEscape(identifier))
+	// documents never replicated are missing, deleted ones are gone
+	if err == nil && (resp.StatusCode() == http.StatusNotFound || resp.StatusCode() == http.StatusGone) {
+		return nil
+	}
+	if err := checkResponse(resp, err); err != nil {
+		return fmt.Errorf("can't delete %s %s in NS: %w", collection, identifier, err)
+	}
+	return nil
+}
+
+// documentTime resolves the time of a raw document, e.g. to set its date
+func documentTime(data map[string]interface{}) (time.Time, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var record model.RecordTime
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return time.Time{}, err
+	}
+	if record.Created == "" {
+		// profiles carry their time as startDate
+		if startDate, ok := data["startDate"].(string); ok {
+			record.Created = model.RawTime(startDate)
+		}
+	}
+	return record.Resolve(nil)
+}
@@ -0,0 +1,183 @@
+package source
+
+import (
+	"context"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testdata = "../testdata"
+
+func loadDeviceStatuses(t *testing.T, client IExporter, limit int64, skip int64) []model.NsEntry {
+	t.Helper()
+	queue := make(chan model.NsEntry)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.LoadDeviceStatuses(queue, limit, skip, context.Background())
+		close(queue)
+	}()
+	var entries []model.NsEntry
+	for entry := range queue {
+		entries = append(entries, entry)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func loadTreatments(t *testing.T, client IExporter, limit int64, skip int64) []model.NsTreatment {
+	t.Helper()
+	queue := make(chan model.NsTreatment)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.LoadTreatments(queue, limit, skip, context.Background())
+		close(queue)
+	}()
+	var entries []model.NsTreatment
+	for entry := range queue {
+		entries = append(entries, entry)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func authorizedClient(t *testing.T, fixture string, opts Options) *NSClient {
+	t.Helper()
+	client := NewNSClient(nstest.NewServer(t, testdata, fixture).URL+"/", nstest.Token, opts)
+	if err := client.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestNSClientAuthorize(t *testing.T) {
+	client := authorizedClient(t, "aaps", Options{})
+	if client.jwt != nstest.Jwt {
+		t.Errorf("jwt %q, expected %q", client.jwt, nstest.Jwt)
+	}
+
+	invalid := NewNSClient(nstest.NewServer(t, testdata, "aaps").URL, "wrong", Options{})
+	if err := invalid.Authorize(context.Background()); err == nil {
+		t.Error("authorization with wrong token succeeded")
+	}
+}
+
+func TestNSClientLoadDeviceStatuses(t *testing.T) {
+	var expected = map[string]int{"aaps": 2, "oref0": 2, "loop": 0}
+	for _, fixture := range nstest.Fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			entries := loadDeviceStatuses(t, authorizedClient(t, fixture, Options{User: "test"}), 100, 0)
+			if len(entries) != expected[fixture] {
+				t.Errorf("%d devicestatuses loaded, expected %d", len(entries), expected[fixture])
+			}
+			for _, entry := range entries {
+				if !strings.HasPrefix(entry.Device, "openaps") {
+					t.Errorf("non-openaps devicestatus loaded: %s", entry.Device)
+				}
+				if entry.User != "test" || entry.Time.IsZero() {
+					t.Errorf("user and time not set: %q, %v", entry.User, entry.Time)
+				}
+			}
+		})
+	}
+}
+
+func TestNSClientLimitAndSkip(t *testing.T) {
+	entries := loadTreatments(t, authorizedClient(t, "aaps", Options{}), 2, 1)
+	if len(entries) != 2 || entries[0].Identifier != "d2e3f4a5-b6c7-4d8e-9f0a-1b2c3d4e5f60" {
+		t.Errorf("unexpected page: %+v", entries)
+	}
+}
+
+func TestNSClientIncludeInvalid(t *testing.T) {
+	for _, includeInvalid := range []bool{false, true} {
+		var invalid []string
+		for _, entry := range loadTreatments(t, authorizedClient(t, "aaps", Options{IncludeInvalid: includeInvalid}), 100, 0) {
+			if !entry.Valid() {
+				invalid = append(invalid, entry.Identifier)
+			}
+		}
+		if !includeInvalid && len(invalid) != 0 {
+			t.Errorf("soft-deleted treatments loaded: %v", invalid)
+		}
+		if includeInvalid && (len(invalid) != 1 || invalid[0] != "c7d8e9f0-a1b2-4c3d-4e5f-607182930415") {
+			t.Errorf("unexpected soft-deleted treatments: %v", invalid)
+		}
+	}
+}
+
+func TestNSClientTimeRange(t *testing.T) {
+	var opts = Options{
+		From: time.Date(2022, 6, 8, 8, 0, 0, 0, time.UTC),
+		To:   time.Date(2022, 6, 8, 9, 45, 0, 500000000, time.UTC),
+	}
+	var types []string
+	for _, entry := range loadTreatments(t, authorizedClient(t, "aaps", opts), 100, 0) {
+		types = append(types, entry.EventType)
+	}
+	if expected := "Meal Bolus,Temporary Target,Temp Basal"; strings.Join(types, ",") != expected {
+		t.Errorf("loaded %v, expected %s", types, expected)
+	}
+}
+
+// TestNSClientHistoryPages reads soft-deleted treatments from a history longer than the limit, within the range only
+func TestNSClientHistoryPages(t *testing.T) {
+	var deleted = "c7d8e9f0-a1b2-4c3d-4e5f-607182930415"
+	var cases = []struct {
+		opts     Options
+		expected []string
+	}{
+		// no valid treatment in the range, the deleted one is still found after every treatment created since
+		{Options{IncludeInvalid: true, From: time.Date(2022, 6, 8, 5, 30, 0, 0, time.UTC), To: time.Date(2022, 6, 8, 6, 30, 0, 0, time.UTC)},
+			[]string{deleted}},
+		// the deleted treatment was created before the range
+		{Options{IncludeInvalid: true, From: time.Date(2022, 6, 8, 7, 0, 0, 0, time.UTC)}, nil},
+	}
+	for _, c := range cases {
+		var invalid []string
+		for _, entry := range loadTreatments(t, authorizedClient(t, "aaps", c.opts), 2, 0) {
+			if !entry.Valid() {
+				invalid = append(invalid, entry.Identifier)
+			}
+		}
+		if strings.Join(invalid, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("from %v: soft-deleted treatments %v, expected %v", c.opts.From, invalid, c.expected)
+		}
+	}
+}
+
+// TestNSClientOffsetTimes checks the time range on created_at written with an offset or without milliseconds
+func TestNSClientOffsetTimes(t *testing.T) {
+	var dir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "treatments"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var treatments = `[
+		{"identifier": "in-range", "eventType": "Note", "created_at": "2022-06-08T10:30:00+03:00"},
+		{"identifier": "no-milliseconds", "eventType": "Note", "created_at": "2022-06-08T07:45:00Z"},
+		{"identifier": "before", "eventType": "Note", "created_at": "2022-06-08T07:30:00+03:00"}
+	]`
+	if err := os.WriteFile(filepath.Join(dir, "treatments", "offset.json"), []byte(treatments), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var opts = Options{From: time.Date(2022, 6, 8, 7, 0, 0, 0, time.UTC), To: time.Date(2022, 6, 8, 8, 0, 0, 0, time.UTC)}
+	client := NewNSClient(nstest.NewServer(t, dir, "offset").URL+"/", nstest.Token, opts)
+	if err := client.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var identifiers []string
+	for _, entry := range loadTreatments(t, client, 100, 0) {
+		identifiers = append(identifiers, entry.Identifier)
+	}
+	if expected := "in-range,no-milliseconds"; strings.Join(identifiers, ",") != expected {
+		t.Errorf("loaded %v, expected %s", identifiers, expected)
+	}
+}
@@ -0,0 +1,134 @@
+package transform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"time"
+)
+
+// Redacted replaces free text when it is redacted instead of dropped
+const Redacted = "[redacted]"
+
+// freeText are fields and tags which may contain names or other identifying text
+var freeText = map[string]bool{"notes": true, "reason": true, "enteredBy": true, "device": true}
+
+// Anonymizer pseudonymizes points for research exports. Pseudonyms and time shifts are derived from the secret,
+// so they are stable across runs and can't be reversed without it.
+type Anonymizer struct {
+	Secret string
+	// RedactText replaces free text with Redacted instead of dropping it
+	RedactText bool
+	// MaxShiftDays bounds the per-user shift of timestamps, zero keeps them
+	MaxShiftDays int
+}
+
+// Pseudonym replaces the user name
+func (a *Anonymizer) Pseudonym(user string) string {
+	if user == "" {
+		return ""
+	}
+	return "u-" + hex.EncodeToString(a.sum("user", user)[:8])
+}
+
+// ShiftDays returns the shift of the user, it is never zero unless shifting is disabled
+func (a *Anonymizer) ShiftDays(user string) int {
+	if a.MaxShiftDays <= 0 {
+		return 0
+	}
+	var days = int(binary.BigEndian.Uint64(a.sum("shift", user)[:8]) % uint64(2*a.MaxShiftDays))
+	days -= a.MaxShiftDays
+	if days >= 0 {
+		days++
+	}
+	return days
+}
+
+// Shift moves the time by whole days of the user, in its location so the time of day is preserved across DST changes
+func (a *Anonymizer) Shift(at time.Time, user string, location *time.Location) time.Time {
+	var days = a.ShiftDays(user)
+	if days == 0 {
+		return at
+	}
+	if location == nil {
+		location = time.UTC
+	}
+	return at.In(location).AddDate(0, 0, days).UTC()
+}
+
+// id hashes record ids, Mongo ObjectIDs contain the creation time
+func (a *Anonymizer) id(id string) string {
+	if id == "" {
+		return ""
+	}
+	return hex.EncodeToString(a.sum("id", id)[:12])
+}
+
+func (a *Anonymizer) sum(purpose string, value string) []byte {
+	mac := hmac.New(sha256.New, []byte(a.Secret))
+	mac.Write([]byte(purpose + "\x00" + value))
+	return mac.Sum(nil)
+}
+
+// UserTag is the value of the user tag of the points of the user
+func (o Options) UserTag(user string) string {
+	if o.Anonymizer != nil {
+		return o.Anonymizer.Pseudonym(user)
+	}
+	return user
+}
+
+func (o Options) time(at time.Time, user string, location *time.Location) time.Time {
+	if o.Anonymizer != nil {
+		return o.Anonymizer.Shift(at, user, location)
+	}
+	return at
+}
+
+func (o Options) id(id string) string {
+	if o.Anonymizer != nil {
+		return o.Anonymizer.id(id)
+	}
+	return id
+}
+
+// text returns the value of a free text field or tag, and whether it is to be written at all
+func (o Options) text(name string, value interface{}) (interface{}, bool) {
+	if o.Anonymizer == nil || !freeText[name] {
+		return value, true
+	}
+	return o.Anonymizer.redact()
+}
+
+// extra returns the value of a whitelisted treatment field, anything but a number may be free text
+func (o Options) extra(value interface{}) (interface{}, bool) {
+	if o.Anonymizer == nil {
+		return value, true
+	}
+	switch value.(type) {
+	case float64, float32, int, int32, int64:
+		return value, true
+	}
+	return o.Anonymizer.redact()
+}
+
+func (a *Anonymizer) redact() (interface{}, bool) {
+	if a.RedactText {
+		return Redacted, true
+	}
+	return nil, false
+}
+
+func (o Options) addTextField(point *write.Point, name string, value interface{}) {
+	if value, ok := o.text(name, value); ok {
+		point.AddField(name, value)
+	}
+}
+
+func (o Options) addTextTag(point *write.Point, name string, value string) {
+	if value, ok := o.text(name, value); ok {
+		point.AddTag(name, value.(string))
+	}
+}
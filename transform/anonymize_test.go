@@ -0,0 +1,124 @@
+package transform
+
+import (
+	"fmt"
+	"ns-exporter/model"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func TestAnonymizerIsStable(t *testing.T) {
+	var anonymizer = &Anonymizer{Secret: "secret", MaxShiftDays: 30}
+	var other = &Anonymizer{Secret: "other", MaxShiftDays: 30}
+
+	if anonymizer.Pseudonym("john") != anonymizer.Pseudonym("john") {
+		t.Error("pseudonym differs between calls")
+	}
+	if anonymizer.Pseudonym("john") == anonymizer.Pseudonym("jane") {
+		t.Error("users share the pseudonym")
+	}
+	if anonymizer.Pseudonym("john") == other.Pseudonym("john") || strings.Contains(anonymizer.Pseudonym("john"), "john") {
+		t.Errorf("pseudonym %q does not depend on the secret", anonymizer.Pseudonym("john"))
+	}
+	for _, user := range []string{"john", "jane", "study-1", "study-2"} {
+		if days := anonymizer.ShiftDays(user); days == 0 || days < -30 || days > 30 {
+			t.Errorf("shift of %s is %d days", user, days)
+		}
+	}
+	if days := (&Anonymizer{Secret: "secret"}).ShiftDays("john"); days != 0 {
+		t.Errorf("shifted by %d days without MaxShiftDays", days)
+	}
+}
+
+func TestAnonymizerShiftKeepsTimeOfDay(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var anonymizer = &Anonymizer{Secret: "secret", MaxShiftDays: 365}
+	// the shift crosses the DST change for some of the users
+	var at = time.Date(2022, 3, 20, 7, 30, 0, 0, berlin)
+	for _, user := range []string{"john", "jane", "study-1", "study-2"} {
+		shifted := anonymizer.Shift(at, user, berlin).In(berlin)
+		if shifted.Hour() != 7 || shifted.Minute() != 30 {
+			t.Errorf("%s shifted to %v", user, shifted)
+		}
+		if days := anonymizer.ShiftDays(user); !shifted.Equal(time.Date(2022, 3, 20+days, 7, 30, 0, 0, berlin)) {
+			t.Errorf("%s shifted to %v, expected %d days", user, shifted, days)
+		}
+	}
+}
+
+func anonymizedTreatments(entries []model.NsTreatment, deletes chan Deletion, options Options) []string {
+	queue := make(chan model.NsTreatment)
+	return run(func() {
+		for _, entry := range entries {
+			queue <- entry
+		}
+		close(queue)
+	}, func(points chan<- write.Point) {
+		Treatments(points, deletes, NewDeduplicator(time.Minute), queue, options)
+	})
+}
+
+func TestTreatmentsAnonymized(t *testing.T) {
+	var anonymizer = &Anonymizer{Secret: "secret", MaxShiftDays: 30}
+	var options = testOptions
+	options.Anonymizer = anonymizer
+	options.Tags = map[string]string{"clinic": "St. John's"}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var createdAt = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	var invalid = false
+	var entries = []model.NsTreatment{
+		{Identifier: "note", EventType: "Note", Notes: "lunch with Jane", EnteredBy: "John's phone", User: "john", Location: berlin, CreatedAt: createdAt,
+			Glucose: 120, Profile: "John's", PumpType: "John's pump", Extra: map[string]interface{}{"pumpSerial": "John 123"}},
+		{Identifier: "site", EventType: "Site Change", EnteredBy: "John's phone", User: "john", Location: berlin, CreatedAt: createdAt.Add(time.Hour)},
+		{Identifier: "deleted", EventType: "Meal Bolus", Insulin: 2, IsValid: &invalid, User: "john", Location: berlin, CreatedAt: createdAt.Add(2 * time.Hour)},
+	}
+
+	deletes := make(chan Deletion, 1)
+	lines := anonymizedTreatments(entries, deletes, options)
+	if len(lines) != 2 {
+		t.Fatalf("unexpected points %v", lines)
+	}
+	for i, line := range lines {
+		for _, leak := range []string{"john", "John", "Jane", "enteredBy", "note,", "site,", "clinic", "profile", "pumpType", "pumpSerial"} {
+			if strings.Contains(line, leak) {
+				t.Errorf("%q leaks %q", line, leak)
+			}
+		}
+		// the weekday is the one of the shifted time, Wednesday 2022-06-08 is shifted by 8 days back
+		if !strings.Contains(line, "user="+anonymizer.Pseudonym("john")) || !strings.Contains(line, fmt.Sprintf("local_hour=%02d", 8+i)) ||
+			!strings.Contains(line, "weekday=Tuesday") {
+			t.Errorf("%q not tagged with the pseudonym and local time", line)
+		}
+	}
+	// numbers of whitelisted fields can't name anyone
+	if !strings.Contains(lines[0], "glucose=120") {
+		t.Errorf("numeric field dropped from %q", lines[0])
+	}
+	// notes derived from the event type are kept, they are not free text
+	if !strings.Contains(lines[1], `notes="Site Change"`) {
+		t.Errorf("event type note dropped from %q", lines[1])
+	}
+
+	var shifted = entries[2].CreatedAt.In(berlin).AddDate(0, 0, anonymizer.ShiftDays("john")).UTC()
+	deleted := <-deletes
+	if expected := (Deletion{Measurement: "treatments", User: anonymizer.Pseudonym("john"), Id: anonymizer.id("deleted"), Time: shifted}); deleted != expected {
+		t.Errorf("deletion %+v, expected %+v", deleted, expected)
+	}
+
+	anonymizer.RedactText = true
+	lines = anonymizedTreatments(entries[:1], nil, options)
+	if len(lines) != 1 || !strings.Contains(lines[0], `notes="`+Redacted+`"`) || !strings.Contains(lines[0], "enteredBy="+Redacted) ||
+		!strings.Contains(lines[0], `profile="`+Redacted+`"`) || !strings.Contains(lines[0], "pumpType="+Redacted) {
+		t.Errorf("free text not redacted: %v", lines)
+	}
+}
@@ -0,0 +1,121 @@
+package transform
+
+import (
+	"fmt"
+	"ns-exporter/model"
+	"sync"
+	"time"
+)
+
+// Deduplicator recognizes records which were already seen during the run, either by one of their identity keys
+// or, when one of them has no key, by equal content less than the time tolerance apart. Records with different
+// keys are different records, however equal their content. It is shared by all sources, so the same record read
+// from both Mongo and NS is written only once.
+type Deduplicator struct {
+	tolerance  time.Duration
+	mutex      sync.Mutex
+	keys       map[string]bool
+	contents   map[string][]seenContent
+	duplicates int
+}
+
+// seenContent is the time of a registered content and whether its record had an identity key
+type seenContent struct {
+	at    time.Time
+	keyed bool
+}
+
+func NewDeduplicator(tolerance time.Duration) *Deduplicator {
+	return &Deduplicator{
+		tolerance: tolerance,
+		keys:      map[string]bool{},
+		contents:  map[string][]seenContent{},
+	}
+}
+
+// Seen registers the record and reports whether it is a duplicate of an already registered one.
+// Empty keys and content are ignored.
+func (d *Deduplicator) Seen(user string, keys []string, content string, at time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var duplicate, keyed = false, false
+	for _, key := range keys {
+		if key != "" {
+			keyed = true
+			duplicate = duplicate || d.keys[user+"|"+key]
+		}
+	}
+
+	var contentKey = user + "|" + content
+	if !duplicate && content != "" {
+		for _, seen := range d.contents[contentKey] {
+			if keyed && seen.keyed {
+				continue
+			}
+			if diff := at.Sub(seen.at); diff < d.tolerance && diff > -d.tolerance {
+				duplicate = true
+				break
+			}
+		}
+	}
+
+	// keys of duplicates are registered as well, so a third copy known under another key is recognized too
+	for _, key := range keys {
+		if key != "" {
+			d.keys[user+"|"+key] = true
+		}
+	}
+	if duplicate {
+		d.duplicates++
+		return true
+	}
+	if content != "" {
+		d.contents[contentKey] = append(d.contents[contentKey], seenContent{at: at, keyed: keyed})
+	}
+	return false
+}
+
+func (d *Deduplicator) Duplicates() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.duplicates
+}
+
+// entryIdentity returns identity keys of the devicestatus, APIv3 falls back to the Mongo _id for identifier
+// so both share the same key space
+func entryIdentity(entry model.NsEntry) []string {
+	return []string{idKey(entry.ID), idKey(entry.Identifier)}
+}
+
+func entryContent(entry model.NsEntry) string {
+	if entry.OpenAps.Suggested.Bg <= 0 {
+		return ""
+	}
+	return fmt.Sprint("devicestatus|", entry.OpenAps.Suggested.Bg, "|", entry.OpenAps.Suggested.Tick, "|",
+		entry.OpenAps.IOB.IOB, "|", entry.OpenAps.Suggested.EventualBG)
+}
+
+func treatmentIdentity(entry model.NsTreatment) []string {
+	var keys = []string{idKey(entry.ID), idKey(entry.Identifier)}
+	if entry.PumpId != 0 {
+		keys = append(keys, fmt.Sprint("pump:", entry.PumpType, "|", entry.PumpId))
+	}
+	return keys
+}
+
+func treatmentContent(entry model.NsTreatment) string {
+	return fmt.Sprint("treatment|", entry.EventType, "|", entry.Insulin, "|", entry.Carbs, "|", entry.Duration, "|",
+		entry.Rate, "|", entry.Percent, "|", entry.TargetTop, "|", entry.TargetBottom, "|", entry.Notes)
+}
+
+func sgvIdentity(entry model.NsSgv) []string {
+	return []string{idKey(entry.ID), idKey(entry.Identifier)}
+}
+
+func idKey(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "id:" + id
+}
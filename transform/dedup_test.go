@@ -0,0 +1,40 @@
+package transform
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	var at = time.Date(2022, 6, 8, 10, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		name      string
+		first     []string
+		second    []string
+		offset    time.Duration
+		duplicate bool
+	}{
+		{"same key", []string{"id:a"}, []string{"", "id:a"}, time.Hour, true},
+		// two SMBs of equal size are different records when their keys differ
+		{"different keys", []string{"id:a", "pump:DASH|1"}, []string{"id:b", "pump:DASH|2"}, 0, false},
+		{"first without key", nil, []string{"id:b"}, 30 * time.Second, true},
+		{"second without key", []string{"id:a"}, []string{""}, -30 * time.Second, true},
+		{"at the tolerance", nil, nil, time.Minute, false},
+		{"beyond the tolerance", nil, nil, -2 * time.Minute, false},
+	}
+	for _, c := range cases {
+		dedup := NewDeduplicator(time.Minute)
+		if dedup.Seen("john", c.first, "treatment|SMB|0.1", at) {
+			t.Fatalf("%s: first record is a duplicate", c.name)
+		}
+		if seen := dedup.Seen("john", c.second, "treatment|SMB|0.1", at.Add(c.offset)); seen != c.duplicate {
+			t.Errorf("%s: duplicate %v, expected %v", c.name, seen, c.duplicate)
+		}
+	}
+	// other users and content are never duplicates
+	dedup := NewDeduplicator(time.Minute)
+	dedup.Seen("john", nil, "treatment|SMB|0.1", at)
+	if dedup.Seen("jane", nil, "treatment|SMB|0.1", at) || dedup.Seen("john", nil, "treatment|SMB|0.2", at) {
+		t.Error("records of other users or content are duplicates")
+	}
+}
@@ -0,0 +1,122 @@
+package transform
+
+import (
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/schema"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Gap is a time without records of a collection longer than the threshold
+type Gap struct {
+	User       string
+	Collection string
+	Start      time.Time
+	End        time.Time
+	// Ongoing gaps last until the end of the run, no record after them was read yet
+	Ongoing  bool
+	Location *time.Location
+}
+
+func (g Gap) Duration() time.Duration {
+	return g.End.Sub(g.Start)
+}
+
+func (g Gap) String() string {
+	var text = fmt.Sprintf("%s of user %q from %s to %s (%s)", g.Collection, g.User, g.Start.UTC().Format(time.RFC3339), g.End.UTC().Format(time.RFC3339), g.Duration().Round(time.Minute))
+	if g.Ongoing {
+		text += ", ongoing"
+	}
+	return text
+}
+
+// Gaps finds the gaps in the records of an import. The latest record of every collection is kept between runs,
+// so gaps spanning runs are found too, and gaps ending before it are not reported again.
+type Gaps struct {
+	threshold time.Duration
+	mutex     sync.Mutex
+	times     map[string][]time.Time
+	latest    map[string]time.Time
+	locations map[string]*time.Location
+}
+
+func NewGaps(threshold time.Duration) *Gaps {
+	return &Gaps{
+		threshold: threshold,
+		times:     map[string][]time.Time{},
+		latest:    map[string]time.Time{},
+		locations: map[string]*time.Location{},
+	}
+}
+
+// Record registers the time of a record of the collection read in the current run
+func (g *Gaps) Record(collection string, at time.Time, location *time.Location) {
+	if at.IsZero() {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.times[collection] = append(g.times[collection], at)
+	g.locations[collection] = location
+}
+
+// Detect returns the gaps in the records of the run, ordered by collection and start, and starts the next run.
+// A gap from the latest record until the end of the run, unless it is zero, is reported as ongoing.
+func (g *Gaps) Detect(user string, end time.Time) []Gap {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var collections []string
+	for collection := range g.latest {
+		collections = append(collections, collection)
+	}
+	for collection := range g.times {
+		if _, ok := g.latest[collection]; !ok {
+			collections = append(collections, collection)
+		}
+	}
+	sort.Strings(collections)
+
+	var gaps []Gap
+	for _, collection := range collections {
+		var previous = g.latest[collection]
+		var times = g.times[collection]
+		if !previous.IsZero() {
+			times = append(times, previous)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i := 1; i < len(times); i++ {
+			// gaps ending before the latest record of the previous run were reported by it
+			if times[i].Sub(times[i-1]) > g.threshold && times[i].After(previous) {
+				gaps = append(gaps, Gap{User: user, Collection: collection, Start: times[i-1], End: times[i], Location: g.locations[collection]})
+			}
+		}
+		var latest = times[len(times)-1]
+		if !end.IsZero() && end.Sub(latest) > g.threshold {
+			gaps = append(gaps, Gap{User: user, Collection: collection, Start: latest, End: end, Ongoing: true, Location: g.locations[collection]})
+		}
+		g.latest[collection] = latest
+	}
+	g.times = map[string][]time.Time{}
+	return gaps
+}
+
+// GapPoint is the gaps point of the gap, at its start with the collection as type. An ongoing gap is written
+// again by later runs and finally when it ends, at the same time so the point is replaced.
+func GapPoint(gap Gap, options Options) (*write.Point, error) {
+	var end = options.time(gap.End, gap.User, gap.Location)
+	point := newSchemaPoint(schema.Gaps)
+	point.AddTag("type", gap.Collection)
+	point.
+		field("end", end.UTC().Format(time.RFC3339)).
+		field("duration", gap.Duration().Minutes()).
+		field("ongoing", gap.Ongoing).
+		SetTime(options.time(gap.Start, gap.User, gap.Location))
+	if gap.User != "" {
+		point.AddTag("user", options.UserTag(gap.User))
+	}
+	options.addTags(point.Point)
+	return point.Point, point.err()
+}
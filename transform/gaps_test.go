@@ -0,0 +1,88 @@
+package transform
+
+import (
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGaps(t *testing.T) {
+	var at = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+	gaps := NewGaps(30 * time.Minute)
+	// newest first, as the sources read them
+	for _, minutes := range []int{120, 115, 60, 55, 50, 0} {
+		gaps.Record("devicestatus", at.Add(time.Duration(minutes)*time.Minute), nil)
+	}
+	gaps.Record("entries", at.Add(115*time.Minute), nil)
+
+	var found = gaps.Detect("john", at.Add(2*time.Hour+10*time.Minute))
+	// the time since the latest records is below the threshold
+	var expected = []string{
+		`devicestatus of user "john" from 2022-06-08T06:00:00Z to 2022-06-08T06:50:00Z (50m0s)`,
+		`devicestatus of user "john" from 2022-06-08T07:00:00Z to 2022-06-08T07:55:00Z (55m0s)`,
+	}
+	if !equalGaps(found, expected) {
+		t.Errorf("unexpected gaps %v, expected %v", found, expected)
+	}
+
+	// the next run reads some of the same records again, the gap between them was reported already,
+	// and the phone stopped uploading since
+	gaps.Record("devicestatus", at.Add(120*time.Minute), nil)
+	gaps.Record("devicestatus", at.Add(60*time.Minute), nil)
+	found = gaps.Detect("john", at.Add(4*time.Hour))
+	expected = []string{
+		`devicestatus of user "john" from 2022-06-08T08:00:00Z to 2022-06-08T10:00:00Z (2h0m0s), ongoing`,
+		`entries of user "john" from 2022-06-08T07:55:00Z to 2022-06-08T10:00:00Z (2h5m0s), ongoing`,
+	}
+	if !equalGaps(found, expected) {
+		t.Errorf("unexpected gaps of the next run %v, expected %v", found, expected)
+	}
+
+	// uploads resumed, the gap ends at the first new record and is written at the same time again
+	gaps.Record("devicestatus", at.Add(5*time.Hour), nil)
+	found = gaps.Detect("john", time.Time{})
+	expected = []string{`devicestatus of user "john" from 2022-06-08T08:00:00Z to 2022-06-08T11:00:00Z (3h0m0s)`}
+	if !equalGaps(found, expected) {
+		t.Errorf("unexpected gaps after resume %v, expected %v", found, expected)
+	}
+}
+
+func TestGapPoint(t *testing.T) {
+	var gap = Gap{User: "john", Collection: "entries", Start: time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC), End: time.Date(2022, 6, 8, 7, 30, 0, 0, time.UTC), Ongoing: true}
+	var line = gapLine(t, gap, Options{Tags: map[string]string{"site": "home"}})
+	var expected = `gaps,type=entries,user=john,site=home end="2022-06-08T07:30:00Z",duration=90,ongoing=true 1654668000000000000`
+	if line != expected {
+		t.Errorf("unexpected point %s, expected %s", line, expected)
+	}
+	// anonymized gaps are shifted and pseudonymized like the records
+	var anonymized = gapLine(t, gap, Options{Anonymizer: &Anonymizer{Secret: "secret", MaxShiftDays: 10}})
+	if strings.Contains(anonymized, "john") || strings.Contains(anonymized, "2022-06-08T07:30:00Z") || !strings.Contains(anonymized, "duration=90,") {
+		t.Errorf("unexpected anonymized point %s", anonymized)
+	}
+}
+
+func gapLine(t *testing.T, gap Gap, options Options) string {
+	t.Helper()
+	point, err := GapPoint(gap, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pointLine(point)
+}
+
+func pointLine(point *write.Point) string {
+	return strings.TrimSuffix(write.PointToLineProtocol(point, time.Nanosecond), "\n")
+}
+
+func equalGaps(gaps []Gap, expected []string) bool {
+	if len(gaps) != len(expected) {
+		return false
+	}
+	for i, gap := range gaps {
+		if gap.String() != expected[i] {
+			return false
+		}
+	}
+	return true
+}
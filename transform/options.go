@@ -0,0 +1,115 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"ns-exporter/model"
+	"time"
+)
+
+const (
+	IdField = "field"
+	IdTag   = "tag"
+)
+
+// Options control the optional fields and tags of the written points
+type Options struct {
+	// ExtraFields are treatment fields written as Influx fields
+	ExtraFields []string
+	// ExtraTags are treatment fields written as Influx tags
+	ExtraTags []string
+	// IdMode writes the record id as IdField or IdTag, empty omits it
+	IdMode        string
+	SourceTags    bool
+	LocalTimeTags bool
+	// Tags are added to every point, e.g. to tell groups of users apart, unless anonymized
+	Tags map[string]string
+	// Anonymizer pseudonymizes users, ids, free text and times, nil writes them as they are
+	Anonymizer *Anonymizer
+}
+
+// ReservedTags are written by the transforms and can't be overridden by Tags
+var ReservedTags = []string{"user", "id", "type", "smb", "device", "enteredBy", "local_hour", "weekday"}
+
+// addTags adds the configured tags, anonymized points go without them as they may tell users apart
+func (o Options) addTags(point *write.Point) {
+	if o.Anonymizer != nil {
+		return
+	}
+	for name, value := range o.Tags {
+		point.AddTag(name, value)
+	}
+}
+
+// addId writes the record id to the point according to the id mode
+func (o Options) addId(point *write.Point, id string) {
+	if id == "" {
+		return
+	}
+	switch o.IdMode {
+	case IdField:
+		point.AddField("id", o.id(id))
+	case IdTag:
+		point.AddTag("id", o.id(id))
+	}
+}
+
+// deletion matches the point as it was written, anonymized the same way
+func (o Options) deletion(measurement string, user string, id string, at time.Time, location *time.Location) Deletion {
+	var result = Deletion{Measurement: measurement, User: o.UserTag(user), Time: o.time(at, user, location)}
+	if o.IdMode == IdTag {
+		result.Id = o.id(id)
+	}
+	return result
+}
+
+// addLocalTime tags the point with hour and weekday of its time in the location of the user.
+// Anonymized points are tagged by their shifted time, as the original weekday would reveal the shift.
+func (o Options) addLocalTime(point *write.Point, at time.Time, location *time.Location) {
+	if !o.LocalTimeTags || location == nil {
+		return
+	}
+	local := at.In(location)
+	point.
+		AddTag("local_hour", local.Format("15")).
+		AddTag("weekday", local.Weekday().String())
+}
+
+// Deletion identifies the point written for a record which has been soft-deleted since.
+// Id is set when ids are written as tags, which sync-deletes requires, as every point of the user at the time would match.
+type Deletion struct {
+	Measurement string
+	User        string
+	Id          string
+	Time        time.Time
+}
+
+// recordId prefers APIv3 identifier, which falls back to the Mongo _id for documents created without one
+func recordId(id string, identifier string) string {
+	if identifier != "" {
+		return identifier
+	}
+	return id
+}
+
+// influxValue converts decoded document values into types accepted as Influx fields
+func influxValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case model.Number:
+		return v.Float()
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case primitive.D:
+		return influxValue(v.Map())
+	case primitive.A, map[string]interface{}, []interface{}, primitive.M:
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprint(v)
+	}
+	return value
+}
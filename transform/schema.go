@@ -0,0 +1,61 @@
+package transform
+
+import (
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"ns-exporter/schema"
+)
+
+// schemaPoint is a point of a measurement of the schema, whose fields are added by their schema
+type schemaPoint struct {
+	*write.Point
+	measurement schema.Measurement
+	// failed keeps the first field missing in the schema, shared by the copies the field calls return
+	failed *error
+}
+
+func newSchemaPoint(measurement schema.Measurement) schemaPoint {
+	return schemaPoint{Point: influxdb2.NewPointWithMeasurement(measurement.Name), measurement: measurement, failed: new(error)}
+}
+
+// schemaField returns the field of the schema, a field missing in it is a bug of the transform
+func (p schemaPoint) schemaField(name string) (schema.Field, error) {
+	field, ok := p.measurement.Field(name)
+	if !ok {
+		return field, fmt.Errorf("field %q of %s is not in the schema", name, p.measurement.Name)
+	}
+	return field, nil
+}
+
+// fail keeps the first error of the point
+func (p schemaPoint) fail(err error) {
+	if *p.failed == nil {
+		*p.failed = err
+	}
+}
+
+// err returns the error of a field missing in the schema, the point is not to be written then
+func (p schemaPoint) err() error {
+	return *p.failed
+}
+
+// field adds the value converted to the type of the field
+func (p schemaPoint) field(name string, value interface{}) schemaPoint {
+	field, err := p.schemaField(name)
+	if err != nil {
+		p.fail(err)
+		return p
+	}
+	p.Point.AddField(name, field.Type.Value(value))
+	return p
+}
+
+// textField adds a text field, which is dropped or redacted when anonymized
+func (p schemaPoint) textField(options Options, name string, value interface{}) {
+	if _, err := p.schemaField(name); err != nil {
+		p.fail(err)
+		return
+	}
+	options.addTextField(p.Point, name, value)
+}
@@ -0,0 +1,179 @@
+package transform
+
+import (
+	"encoding/json"
+	"ns-exporter/model"
+	"ns-exporter/schema"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSchemaCoversGoldens keeps the schema in line with what the transforms write, the goldens cover every
+// optional tag and field
+func TestSchemaCoversGoldens(t *testing.T) {
+	var extra = map[string]bool{}
+	for _, name := range append(testOptions.ExtraFields, testOptions.ExtraTags...) {
+		extra[name] = true
+	}
+	files, err := filepath.Glob(filepath.Join("..", "testdata", "golden", "*.lp"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no goldens", err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			name, tags, fields := lineKeys(line)
+			measurement, ok := schema.Lookup(name)
+			if !ok {
+				t.Fatalf("%s: measurement %s not in schema", file, name)
+			}
+			for _, tag := range tags {
+				if !extra[tag] && !hasTag(measurement, tag) {
+					t.Errorf("%s: tag %s of %s not in schema", filepath.Base(file), tag, name)
+				}
+			}
+			for _, field := range fields {
+				if _, ok := measurement.Field(field); !ok && !extra[field] {
+					t.Errorf("%s: field %s of %s not in schema", filepath.Base(file), field, name)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemaPoint(t *testing.T) {
+	// values are converted to the type of the schema
+	var point = newSchemaPoint(schema.Treatments).field("carbs", 20.0).field("bolus", int64(2))
+	point.AddTag("user", "john")
+	var line = pointLine(point.Point)
+	if line != "treatments,user=john carbs=20i,bolus=2" {
+		t.Errorf("unexpected point %s", line)
+	}
+	if point.err() != nil {
+		t.Error(point.err())
+	}
+	// fields missing in the schema fail the point
+	point.field("iob", 1.0).textField(Options{}, "device", "rig")
+	if pointLine(point.Point) != line || point.err() == nil || !strings.Contains(point.err().Error(), `"iob"`) {
+		t.Errorf("field missing in the schema written: %s, %v", pointLine(point.Point), point.err())
+	}
+}
+
+// TestSchemaCoversTransforms runs records taking every branch of the transforms and checks the tags and fields
+// of their points against the schema, whether or not the goldens reach them
+func TestSchemaCoversTransforms(t *testing.T) {
+	var deviceStatuses = decodeRecords[model.NsEntry](t, `[{"device": "openaps://phone", "created_at": "2022-06-08T06:00:00Z", "openaps": {
+		"iob": {"iob": 1.5, "basaliob": 0.5, "activity": 0.01},
+		"suggested": {"bg": 120, "tick": 2, "eventualBG": 110, "targetBG": 100, "insulinReq": 0.2, "sensitivityRatio": 1.1, "COB": 20,
+			"units": 0.3, "rate": 0.8, "duration": 30, "predBGs": {"IOB": [120, 110], "ZT": [120, 100], "COB": [120, 130], "UAM": [120, 125]},
+			"reason": "COB: 20, Dev: 5, BGI: -1, ISF: 40/45=42, CR: 10, Target: 100"}}}]`)
+	var treatments = decodeRecords[model.NsTreatment](t, `[
+		{"eventType": "Meal Bolus", "carbs": 20, "insulin": 2, "enteredBy": "AAPS", "glucose": 120, "pumpType": "DANA", "created_at": "2022-06-08T06:00:00Z"},
+		{"eventType": "Temp Basal", "duration": 30, "percent": -20, "rate": 0.8, "created_at": "2022-06-08T06:10:00Z"},
+		{"eventType": "Temporary Target", "duration": 60, "targetTop": 140, "targetBottom": 120, "units": "mg/dl", "reason": "Activity", "created_at": "2022-06-08T06:20:00Z"},
+		{"eventType": "Note", "notes": "lunch", "created_at": "2022-06-08T06:30:00Z"},
+		{"eventType": "Site Change", "created_at": "2022-06-08T06:40:00Z"}]`)
+	var entries = decodeRecords[model.NsSgv](t, `[
+		{"type": "sgv", "sgv": 120, "direction": "Flat", "noise": 1, "device": "xDrip", "date": 1654668000000},
+		{"type": "mbg", "mbg": 110, "date": 1654668300000}]`)
+	var gap = Gap{User: "john", Collection: "entries", Start: time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC), End: time.Date(2022, 6, 8, 7, 0, 0, 0, time.UTC)}
+
+	var lines = append(transformDeviceStatuses(deviceStatuses, nil), transformTreatments(treatments, nil)...)
+	lines = append(append(lines, transformEntries(entries, nil)...), gapLine(t, gap, testOptions))
+	if expected := len(deviceStatuses) + len(treatments) + len(entries) + 1; len(lines) != expected {
+		t.Fatalf("%d points, expected %d: %v", len(lines), expected, lines)
+	}
+	var extra = map[string]bool{}
+	for _, name := range append(testOptions.ExtraFields, testOptions.ExtraTags...) {
+		extra[name] = true
+	}
+	for _, line := range lines {
+		name, tags, fields := lineKeys(line)
+		measurement, ok := schema.Lookup(name)
+		if !ok {
+			t.Fatalf("measurement %s not in schema", name)
+		}
+		for _, tag := range tags {
+			if !extra[tag] && !hasTag(measurement, tag) {
+				t.Errorf("tag %s of %s not in schema", tag, name)
+			}
+		}
+		for _, field := range fields {
+			if _, ok := measurement.Field(field); !ok && !extra[field] {
+				t.Errorf("field %s of %s not in schema", field, name)
+			}
+		}
+	}
+	// the reason values are parsed
+	if _, _, fields := lineKeys(lines[0]); !strings.Contains(strings.Join(fields, ","), "isf_nt,isf_bg,isf,cr") {
+		t.Errorf("reason values missing in %s", lines[0])
+	}
+}
+
+// decodeRecords reads records from JSON as the NS client does
+func decodeRecords[T any, P interface {
+	*T
+	ResolveTime(*time.Location) error
+}](t *testing.T, data string) []T {
+	t.Helper()
+	var records []T
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if err := P(&records[i]).ResolveTime(time.UTC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return records
+}
+
+func hasTag(measurement schema.Measurement, name string) bool {
+	for _, tag := range measurement.Tags {
+		if tag.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lineKeys returns the measurement, the tag keys and the field keys of a line protocol line
+func lineKeys(line string) (string, []string, []string) {
+	var sections = splitLine(line, ' ')
+	var series = splitLine(sections[0], ',')
+	var keys = func(pairs []string) []string {
+		var result []string
+		for _, pair := range pairs {
+			result = append(result, pair[:strings.Index(pair, "=")])
+		}
+		return result
+	}
+	return series[0], keys(series[1:]), keys(splitLine(sections[1], ','))
+}
+
+// splitLine splits at separators which are neither escaped nor quoted
+func splitLine(text string, separator byte) []string {
+	var parts []string
+	var start, quoted = 0, false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] == '"':
+			quoted = !quoted
+		case text[i] == separator && !quoted:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
@@ -0,0 +1,293 @@
+package transform
+
+import (
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"html"
+	"ns-exporter/model"
+	"ns-exporter/schema"
+	"regexp"
+	"strconv"
+)
+
+// reg matches the values of the reason, its groups are named by their fields
+var reg = regexp.MustCompile("Dev: (?P<dev>[-0-9.]+),.*ISF: (?:(?P<isf_nt>[-0-9.]+)/(?P<isf_bg>[-0-9.]+)+=)?(?P<isf>[-0-9.]+),.*CR: (?P<cr>[-0-9.]+)")
+
+// DeviceStatuses turns openaps devicestatuses into points until entries are closed and returns the number of points.
+// Soft-deleted records are sent to deletes, or dropped when deletes is nil.
+func DeviceStatuses(points chan<- write.Point, deletes chan<- Deletion, dedup *Deduplicator, entries <-chan model.NsEntry, options Options) int {
+
+	var count = 0
+
+	for entry := range entries {
+
+		if !entry.Valid() {
+			if deletes != nil {
+				deletes <- options.deletion(schema.OpenAps.Name, entry.User, recordId(entry.ID, entry.Identifier), entry.Time, entry.Location)
+			}
+			continue
+		}
+
+		if dedup.Seen(entry.User, entryIdentity(entry), entryContent(entry), entry.Time) {
+			// deduplication, because nightscout still allows duplicate records to be added
+			fmt.Println("skipping duplicate devicestatus record: ", entry.Time, ", bg: ", entry.OpenAps.Suggested.Bg, ", tick: ", entry.OpenAps.Suggested.Tick)
+			continue
+		}
+
+		point := newSchemaPoint(schema.OpenAps).
+			field("iob", entry.OpenAps.IOB.IOB.Float()).
+			field("basal_iob", entry.OpenAps.IOB.BasalIOB.Float()).
+			field("activity", entry.OpenAps.IOB.Activity.Float())
+		point.SetTime(options.time(entry.Time, entry.User, entry.Location))
+
+		if entry.User != "" {
+			point.AddTag("user", options.UserTag(entry.User))
+		}
+		options.addTags(point.Point)
+		options.addId(point.Point, recordId(entry.ID, entry.Identifier))
+		if options.SourceTags && entry.Device != "" {
+			options.addTextTag(point.Point, "device", entry.Device)
+		}
+		options.addLocalTime(point.Point, point.Time(), entry.Location)
+
+		if entry.OpenAps.Suggested.Bg > 0 {
+			point.
+				field("bg", entry.OpenAps.Suggested.Bg.Float()).
+				field("tick", entry.OpenAps.Suggested.Tick.Float()).
+				field("eventual_bg", entry.OpenAps.Suggested.EventualBG.Float()).
+				field("target_bg", entry.OpenAps.Suggested.TargetBG.Float()).
+				field("insulin_req", entry.OpenAps.Suggested.InsulinReq.Float()).
+				field("cob", entry.OpenAps.Suggested.COB.Float()).
+				field("bolus", entry.OpenAps.Suggested.Units.Float()).
+				field("tbs_rate", entry.OpenAps.Suggested.Rate.Float()).
+				field("tbs_duration", entry.OpenAps.Suggested.Duration.Int()).
+				field("sens", entry.OpenAps.Suggested.SensitivityRatio.Float())
+
+			if len(entry.OpenAps.Suggested.PredBGs.COB) > 0 {
+				point.field("pred_cob", entry.OpenAps.Suggested.PredBGs.COB[len(entry.OpenAps.Suggested.PredBGs.COB)-1].Float())
+			}
+			if len(entry.OpenAps.Suggested.PredBGs.IOB) > 0 {
+				point.field("pred_iob", entry.OpenAps.Suggested.PredBGs.IOB[len(entry.OpenAps.Suggested.PredBGs.IOB)-1].Float())
+			}
+			if len(entry.OpenAps.Suggested.PredBGs.UAM) > 0 {
+				point.field("pred_uam", entry.OpenAps.Suggested.PredBGs.UAM[len(entry.OpenAps.Suggested.PredBGs.UAM)-1].Float())
+			}
+			if len(entry.OpenAps.Suggested.PredBGs.ZT) > 0 {
+				point.field("pred_zt", entry.OpenAps.Suggested.PredBGs.ZT[len(entry.OpenAps.Suggested.PredBGs.ZT)-1].Float())
+			}
+			if len(entry.OpenAps.Suggested.Reason) > 0 {
+				matches := reg.FindStringSubmatch(entry.OpenAps.Suggested.Reason)
+				names := reg.SubexpNames()
+				for i, match := range matches {
+					if i != 0 {
+						if len(match) > 0 {
+							if rvalue, err := strconv.ParseFloat(match, 32); err == nil {
+								point.field(names[i], rvalue)
+							}
+						}
+					}
+				}
+
+				point.textField(options, "reason", html.UnescapeString(entry.OpenAps.Suggested.Reason))
+			}
+		}
+
+		if err := point.err(); err != nil {
+			fmt.Println("skipping devicestatus: ", err)
+			continue
+		}
+		count++
+		points <- *point.Point
+
+		fmt.Println("treatment time+: ", entry.Time, "iob:", entry.OpenAps.IOB.IOB, ", bg: ", entry.OpenAps.Suggested.Bg)
+	}
+	fmt.Println("total devicestatuses parsed: ", count)
+	return count
+}
+
+// NotedEvents are event types written as notes of treatments without other values
+var NotedEvents = map[string]bool{
+	"Site Change":         true,
+	"Insulin Change":      true,
+	"Pump Battery Change": true,
+	"Sensor Change":       true,
+	"Sensor Start":        true,
+	"Sensor Stop":         true,
+	"BG Check":            true,
+	"Exercise":            true,
+	"Announcement":        true,
+	"Question":            true,
+	//"Note": true,
+	"OpenAPS Offline": true,
+	"D.A.D. Alert":    true,
+	"Mbg":             true,
+	//"Carb Correction": true,
+	//"Bolus Wizard": true,
+	//"Correction Bolus": true,
+	//"Meal Bolus": true,
+	//"Combo Bolus": true,
+	//"Temporary Target": true,
+	//"Temporary Target Cancel": true,
+	"Profile Switch": true,
+	//"Snack Bolus": true,
+	//"Temp Basal": true,
+	//"Temp Basal Start": true,
+	//"Temp Basal End": true,
+}
+
+// Treatments turns treatments into points until entries are closed and returns the number of points.
+// Soft-deleted records are sent to deletes, or dropped when deletes is nil.
+func Treatments(points chan<- write.Point, deletes chan<- Deletion, dedup *Deduplicator, entries <-chan model.NsTreatment, options Options) int {
+
+	var count = 0
+	for entry := range entries {
+
+		if !entry.Valid() {
+			if deletes != nil {
+				deletes <- options.deletion(schema.Treatments.Name, entry.User, recordId(entry.ID, entry.Identifier), entry.CreatedAt, entry.Location)
+			}
+			continue
+		}
+
+		if dedup.Seen(entry.User, treatmentIdentity(entry), treatmentContent(entry), entry.CreatedAt) {
+			fmt.Println("skipping duplicate treatment record: ", entry.CreatedAt, ", type: ", entry.EventType)
+			continue
+		}
+
+		point := newSchemaPoint(schema.Treatments)
+		point.SetTime(options.time(entry.CreatedAt, entry.User, entry.Location))
+
+		if entry.User != "" {
+			point.AddTag("user", options.UserTag(entry.User))
+		}
+		options.addTags(point.Point)
+		options.addId(point.Point, recordId(entry.ID, entry.Identifier))
+		if options.SourceTags && entry.EnteredBy != "" {
+			options.addTextTag(point.Point, "enteredBy", entry.EnteredBy)
+		}
+		options.addLocalTime(point.Point, point.Time(), entry.Location)
+
+		tagName := "type"
+		if entry.Carbs > 0 {
+			point.
+				field("carbs", entry.Carbs.Int()).
+				AddTag(tagName, "carbs")
+		}
+		if entry.Insulin > 0 {
+			point.
+				field("bolus", entry.Insulin.Float()).
+				AddTag(tagName, "bolus").
+				AddTag("smb", strconv.FormatBool(entry.IsSMB))
+		}
+		if entry.EventType == "Temp Basal" {
+			point.
+				field("duration", entry.Duration.Int()).
+				field("percent", entry.Percent.Int()).
+				field("rate", entry.Rate.Float()).
+				AddTag(tagName, "tbs")
+		} else if entry.EventType == "Temporary Target" {
+			point.
+				field("duration", entry.Duration.Int()).
+				field("target_top", entry.TargetTop.Float()).
+				field("target_bottom", entry.TargetBottom.Float()).
+				field("units", entry.Units).
+				AddTag(tagName, "tt")
+			point.textField(options, "reason", entry.Reason)
+		} else if len(entry.Notes) > 0 {
+			point.textField(options, "notes", entry.Notes)
+		} else if NotedEvents[entry.EventType] {
+			point.field("notes", entry.EventType)
+		}
+
+		for _, name := range options.ExtraFields {
+			if value, ok := entry.Lookup(name); ok {
+				if value, ok := options.extra(influxValue(value)); ok {
+					point.AddField(name, value)
+				}
+			}
+		}
+		for _, name := range options.ExtraTags {
+			if value, ok := entry.Lookup(name); ok {
+				if value, ok := options.extra(influxValue(value)); ok {
+					point.AddTag(name, fmt.Sprint(value))
+				}
+			}
+		}
+
+		if err := point.err(); err != nil {
+			fmt.Println("skipping treatment: ", err)
+			continue
+		}
+		count++
+		points <- *point.Point
+		fmt.Println("time: ", point.Time(), ", type: ", entry.EventType)
+	}
+
+	fmt.Println("total treatments parsed: ", count)
+	return count
+}
+
+// Entries turns CGM readings and meter values into points until entries are closed and returns the number of points.
+// Calibrations and other entries without a glucose value are skipped.
+// Soft-deleted records are sent to deletes, or dropped when deletes is nil.
+func Entries(points chan<- write.Point, deletes chan<- Deletion, dedup *Deduplicator, entries <-chan model.NsSgv, options Options) int {
+
+	var count = 0
+	for entry := range entries {
+
+		if !entry.Valid() {
+			if deletes != nil {
+				deletes <- options.deletion(schema.Entries.Name, entry.User, recordId(entry.ID, entry.Identifier), entry.Time, entry.Location)
+			}
+			continue
+		}
+		if entry.Sgv <= 0 && entry.Mbg <= 0 {
+			continue
+		}
+
+		// equal readings of 1-minute CGMs are only a minute apart, so entries are only recognized by their ids
+		if dedup.Seen(entry.User, sgvIdentity(entry), "", entry.Time) {
+			fmt.Println("skipping duplicate entry: ", entry.Time, ", type: ", entry.Type)
+			continue
+		}
+
+		point := newSchemaPoint(schema.Entries)
+		point.SetTime(options.time(entry.Time, entry.User, entry.Location))
+
+		if entry.User != "" {
+			point.AddTag("user", options.UserTag(entry.User))
+		}
+		options.addTags(point.Point)
+		options.addId(point.Point, recordId(entry.ID, entry.Identifier))
+		if options.SourceTags && entry.Device != "" {
+			options.addTextTag(point.Point, "device", entry.Device)
+		}
+		options.addLocalTime(point.Point, point.Time(), entry.Location)
+
+		if entry.Sgv > 0 {
+			point.
+				field("sgv", entry.Sgv.Int()).
+				AddTag("type", "sgv")
+			if entry.Direction != "" {
+				point.field("direction", entry.Direction)
+			}
+			if entry.Noise > 0 {
+				point.field("noise", entry.Noise.Int())
+			}
+		} else {
+			point.
+				field("mbg", entry.Mbg.Int()).
+				AddTag("type", "mbg")
+		}
+
+		if err := point.err(); err != nil {
+			fmt.Println("skipping entry: ", err)
+			continue
+		}
+		count++
+		points <- *point.Point
+	}
+
+	fmt.Println("total entries parsed: ", count)
+	return count
+}
@@ -0,0 +1,195 @@
+package transform
+
+import (
+	"flag"
+	"ns-exporter/internal/nstest"
+	"ns-exporter/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// testOptions enable every optional tag and field, so goldens cover all of them
+var testOptions = Options{
+	ExtraFields:   []string{"glucose", "profile", "percentage", "absorptionTime", "bolusCalculatorResult", "pumpSerial"},
+	ExtraTags:     []string{"pumpType"},
+	IdMode:        IdTag,
+	SourceTags:    true,
+	LocalTimeTags: true,
+}
+
+// run sends entries through the transform and returns the points as line protocol
+func run(entries func(), transform func(points chan<- write.Point)) []string {
+	points := make(chan write.Point)
+	done := make(chan struct{})
+	var lines []string
+	go func() {
+		for point := range points {
+			lines = append(lines, strings.TrimSuffix(write.PointToLineProtocol(&point, time.Nanosecond), "\n"))
+		}
+		close(done)
+	}()
+	go entries()
+	transform(points)
+	close(points)
+	<-done
+	return lines
+}
+
+func transformDeviceStatuses(entries []model.NsEntry, deletes chan Deletion) []string {
+	queue := make(chan model.NsEntry)
+	return run(func() {
+		for _, entry := range entries {
+			queue <- entry
+		}
+		close(queue)
+	}, func(points chan<- write.Point) {
+		DeviceStatuses(points, deletes, NewDeduplicator(time.Minute), queue, testOptions)
+	})
+}
+
+func transformTreatments(entries []model.NsTreatment, deletes chan Deletion) []string {
+	queue := make(chan model.NsTreatment)
+	return run(func() {
+		for _, entry := range entries {
+			queue <- entry
+		}
+		close(queue)
+	}, func(points chan<- write.Point) {
+		Treatments(points, deletes, NewDeduplicator(time.Minute), queue, testOptions)
+	})
+}
+
+// loadBSONFixture converts the fixture into BSON documents, as they would be read from Mongo
+func loadBSONFixture(t *testing.T, path string) []bson.Raw {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapper struct {
+		Records []bson.Raw `bson:"records"`
+	}
+	if err := bson.UnmarshalExtJSON([]byte(`{"records": `+string(data)+`}`), false, &wrapper); err != nil {
+		t.Fatal(err)
+	}
+	return wrapper.Records
+}
+
+// assertGolden compares lines with the golden file, or rewrites it with -update
+func assertGolden(t *testing.T, name string, lines []string) {
+	t.Helper()
+	path := filepath.Join("..", "testdata", "golden", name+".lp")
+	actual := strings.Join(lines, "\n") + "\n"
+	if *update {
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != string(expected) {
+		t.Errorf("%s differs from golden:\n--- actual\n%s--- expected\n%s", name, actual, expected)
+	}
+}
+
+func TestParseDeviceStatusesFromMongo(t *testing.T) {
+	for _, fixture := range nstest.Fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			var entries []model.NsEntry
+			for _, doc := range loadBSONFixture(t, filepath.Join("..", "testdata", "devicestatus", fixture+".json")) {
+				// MongoClient only reads documents with openaps section
+				if _, err := doc.LookupErr("openaps"); err != nil {
+					continue
+				}
+				var entry model.NsEntry
+				if err := bson.Unmarshal(doc, &entry); err != nil {
+					t.Fatal(err)
+				}
+				if err := entry.ResolveTime(nil); err != nil {
+					t.Fatal(err)
+				}
+				entry.User = "test"
+				entries = append(entries, entry)
+			}
+			assertGolden(t, "devicestatus_"+fixture, transformDeviceStatuses(entries, nil))
+		})
+	}
+}
+
+func TestParseTreatmentsFromMongo(t *testing.T) {
+	for _, fixture := range nstest.Fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			var entries []model.NsTreatment
+			for _, doc := range loadBSONFixture(t, filepath.Join("..", "testdata", "treatments", fixture+".json")) {
+				var entry model.NsTreatment
+				if err := bson.Unmarshal(doc, &entry); err != nil {
+					t.Fatal(err)
+				}
+				if err := entry.ResolveTime(nil); err != nil {
+					t.Fatal(err)
+				}
+				entry.User = "test"
+				entries = append(entries, entry)
+			}
+			assertGolden(t, "treatments_"+fixture, transformTreatments(entries, nil))
+		})
+	}
+}
+
+func TestParseTreatmentsDeletesInvalid(t *testing.T) {
+	var invalid = false
+	entry := model.NsTreatment{Identifier: "deleted", EventType: "Meal Bolus", Insulin: 2, IsValid: &invalid, User: "test"}
+	entry.CreatedAt = time.Date(2022, 6, 8, 6, 0, 0, 0, time.UTC)
+
+	deletes := make(chan Deletion, 1)
+	if lines := transformTreatments([]model.NsTreatment{entry}, deletes); len(lines) != 0 {
+		t.Errorf("invalid treatment written: %v", lines)
+	}
+	deleted := <-deletes
+	if expected := (Deletion{Measurement: "treatments", User: "test", Id: "deleted", Time: entry.CreatedAt}); deleted != expected {
+		t.Errorf("deletion %+v, expected %+v", deleted, expected)
+	}
+}
+
+func transformEntries(entries []model.NsSgv, deletes chan Deletion) []string {
+	queue := make(chan model.NsSgv)
+	return run(func() {
+		for _, entry := range entries {
+			queue <- entry
+		}
+		close(queue)
+	}, func(points chan<- write.Point) {
+		Entries(points, deletes, NewDeduplicator(time.Minute), queue, testOptions)
+	})
+}
+
+func TestParseEntriesFromMongo(t *testing.T) {
+	var entries []model.NsSgv
+	for _, doc := range loadBSONFixture(t, filepath.Join("..", "testdata", "entries", "aaps.json")) {
+		var entry model.NsSgv
+		if err := bson.Unmarshal(doc, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := entry.ResolveTime(nil); err != nil {
+			t.Fatal(err)
+		}
+		entry.User = "test"
+		entries = append(entries, entry)
+	}
+	// meter values are written as mbg, calibrations have no glucose value and are skipped
+	var at = time.Date(2022, 6, 8, 10, 7, 0, 0, time.UTC)
+	entries = append(entries,
+		model.NsSgv{Identifier: "meter", Type: "mbg", Mbg: 135, Time: at, User: "test"},
+		model.NsSgv{Identifier: "calibration", Type: "cal", Time: at, User: "test"})
+	assertGolden(t, "entries_aaps", transformEntries(entries, nil))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"ns-exporter/pipeline"
+	"ns-exporter/sink"
+	"ns-exporter/source"
+	"os"
+	"time"
+)
+
+// validateTimeout limits the checks when no timeout is configured
+const validateTimeout = 30 * time.Second
+
+// validate checks the settings and connects to every source and InfluxDb without reading or writing any records
+func validate(ctx context.Context, s *settings, out io.Writer) error {
+	var timeout = *s.timeout
+	if timeout <= 0 {
+		timeout = validateTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var problems = 0
+	report := func(subject string, err error) {
+		if err != nil {
+			problems++
+			fmt.Fprintf(out, "%s: error: %v\n", subject, err)
+		} else {
+			fmt.Fprintf(out, "%s: ok\n", subject)
+		}
+	}
+
+	if *s.configFile != "" {
+		fmt.Fprintf(out, "config %s: ok, %d imports\n", *s.configFile, len(s.file.Imports))
+	}
+	_, err := s.transformOptions()
+	report("options", err)
+
+	var entries = s.importEntries()
+	if len(entries) == 0 {
+		report("imports", fmt.Errorf("no import configured, set mongo-uri and mongo-db, ns-uri and ns-token, or imports in the config file"))
+	}
+	var pinged = map[influxTarget]bool{}
+	for i, entry := range entries {
+		var name = fmt.Sprintf("import %d (user %q)", i+1, entry.User)
+		settings, err := s.newImport(entry)
+		if err != nil {
+			report(name, err)
+			continue
+		}
+		if settings.MongoDb == "" && (settings.NsUri == "" || settings.NsToken == "") {
+			report(name, fmt.Errorf("neither mongo-db nor ns-uri with ns-token set"))
+			continue
+		}
+		if entry.User == "" && len(entries) > 1 {
+			report(name, fmt.Errorf("user must be set when there are multiple imports"))
+		}
+		if s.influxConfigured(entry) {
+			if target, err := s.influxTarget(entry); err != nil {
+				report(name+" influx", err)
+			} else if !pinged[target] {
+				pinged[target] = true
+				influx := target.newSink()
+				report(fmt.Sprintf("%s influx %s", name, target), influx.(sink.Pinger).Ping(ctx))
+				influx.Close()
+			}
+		}
+		if settings.MongoDb != "" {
+			report(fmt.Sprintf("%s mongo-db %s", name, settings.MongoDb), checkMongo(ctx, settings))
+		}
+		if settings.NsUri != "" && settings.NsToken != "" {
+			report(fmt.Sprintf("%s ns %s", name, settings.NsUri), checkNS(ctx, settings))
+		}
+	}
+
+	if s.postgresConfigured() {
+		report("postgres", checkPostgres(ctx, s))
+	}
+	if *s.sqliteFile != "" {
+		report("sqlite "+*s.sqliteFile, checkSQLite(ctx, *s.sqliteFile))
+	}
+	if *s.filesDir != "" {
+		report("files "+*s.filesDir, checkFiles(*s.filesDir, splitList(*s.filesFormats)))
+	}
+	if *s.otlpEndpoint != "" {
+		report("otlp "+*s.otlpEndpoint, checkOTLP(ctx, s))
+	}
+	if *s.mqttUri != "" {
+		report("mqtt "+*s.mqttUri, checkMQTT(ctx, s))
+	}
+	if *s.alertWebhooks != "" {
+		// webhooks are not called, a test message would reach people
+		_, err := s.monitor()
+		report(fmt.Sprintf("alert webhooks (%d)", len(splitList(*s.alertWebhooks))), err)
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	fmt.Fprintln(out, "configuration is valid")
+	return nil
+}
+
+func checkMongo(ctx context.Context, settings pipeline.Import) error {
+	if settings.MongoUri == "" {
+		return fmt.Errorf("mongo-uri not set")
+	}
+	client, err := source.NewMongoClient(settings.MongoUri, settings.MongoDb, source.Options{User: settings.User}, ctx)
+	if err != nil {
+		return err
+	}
+	client.Close(ctx)
+	return nil
+}
+
+func checkNS(ctx context.Context, settings pipeline.Import) error {
+	return source.NewNSClient(settings.NsUri, settings.NsToken, source.Options{User: settings.User}).Authorize(ctx)
+}
+
+func checkPostgres(ctx context.Context, s *settings) error {
+	postgres, err := s.postgres()
+	if err != nil {
+		return err
+	}
+	defer postgres.Close()
+	return postgres.Ping(ctx)
+}
+
+func checkSQLite(ctx context.Context, path string) error {
+	archive, err := sink.NewSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	return archive.Ping(ctx)
+}
+
+// checkFiles checks the formats are known and files can be created in the directory
+func checkFiles(dir string, formats []string) error {
+	if _, err := sink.NewFiles(dir, formats...); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".ns-exporter-")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func checkOTLP(ctx context.Context, s *settings) error {
+	otlp, err := s.otlp()
+	if err != nil {
+		return err
+	}
+	defer otlp.Close()
+	return otlp.Ping(ctx)
+}
+
+func checkMQTT(ctx context.Context, s *settings) error {
+	mqtt, err := s.mqtt()
+	if err != nil {
+		return err
+	}
+	defer mqtt.Close()
+	return mqtt.Ping(ctx)
+}